@@ -2,56 +2,118 @@ package main
 
 import (
 	"bufio"
-	"encoding/gob"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"time"
 
-	"log"
 	"math/rand"
 	"net"
 	"os"
 	"strings"
-)
 
-type CommandType int
-
-const (
-	ClientRequest CommandType = iota
-	CoordinatorResponse
-	CoordinatorRequest
-	CoordinatorPrepare
-	CoordinatorCommit
-	ParticipantResponse
-	ParticipantYes
-	ParticipantAbort
+	"bank/config"
+	"bank/logging"
+	"bank/protocol"
 )
 
-type Packet struct {
-	IsClient      bool
-	Id            string
-	TransactionId string
-	CommandType   CommandType
-	Command       string
+var clusterId = "default"
+
+var codecs = map[string]protocol.Codec{
+	"gob":  protocol.GobCodec{},
+	"json": protocol.JSONCodec{},
 }
 
-func ChooseServer(filename string) (net.Conn, error) {
-	content, err := ioutil.ReadFile(filename)
+var codecName = "gob"
+
+// transport is set by the configuration; with "grpc" branch ports serve
+// the Bank service rather than gob.
+var transport = "socket"
+
+// With a CA configured the client dials over mutual TLS, presenting
+// certs/<id>.crt.
+var tlsFiles protocol.TLSFiles
+var certDir = "certs"
+
+// token authenticates the client to branches that require one. It is read
+// from BANK_TOKEN so it stays out of the process list.
+var token = os.Getenv("BANK_TOKEN")
+
+// ChooseServer returns a random branch and the address of its listener for
+// the client's codec.
+func ChooseServer(filename string) (string, string, error) {
+	cfg, err := config.Load(filename)
 	if err != nil {
-		log.Fatal("Unable to read configuration file")
+		return "", "", err
 	}
-	lines := strings.Split(string(content), "\n")
-	index := rand.Intn(len(lines))
-	serverInfo := strings.Fields(lines[index])
-	log.Printf("Connecting to Branch %s", serverInfo[0])
-	if len(serverInfo) != 3 {
-		log.Fatal("Invalid config file")
+	clusterId = cfg.Cluster
+	transport = cfg.Transport
+	tlsFiles.CA = cfg.TLS.CA
+	certDir = cfg.TLS.Certs
+	branch := cfg.Branches[rand.Intn(len(cfg.Branches))]
+	logging.Network.Info("Connecting", logging.Peer(branch.Id), "codec", codecName)
+	address, ok := branch.ListenerAddress(codecName)
+	if !ok {
+		return "", "", fmt.Errorf("branch %s has no %s listener", branch.Id, codecName)
 	}
-	return net.Dial("tcp", serverInfo[1]+":"+serverInfo[2])
+	return branch.Id, address, nil
 }
 
-func WriteServer(connection net.Conn, input chan Packet) {
-	encoder := gob.NewEncoder(connection)
+// Connect reaches a branch over the cluster's transport. Packets sent on input
+// are answered on output, which is closed when the branch goes away.
+func Connect(id string, filename string, input chan protocol.Packet, output chan protocol.Packet) (io.Closer, error) {
+	branch, address, err := ChooseServer(filename)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if tlsFiles.Enabled() {
+		tlsConfig, err = tlsFiles.Resolve(certDir, id).Load()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = branch
+	}
+	if transport == "grpc" && codecName == "gob" {
+		return DialBank(address, tlsConfig, input, output)
+	}
+	var connection net.Conn
+	if tlsConfig != nil {
+		connection, err = tls.Dial("tcp", address, tlsConfig)
+	} else {
+		connection, err = net.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	go WriteServer(connection, codecs[codecName], input)
+	go ReadServer(connection, codecs[codecName], output)
+	return connection, nil
+}
+
+func ShakeHands(id string, input chan protocol.Packet, output chan protocol.Packet) error {
+	handshake := protocol.Handshake{Version: protocol.ProtocolVersion, Role: protocol.ClientRole, Id: id, ClusterId: clusterId, Features: protocol.SupportedFeatures, Token: token}
+	input <- protocol.Packet{Version: protocol.ProtocolVersion, IsClient: true, Id: id, CommandType: protocol.HandshakeRequest, Handshake: handshake}
+	packet, ok := <-output
+	if !ok {
+		return errors.New("connection closed during handshake")
+	}
+	if packet.Response.Status != protocol.StatusOK {
+		return errors.New(packet.Response.Message)
+	}
+	if packet.Handshake.Version != protocol.ProtocolVersion {
+		return fmt.Errorf("server speaks protocol version %d, expected %d", packet.Handshake.Version, protocol.ProtocolVersion)
+	}
+	if packet.Handshake.ClusterId != clusterId {
+		return fmt.Errorf("server belongs to cluster %q, expected %q", packet.Handshake.ClusterId, clusterId)
+	}
+	return nil
+}
+
+func WriteServer(connection net.Conn, codec protocol.Codec, input chan protocol.Packet) {
+	encoder := codec.NewEncoder(connection)
 	for {
 		packet := <-input
 		err := encoder.Encode(packet)
@@ -61,69 +123,112 @@ func WriteServer(connection net.Conn, input chan Packet) {
 	}
 }
 
-func ReadServer(connection net.Conn, output chan Packet) {
-	decoder := gob.NewDecoder(connection)
+func ReadServer(connection net.Conn, codec protocol.Codec, output chan protocol.Packet) {
+	decoder := codec.NewDecoder(connection)
 	for {
-		var packet Packet
+		var packet protocol.Packet
 		err := decoder.Decode(&packet)
 		if err != nil {
+			close(output)
 			return
 		}
 		output <- packet
 	}
 }
 
-func HandlePacket(packet Packet) (bool, string) {
-	if strings.Contains(packet.Command, "ABORTED") {
-		return false, packet.Command
-	} else if packet.Command == "COMMIT OK" {
-		return false, packet.Command
+func HandlePacket(request protocol.Request, packet protocol.Packet) (bool, string) {
+	switch packet.Response.Status {
+	case protocol.StatusOK, protocol.StatusInvalid, protocol.StatusSnapshotFailed, protocol.StatusPermissionDenied:
+		return true, protocol.FormatResponse(request, packet.Response)
 	}
-	return true, packet.Command
+	return false, protocol.FormatResponse(request, packet.Response)
 }
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.SetOutput(ioutil.Discard)
-	if len(os.Args) != 3 {
-		log.Fatal("Format should be ./client id configuration")
+	configFile := config.String(flag.CommandLine, "config", "BANK_CONFIG", "", "cluster configuration `file`")
+	id := config.String(flag.CommandLine, "id", "BANK_CLIENT_ID", "", "client `id`")
+	var logOptions logging.Options
+	config.StringVar(flag.CommandLine, &logOptions.Level, "log-level", "BANK_LOG_LEVEL", "warn", "least severe `level` logged, debug, info, warn or error, then any for subsystems, as in warn,commit=debug")
+	config.StringVar(flag.CommandLine, &logOptions.Format, "log-format", "BANK_LOG_FORMAT", "text", "`format` of logs: text, which is logfmt, or json")
+	config.StringVar(flag.CommandLine, &logOptions.Destination, "log", "BANK_LOG", "stderr", "stderr, stdout, off, or a `file` to append logs to")
+	config.StringVar(flag.CommandLine, &codecName, "codec", "BANK_CODEC", codecName, "`codec` to speak to branches: gob or json")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: client [flags] [id configuration]")
+		flag.PrintDefaults()
 	}
-	var connection net.Conn
-	var err error
+	flag.Parse()
+	// The id and configuration may still be given as arguments.
+	switch flag.NArg() {
+	case 0:
+	case 2:
+		*id, *configFile = flag.Arg(0), flag.Arg(1)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *id == "" || *configFile == "" {
+		fmt.Fprintln(os.Stderr, "An id and a configuration are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if _, ok := codecs[codecName]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown codec %q\n", codecName)
+		os.Exit(2)
+	}
+	if err := logging.Setup(logOptions, "client", *id); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	var connection io.Closer
 	var response string
-	var output chan Packet
-	var input chan Packet
-	id := os.Args[1]
+	var output chan protocol.Packet
+	var input chan protocol.Packet
 	scanner := bufio.NewScanner(os.Stdin)
 	inTransaction := false
 	transactionId := ""
 	for scanner.Scan() {
 		command := scanner.Text()
 		command = strings.TrimSpace(command)
-		log.Println(command)
-		if command == "BEGIN" {
+		logging.Commit.Debug("Command", "line", command, logging.Txn(transactionId))
+		request, err := protocol.ParseRequest(command)
+		if err != nil {
+			logging.Commit.Info("Invalid command", "line", command, "error", err)
+			if inTransaction {
+				fmt.Println("INVALID COMMAND")
+			}
+			continue
+		}
+		if request.Operation == protocol.OpBegin {
 			if connection != nil {
 				connection.Close()
 			}
-			connection, err = ChooseServer(os.Args[2])
+			input = make(chan protocol.Packet, 100)
+			output = make(chan protocol.Packet, 100)
+			connection, err = Connect(*id, *configFile, input, output)
 			if err != nil {
-				log.Println("Unable to connect")
+				logging.Network.Warn("Unable to connect", "error", err)
 				continue
 			}
-			input = make(chan Packet, 100)
-			output = make(chan Packet, 100)
-			go WriteServer(connection, input)
-			go ReadServer(connection, output)
+			err = ShakeHands(*id, input, output)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Handshake failed:", err)
+				os.Exit(1)
+			}
 			inTransaction = true
 			transactionId = ""
 		} else if !inTransaction {
 			continue
 		}
-		input <- Packet{true, id, transactionId, ClientRequest, command}
-		packet := <-output
+		input <- protocol.Packet{Version: protocol.ProtocolVersion, IsClient: true, Id: *id, TransactionId: transactionId, CommandType: protocol.ClientRequest, Request: request}
+		packet, ok := <-output
+		if !ok {
+			fmt.Println("CONNECTION CLOSED")
+			inTransaction = false
+			continue
+		}
 		transactionId = packet.TransactionId
-		inTransaction, response = HandlePacket(packet)
+		inTransaction, response = HandlePacket(request, packet)
 		fmt.Println(response)
 	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"bank/logging"
+	bankpb "bank/proto"
+	"bank/protocol"
+)
+
+// With transport=grpc each packet the client sends becomes a call on the Bank
+// service and each answer becomes a packet, so main reads the same channels it
+// reads for a socket.
+
+type bankCall func(bankpb.BankClient, context.Context, *bankpb.TransactionRequest, ...grpc.CallOption) (*bankpb.TransactionResponse, error)
+
+var bankCalls = map[protocol.Operation]bankCall{
+	protocol.OpBegin:    bankpb.BankClient.Begin,
+	protocol.OpDeposit:  bankpb.BankClient.Deposit,
+	protocol.OpWithdraw: bankpb.BankClient.Withdraw,
+	protocol.OpBalance:  bankpb.BankClient.Balance,
+	protocol.OpOpen:     bankpb.BankClient.Open,
+	protocol.OpClose:    bankpb.BankClient.Close,
+	protocol.OpHistory:  bankpb.BankClient.History,
+	protocol.OpSnapshot: bankpb.BankClient.Snapshot,
+	protocol.OpCommit:   bankpb.BankClient.Commit,
+	protocol.OpAbort:    bankpb.BankClient.Abort,
+	protocol.OpJoin:     bankpb.BankClient.Join,
+	protocol.OpLeave:    bankpb.BankClient.Leave,
+}
+
+// DialBank uses config for TLS unless it is nil.
+func DialBank(address string, config *tls.Config, input chan protocol.Packet, output chan protocol.Packet) (io.Closer, error) {
+	credential := insecure.NewCredentials()
+	if config != nil {
+		credential = credentials.NewTLS(config)
+	}
+	client, err := grpc.NewClient(address, grpc.WithTransportCredentials(credential))
+	if err != nil {
+		return nil, err
+	}
+	go CallBank(bankpb.NewBankClient(client), input, output)
+	return client, nil
+}
+
+// CallBank closes output once a call fails, as ReadServer does when the
+// connection drops.
+func CallBank(bank bankpb.BankClient, input chan protocol.Packet, output chan protocol.Packet) {
+	for {
+		packet := <-input
+		answer, err := CallPacket(bank, packet)
+		if err != nil {
+			logging.Network.Info("Call failed", logging.Command(packet.CommandType), logging.Txn(packet.TransactionId), "error", err)
+			close(output)
+			return
+		}
+		output <- answer
+	}
+}
+
+func CallPacket(bank bankpb.BankClient, packet protocol.Packet) (protocol.Packet, error) {
+	ctx := context.Background()
+	if packet.CommandType == protocol.HandshakeRequest {
+		handshake, err := bank.Handshake(ctx, protocol.HandshakeToProto(packet.Handshake))
+		if status.Code(err) == codes.FailedPrecondition {
+			refused := protocol.Response{Status: protocol.StatusRefused, Message: status.Convert(err).Message()}
+			return protocol.Packet{Version: protocol.ProtocolVersion, CommandType: protocol.HandshakeResponse, Response: refused}, nil
+		}
+		if err != nil {
+			return protocol.Packet{}, err
+		}
+		return protocol.Packet{Version: protocol.ProtocolVersion, CommandType: protocol.HandshakeResponse, Handshake: protocol.HandshakeFromProto(handshake)}, nil
+	}
+	call, ok := bankCalls[packet.Request.Operation]
+	if !ok {
+		return protocol.Packet{Version: protocol.ProtocolVersion, TransactionId: packet.TransactionId, CommandType: protocol.CoordinatorResponse, Response: protocol.Response{Status: protocol.StatusInvalid}}, nil
+	}
+	message := &bankpb.TransactionRequest{ClientId: packet.Id, TransactionId: packet.TransactionId, Request: protocol.RequestToProto(packet.Request), Token: token}
+	response, err := call(bank, ctx, message)
+	if err != nil {
+		return protocol.Packet{}, err
+	}
+	return protocol.Packet{Version: protocol.ProtocolVersion, TransactionId: response.GetTransactionId(), CommandType: protocol.CoordinatorResponse, Response: protocol.ResponseFromProto(response.GetResponse())}, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"bank/logging"
+)
+
+// A branch with an admin address serves read-only views of the transactions
+// and accounts on it, for finding out why one is stuck. Each object is
+// copied under its own lock, held only for the copy, so a view never blocks
+// transactions for long and is consistent per object rather than across
+// them. The views show balances and client ids, so they are served like the
+// HTTP gateway, over TLS when it is configured, and only to clients with the
+// admin permission on every account.
+var adminAddress string
+
+type TransactionView struct {
+	Id           string    `json:"id"`
+	Coordinator  string    `json:"coordinator"`
+	State        string    `json:"state"`
+	Finished     bool      `json:"finished"`
+	Session      string    `json:"session,omitempty"`
+	Client       string    `json:"client,omitempty"`
+	Began        time.Time `json:"began"`
+	Accounts     []string  `json:"accounts"`
+	Participants []string  `json:"participants"`
+	Members      []string  `json:"members,omitempty"`
+	Votes        []string  `json:"votes"`
+}
+
+type WriteView struct {
+	Transaction string `json:"transaction"`
+	Value       int    `json:"value"`
+	Committed   bool   `json:"committed"`
+	Closes      bool   `json:"closes,omitempty"`
+}
+
+type AccountView struct {
+	Id                string      `json:"id"`
+	Value             int         `json:"value"`
+	Closed            bool        `json:"closed"`
+	CommitTimestamp   string      `json:"commitTimestamp"`
+	SnapshotTimestamp string      `json:"snapshotTimestamp"`
+	Writes            []WriteView `json:"writes"`
+	Reads             []string    `json:"reads"`
+	Waiters           []Waiter    `json:"waiters"`
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// View copies what the admin endpoints show of the transaction. Votes are
+// the participants that voted yes while it was prepared here.
+func (t *Transaction) View() TransactionView {
+	t.RWMutex.RLock()
+	view := TransactionView{
+		Id:           t.Id,
+		Coordinator:  t.Id[strings.LastIndex(t.Id, ":")+1:],
+		State:        t.State.String(),
+		Finished:     t.Finished,
+		Session:      t.SessionId,
+		Began:        t.Began,
+		Accounts:     sortedKeys(t.Accounts),
+		Participants: sortedKeys(t.Participants),
+		Members:      append([]string(nil), t.Members...),
+		Votes:        sortedKeys(t.Responses),
+	}
+	t.RWMutex.RUnlock()
+	if node, ok := clients.Get(view.Session).(*Node); ok {
+		view.Client = node.ClientId
+	}
+	return view
+}
+
+// View copies what the admin endpoints show of the account. Writes after
+// the first are pending; the first is the committed state.
+func (a *Account) View() AccountView {
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+	view := AccountView{
+		Id:                a.Id,
+		Value:             a.Value,
+		Closed:            a.Closed,
+		CommitTimestamp:   a.CommitTimestamp,
+		SnapshotTimestamp: a.SnapshotTimestamp,
+		Writes:            make([]WriteView, 0, len(a.Writes)),
+		Reads:             append([]string{}, a.Reads...),
+		Waiters:           make([]Waiter, 0, len(a.Waiters)),
+	}
+	for _, write := range a.Writes {
+		view.Writes = append(view.Writes, WriteView{Transaction: write.Timestamp, Value: write.Value, Committed: write.Committed, Closes: write.Closes})
+	}
+	for _, waiter := range a.Waiters {
+		view.Waiters = append(view.Waiters, *waiter)
+	}
+	return view
+}
+
+// AdminMux routes the admin views, each behind RequireAdmin.
+func AdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("GET /admin/transactions", RequireAdmin(HandleAdminTransactions))
+	mux.Handle("GET /admin/transactions/{id}", RequireAdmin(HandleAdminTransaction))
+	mux.Handle("GET /admin/accounts", RequireAdmin(HandleAdminAccounts))
+	mux.Handle("GET /admin/accounts/{id}", RequireAdmin(HandleAdminAccount))
+	return mux
+}
+
+func ServeAdmin(address string) {
+	if tlsConfig == nil {
+		logging.Fatalf("Admin server stopped: %v", http.ListenAndServe(address, AdminMux()))
+	}
+	server := &http.Server{Addr: address, Handler: RequireClientCertificate(AdminMux()), TLSConfig: tlsConfig}
+	logging.Fatalf("Admin server stopped: %v", server.ListenAndServeTLS("", ""))
+}
+
+// RequireAdmin turns away callers that do not authenticate as for the HTTP
+// gateway, or lack the admin permission on every account.
+func RequireAdmin(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, reason := GatewayClient(r)
+		if reason != "" {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": reason})
+			return
+		}
+		if !HasPermission(client, PermissionAdmin, "*", "*") {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("client %q may not see admin views", client)})
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// HandleAdminTransactions lists transactions, or only those in the state
+// given as ?state=, such as OPEN or PREPARE.
+func HandleAdminTransactions(w http.ResponseWriter, r *http.Request) {
+	state := strings.ToUpper(r.URL.Query().Get("state"))
+	transactions.RWMutex.RLock()
+	all := make([]*Transaction, 0, len(transactions.Data))
+	for _, value := range transactions.Data {
+		all = append(all, value.(*Transaction))
+	}
+	transactions.RWMutex.RUnlock()
+	views := make([]TransactionView, 0, len(all))
+	for _, transaction := range all {
+		if view := transaction.View(); state == "" || view.State == state {
+			views = append(views, view)
+		}
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return TimestampGreater(views[j].Id, views[i].Id)
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"transactions": views})
+}
+
+func HandleAdminTransaction(w http.ResponseWriter, r *http.Request) {
+	transaction, ok := transactions.Get(r.PathValue("id")).(*Transaction)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such transaction"})
+		return
+	}
+	writeJSON(w, http.StatusOK, transaction.View())
+}
+
+// HandleAdminAccounts lists the accounts on this branch, or with ?pending=true
+// only those with pending writes, reads or waiters.
+func HandleAdminAccounts(w http.ResponseWriter, r *http.Request) {
+	pending := r.URL.Query().Get("pending") == "true"
+	accounts.RWMutex.RLock()
+	all := make([]*Account, 0, len(accounts.Data))
+	for _, value := range accounts.Data {
+		all = append(all, value.(*Account))
+	}
+	accounts.RWMutex.RUnlock()
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Id < all[j].Id
+	})
+	views := make([]AccountView, 0)
+	for _, account := range all {
+		view := account.View()
+		if !pending || len(view.Writes) > 1 || len(view.Reads) > 0 || len(view.Waiters) > 0 {
+			views = append(views, view)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"accounts": views})
+}
+
+func HandleAdminAccount(w http.ResponseWriter, r *http.Request) {
+	account := LookupAccount(r.PathValue("id"))
+	if account == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such account"})
+		return
+	}
+	writeJSON(w, http.StatusOK, account.View())
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getView(t *testing.T, path string, view any) int {
+	return getViewAs(t, "", "", path, view)
+}
+
+// getViewAs gets path as client, who gives token as the gateway's clients do.
+func getViewAs(t *testing.T, client string, token string, path string, view any) int {
+	request := httptest.NewRequest("GET", path, nil)
+	if client != "" {
+		request.SetBasicAuth(client, token)
+	}
+	recorder := httptest.NewRecorder()
+	AdminMux().ServeHTTP(recorder, request)
+	if err := json.Unmarshal(recorder.Body.Bytes(), view); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return recorder.Code
+}
+
+func TestAdminViews(t *testing.T) {
+	accounts.Init()
+	transactions.Init()
+	clients.Init()
+	concurrency = "wait"
+	account := &Account{}
+	account.Init("x")
+	accounts.Set("x", account)
+	writer := &Transaction{}
+	writer.Init("2:A", "tcp:1")
+	writer.AddAccount("x")
+	transactions.Set("2:A", writer)
+	if err := account.Write(5, "2:A"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later read waits for the tentative write, and shows as a waiter.
+	read := make(chan error)
+	go func() {
+		_, err := account.Read("3:A")
+		read <- err
+	}()
+	var view AccountView
+	for deadline := time.Now().Add(time.Second); len(view.Waiters) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("read never showed as waiting")
+		}
+		time.Sleep(time.Millisecond)
+		getView(t, "/admin/accounts/x", &view)
+	}
+	if view.Waiters[0].Transaction != "3:A" || view.Waiters[0].Operation != "read" {
+		t.Errorf("waiters = %+v", view.Waiters)
+	}
+	if len(view.Writes) != 2 || view.Writes[1].Transaction != "2:A" || view.Writes[1].Value != 5 || view.Writes[1].Committed {
+		t.Errorf("writes = %+v", view.Writes)
+	}
+
+	var pending struct{ Accounts []AccountView }
+	getView(t, "/admin/accounts?pending=true", &pending)
+	if len(pending.Accounts) != 1 || pending.Accounts[0].Id != "x" {
+		t.Errorf("pending accounts = %+v", pending.Accounts)
+	}
+	var open struct{ Transactions []TransactionView }
+	getView(t, "/admin/transactions?state=open", &open)
+	if len(open.Transactions) != 1 || open.Transactions[0].Coordinator != "A" || open.Transactions[0].Accounts[0] != "x" {
+		t.Errorf("open transactions = %+v", open.Transactions)
+	}
+	var missing map[string]string
+	if code := getView(t, "/admin/accounts/y", &missing); code != 404 {
+		t.Errorf("missing account answered %d", code)
+	}
+
+	account.Abort("2:A")
+	if err := <-read; err == nil {
+		t.Error("read of an account with no committed value succeeded")
+	}
+	getView(t, "/admin/accounts/x", &view)
+	if len(view.Waiters) != 0 {
+		t.Errorf("waiters after abort = %+v", view.Waiters)
+	}
+}
+
+func TestAdminRequiresPermission(t *testing.T) {
+	accounts.Init()
+	tokens = map[string]string{"alice": "a", "ops": "o"}
+	acl = []ACLEntry{{Client: "alice", Permissions: []Permission{PermissionRead}, Branch: "*", Account: "*"}, {Client: "ops", Permissions: []Permission{PermissionAdmin}, Branch: "*", Account: "*"}}
+	defer func() { tokens, acl = nil, nil }()
+
+	tests := []struct {
+		client string
+		token  string
+		code   int
+	}{
+		{"", "", 401},
+		{"ops", "wrong", 401},
+		{"alice", "a", 403},
+		{"ops", "o", 200},
+	}
+	for _, test := range tests {
+		var view map[string]any
+		if code := getViewAs(t, test.client, test.token, "/admin/accounts", &view); code != test.code {
+			t.Errorf("%q with token %q got %d, want %d", test.client, test.token, code, test.code)
+		}
+	}
+}
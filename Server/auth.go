@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"bank/protocol"
+)
+
+// The tokens file has a line "client token" per client. Once it is loaded,
+// clients must present their token in the handshake.
+var tokens map[string]string
+
+// The acl file has lines "client permissions account...", where permissions
+// is a comma-separated list of read, deposit, withdraw and admin and each
+// account is branch.account. JOIN and LEAVE need admin on branch.*. Either
+// part of an account, and the client, may be "*". Once it is loaded, a
+// client may only do what a line grants it.
+var acl []ACLEntry
+
+type Permission int
+
+const (
+	PermissionNone Permission = iota
+	PermissionRead
+	PermissionDeposit
+	PermissionWithdraw
+	PermissionAdmin
+)
+
+var permissionNames = map[string]Permission{
+	"read":     PermissionRead,
+	"deposit":  PermissionDeposit,
+	"withdraw": PermissionWithdraw,
+	"admin":    PermissionAdmin,
+}
+
+type ACLEntry struct {
+	Client      string
+	Permissions []Permission
+	Branch      string
+	Account     string
+}
+
+func LoadTokens(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	tokens = make(map[string]string)
+	for number, line := range ConfigLines(string(content)) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected client and token", filename, number+1)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+	return nil
+}
+
+func LoadACL(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	acl = make([]ACLEntry, 0)
+	for number, line := range ConfigLines(string(content)) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return fmt.Errorf("%s:%d: expected client, permissions and accounts", filename, number+1)
+		}
+		permissions := make([]Permission, 0)
+		for _, name := range strings.Split(fields[1], ",") {
+			permission, ok := permissionNames[name]
+			if !ok {
+				return fmt.Errorf("%s:%d: unknown permission %q", filename, number+1, name)
+			}
+			permissions = append(permissions, permission)
+		}
+		for _, account := range fields[2:] {
+			accountInfo := strings.Split(account, ".")
+			if len(accountInfo) != 2 {
+				return fmt.Errorf("%s:%d: account %q should be branch.account", filename, number+1, account)
+			}
+			acl = append(acl, ACLEntry{Client: fields[0], Permissions: permissions, Branch: accountInfo[0], Account: accountInfo[1]})
+		}
+	}
+	return nil
+}
+
+// ConfigLines splits content into lines with comments starting at # removed.
+func ConfigLines(content string) []string {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		if index := strings.Index(line, "#"); index >= 0 {
+			lines[i] = line[:index]
+		}
+	}
+	return lines
+}
+
+// Authenticate returns why client may not connect with token, or an empty
+// string if it may.
+func Authenticate(client string, token string) string {
+	if tokens == nil {
+		return ""
+	}
+	expected, ok := tokens[client]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(token)) != 1 {
+		return fmt.Sprintf("client %q failed to authenticate", client)
+	}
+	return ""
+}
+
+// RequiredPermission is what request needs on its account.
+func RequiredPermission(request protocol.Request) Permission {
+	switch request.Operation {
+	case protocol.OpBalance, protocol.OpHistory, protocol.OpSnapshot:
+		return PermissionRead
+	case protocol.OpDeposit, protocol.OpOpen:
+		return PermissionDeposit
+	case protocol.OpWithdraw, protocol.OpClose:
+		return PermissionWithdraw
+	case protocol.OpJoin, protocol.OpLeave:
+		return PermissionAdmin
+	}
+	return PermissionNone
+}
+
+// Permitted reports whether client may make request. A wildcard in the
+// request is only covered by a wildcard in the ACL, a snapshot reads every
+// account, and JOIN and LEAVE act on every account of their branch.
+func Permitted(client string, request protocol.Request) bool {
+	branch, account := request.Branch, request.Account
+	switch request.Operation {
+	case protocol.OpSnapshot:
+		branch, account = "*", "*"
+	case protocol.OpJoin, protocol.OpLeave:
+		account = "*"
+	}
+	return HasPermission(client, RequiredPermission(request), branch, account)
+}
+
+// HasPermission reports whether the ACL gives client required on
+// branch.account, where a wildcard is only covered by a wildcard.
+func HasPermission(client string, required Permission, branch string, account string) bool {
+	if acl == nil || required == PermissionNone {
+		return true
+	}
+	for _, entry := range acl {
+		if !MatchesPattern(entry.Client, client) || !MatchesPattern(entry.Branch, branch) || !MatchesPattern(entry.Account, account) {
+			continue
+		}
+		for _, permission := range entry.Permissions {
+			if permission == required {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func MatchesPattern(pattern string, value string) bool {
+	return pattern == "*" || pattern == value
+}
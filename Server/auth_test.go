@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bank/protocol"
+)
+
+// loadACL loads content as the acl file until the test ends.
+func loadACL(t *testing.T, content string) {
+	filename := filepath.Join(t.TempDir(), "acl")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadACL(filename); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { acl = nil })
+}
+
+func TestPermitted(t *testing.T) {
+	loadACL(t, "# teller\nalice read,deposit A.* B.x\nbob withdraw *.*\n* read C.*\nops admin *.*\n")
+
+	tests := []struct {
+		client  string
+		command string
+		allowed bool
+	}{
+		{"alice", "DEPOSIT A.y 5", true},
+		{"alice", "BALANCE B.x", true},
+		{"alice", "WITHDRAW A.y 5", false},
+		{"alice", "BALANCE B.y", false},
+		{"alice", "BALANCE A.*", true},
+		{"alice", "BALANCE *.*", false},
+		{"alice", "SNAPSHOT", false},
+		{"alice", "COMMIT", true},
+		{"bob", "CLOSE D.z", true},
+		{"bob", "OPEN D.z", false},
+		{"carol", "HISTORY C.z", true},
+		{"carol", "BALANCE A.y", false},
+		{"ops", "JOIN D 10.0.0.4:7404", true},
+		{"ops", "BALANCE A.y", false},
+		{"alice", "LEAVE B", false},
+	}
+	for _, test := range tests {
+		request, err := protocol.ParseRequest(test.command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := Permitted(test.client, request); allowed != test.allowed {
+			t.Errorf("Permitted(%q, %q) = %v, want %v", test.client, test.command, allowed, test.allowed)
+		}
+	}
+}
+
+func TestPermittedWildcards(t *testing.T) {
+	loadACL(t, "dana admin D.*\nerin admin D.x\nfrank read *.x\ngina read A.*\n")
+
+	tests := []struct {
+		client  string
+		command string
+		allowed bool
+	}{
+		{"dana", "JOIN D 10.0.0.4:7404", true},
+		{"dana", "LEAVE D", true},
+		// A grant on one branch does not cover another.
+		{"dana", "LEAVE E", false},
+		{"gina", "BALANCE B.y", false},
+		// A wildcard in the request is only covered by one in the grant.
+		{"erin", "LEAVE D", false},
+		{"frank", "BALANCE B.x", true},
+		{"frank", "BALANCE *.x", true},
+		{"frank", "BALANCE B.*", false},
+		{"gina", "BALANCE A.*", true},
+		{"gina", "BALANCE *.*", false},
+		{"gina", "SNAPSHOT", false},
+	}
+	for _, test := range tests {
+		request, err := protocol.ParseRequest(test.command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := Permitted(test.client, request); allowed != test.allowed {
+			t.Errorf("Permitted(%q, %q) = %v, want %v", test.client, test.command, allowed, test.allowed)
+		}
+	}
+}
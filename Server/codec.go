@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"bank/protocol"
+)
+
+// TextCodec speaks the same lines ./client reads from stdin, so a branch can be
+// driven from telnet. Responses are rendered against the request they answer,
+// so every connection needs its own instance.
+type TextCodec struct {
+	Mutex   sync.Mutex
+	Pending []protocol.Request
+}
+
+func (c *TextCodec) push(request protocol.Request) {
+	c.Mutex.Lock()
+	c.Pending = append(c.Pending, request)
+	c.Mutex.Unlock()
+}
+
+func (c *TextCodec) pop() protocol.Request {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if len(c.Pending) == 0 {
+		return protocol.Request{}
+	}
+	request := c.Pending[0]
+	c.Pending = c.Pending[1:]
+	return request
+}
+
+func (c *TextCodec) NewEncoder(w io.Writer) protocol.Encoder {
+	return &textEncoder{c, w}
+}
+
+func (c *TextCodec) NewDecoder(r io.Reader) protocol.Decoder {
+	id := "text"
+	connection, ok := r.(net.Conn)
+	if ok {
+		id = "text:" + connection.RemoteAddr().String()
+	}
+	return &textDecoder{c, bufio.NewReader(r), connection, id, false}
+}
+
+type textEncoder struct {
+	codec  *TextCodec
+	writer io.Writer
+}
+
+func (e *textEncoder) Encode(v interface{}) error {
+	packet := v.(protocol.Packet)
+	var line string
+	if packet.CommandType == protocol.HandshakeResponse {
+		if packet.Response.Status == protocol.StatusOK {
+			return nil
+		}
+		line = protocol.FormatResponse(protocol.Request{}, packet.Response)
+	} else {
+		line = protocol.FormatResponse(e.codec.pop(), packet.Response)
+	}
+	_, err := io.WriteString(e.writer, line+"\n")
+	return err
+}
+
+type textDecoder struct {
+	codec      *TextCodec
+	reader     *bufio.Reader
+	connection net.Conn
+	id         string
+	handshake  bool
+}
+
+// Decode returns a handshake for the session first, since a telnet user just
+// starts typing commands. Over TLS the session is named by the client's
+// certificate instead of its address. When clients need tokens the first
+// line must be AUTH followed by the client id and its token; anything else
+// makes a handshake without a token, which is refused.
+func (d *textDecoder) Decode(v interface{}) error {
+	packet := v.(*protocol.Packet)
+	if !d.handshake {
+		d.handshake = true
+		if connection, ok := d.connection.(*tls.Conn); ok {
+			if err := connection.Handshake(); err != nil {
+				return err
+			}
+			if _, id, err := protocol.CertificateIdentity(connection.ConnectionState().PeerCertificates[0]); err == nil {
+				d.id = id
+			}
+		}
+		token := ""
+		if tokens != nil {
+			line, err := d.readLine()
+			if err != nil {
+				return err
+			}
+			if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "AUTH" {
+				d.id, token = fields[1], fields[2]
+			}
+		}
+		handshake := protocol.Handshake{Version: protocol.ProtocolVersion, Role: protocol.ClientRole, Id: d.id, ClusterId: clusterId, Features: protocol.SupportedFeatures, Token: token}
+		*packet = protocol.Packet{Version: protocol.ProtocolVersion, IsClient: true, Id: d.id, CommandType: protocol.HandshakeRequest, Handshake: handshake}
+		return nil
+	}
+	line, err := d.readLine()
+	if err != nil {
+		return err
+	}
+	request, err := protocol.ParseRequest(line)
+	if err != nil {
+		request = protocol.Request{}
+	}
+	d.codec.push(request)
+	*packet = protocol.Packet{Version: protocol.ProtocolVersion, IsClient: true, Id: d.id, CommandType: protocol.ClientRequest, Request: request}
+	return nil
+}
+
+// readLine returns the next line that is not blank, trimmed.
+func (d *textDecoder) readLine() (string, error) {
+	for {
+		line, err := d.reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line != "" {
+			return line, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+var codecs = map[string]func() protocol.Codec{
+	"gob":  func() protocol.Codec { return protocol.GobCodec{} },
+	"json": func() protocol.Codec { return protocol.JSONCodec{} },
+	"text": func() protocol.Codec { return &TextCodec{} },
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"bank/protocol"
+)
+
+func TestTextAuth(t *testing.T) {
+	tokens = map[string]string{"alice": "s3cret"}
+	defer func() { tokens = nil }()
+
+	tests := []struct {
+		input         string
+		id            string
+		authenticated bool
+	}{
+		{"\nAUTH alice s3cret\nBALANCE A.x\n", "alice", true},
+		{"AUTH alice wrong\n", "alice", false},
+		{"BALANCE A.x\n", "text", false},
+	}
+	for _, test := range tests {
+		decoder := (&TextCodec{}).NewDecoder(strings.NewReader(test.input))
+		var packet protocol.Packet
+		if err := decoder.Decode(&packet); err != nil {
+			t.Fatal(err)
+		}
+		handshake := packet.Handshake
+		if packet.CommandType != protocol.HandshakeRequest || handshake.Id != test.id {
+			t.Errorf("%q: handshake = %+v, want one for %s", test.input, packet, test.id)
+		}
+		if reason := Authenticate(handshake.Id, handshake.Token); (reason == "") != test.authenticated {
+			t.Errorf("%q: Authenticate = %q, want authenticated %v", test.input, reason, test.authenticated)
+		}
+	}
+}
+
+func TestTextSession(t *testing.T) {
+	startBranch(t)
+	server, client := net.Pipe()
+	defer client.Close()
+	Accept(server, &TextCodec{})
+	replies := bufio.NewReader(client)
+
+	session := []struct{ line, reply string }{
+		{"BALANCE A.x", "INVALID COMMAND"},
+		{"BEGIN", "OK"},
+		{"OPEN A.x", "OK"},
+		{"DEPOSIT A.x 10", "OK"},
+		{"BALANCE A.x", "A.x = 10"},
+		{"COMMIT", "COMMIT OK"},
+		{"DEPOSIT A.x 1", "INVALID COMMAND"},
+		{"BEGIN", "OK"},
+		{"WITHDRAW A.x 3", "OK"},
+		{"ABORT", "ABORTED CLIENT_ABORT"},
+		{"BEGIN", "OK"},
+		{"BALANCE A.x", "A.x = 10"},
+		{"BOGUS", "INVALID COMMAND"},
+		{"COMMIT", "COMMIT OK"},
+	}
+	for _, step := range session {
+		client.SetDeadline(time.Now().Add(time.Second))
+		if _, err := client.Write([]byte(step.line + "\n")); err != nil {
+			t.Fatalf("%s: %v", step.line, err)
+		}
+		reply, err := replies.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s: %v", step.line, err)
+		}
+		if reply = strings.TrimSpace(reply); reply != step.reply {
+			t.Errorf("%s = %q, want %q", step.line, reply, step.reply)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+
+	"bank/logging"
+)
+
+// Each pair of branches keeps one connection, which the lower id dials. The
+// higher id only dials after suspectTimeout without a connection, which is
+// how a new branch introduces itself to a seed that has not heard of it. If
+// both connections come up anyway, the one the lower id dialed is kept and
+// the other closed, and both branches agree which that is. Packets still
+// queued for a branch when its connection is replaced or lost are sent on
+// the next one.
+var registration sync.Mutex
+
+// retired holds the last connection given up on for each branch that has no
+// connection, so that the next one can send what it left behind.
+var retired Map
+
+// ShouldDial reports whether this branch dials branch rather than waiting to
+// be dialed.
+func ShouldDial(branch string) bool {
+	return host.Id < branch
+}
+
+// Preferred reports whether node is the connection its pair keeps.
+func Preferred(node *Node) bool {
+	return node.Outgoing == ShouldDial(node.Id)
+}
+
+// RegisterBranch makes node the connection to its branch, replacing the
+// previous one, unless that one is still open and preferred while node is
+// not. It reports whether node was registered; if not, it is closed.
+func RegisterBranch(node *Node) bool {
+	registration.Lock()
+	previous, ok := nodes.Get(node.Id).(*Node)
+	if ok && previous.IsOpen() && Preferred(previous) && !Preferred(node) {
+		registration.Unlock()
+		logging.Network.Info("Closing duplicate connection", logging.Peer(node.Id))
+		node.Close()
+		return false
+	}
+	if !ok {
+		previous, ok = retired.Get(node.Id).(*Node)
+		retired.Delete(node.Id)
+	}
+	nodes.Set(node.Id, node)
+	registration.Unlock()
+	if ok {
+		logging.Network.Info("Replacing connection", logging.Peer(node.Id))
+		previous.Close()
+		for _, packet := range previous.Leftovers() {
+			node.Send(packet)
+		}
+	}
+	return true
+}
+
+// RetireBranch unregisters node if it is still its branch's connection and
+// reports whether it was.
+func RetireBranch(node *Node) bool {
+	registration.Lock()
+	defer registration.Unlock()
+	if !nodes.CompareAndDelete(node.Id, node) {
+		return false
+	}
+	retired.Set(node.Id, node)
+	return true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"bank/protocol"
+)
+
+// stoppedNode is a connection to branch whose writer has already stopped, so
+// whatever is queued in Input is left over.
+func stoppedNode(branch string, outgoing bool, queued ...protocol.CommandType) *Node {
+	connection, _ := net.Pipe()
+	node := &Node{
+		Id:         branch,
+		Connection: connection,
+		Input:      make(chan protocol.Packet, 100),
+		Done:       make(chan struct{}),
+		Outgoing:   outgoing,
+		Stopped:    make(chan struct{}),
+	}
+	close(node.Stopped)
+	for _, commandType := range queued {
+		node.Input <- protocol.Packet{Id: "B", CommandType: commandType}
+	}
+	return node
+}
+
+func queuedTypes(node *Node) []protocol.CommandType {
+	types := make([]protocol.CommandType, 0)
+	for len(node.Input) > 0 {
+		types = append(types, (<-node.Input).CommandType)
+	}
+	return types
+}
+
+func TestRegisterBranch(t *testing.T) {
+	host = Node{Id: "B"}
+	nodes.Init()
+	retired.Init()
+
+	// A has the lower id, so the connection A dialed is the one kept.
+	dialedByA := stoppedNode("A", false)
+	dialedByB := stoppedNode("A", true)
+	if !RegisterBranch(dialedByA) {
+		t.Fatal("first connection was not registered")
+	}
+	if RegisterBranch(dialedByB) {
+		t.Fatal("duplicate dialed by the higher id replaced the preferred connection")
+	}
+	if dialedByB.IsOpen() || !dialedByA.IsOpen() {
+		t.Fatal("wrong connection closed")
+	}
+
+	// A reconnection replaces the old connection and sends what it left
+	// queued, apart from its handshake.
+	dialedByA.Input <- protocol.Packet{CommandType: protocol.HandshakeResponse}
+	dialedByA.Input <- protocol.Packet{CommandType: protocol.CoordinatorCommit}
+	reconnection := stoppedNode("A", false, protocol.HandshakeResponse)
+	if !RegisterBranch(reconnection) {
+		t.Fatal("reconnection was not registered")
+	}
+	if dialedByA.IsOpen() {
+		t.Error("replaced connection was left open")
+	}
+	if got := queuedTypes(reconnection); len(got) != 2 || got[0] != protocol.HandshakeResponse || got[1] != protocol.CoordinatorCommit {
+		t.Errorf("reconnection queue = %v, want handshake then commit", got)
+	}
+
+	// A connection given up on hands its queue to the next one.
+	reconnection.Input <- protocol.Packet{CommandType: protocol.CoordinatorAbort}
+	if !RetireBranch(reconnection) {
+		t.Fatal("registered connection was not retired")
+	}
+	if nodes.Contains("A") {
+		t.Fatal("retired connection is still registered")
+	}
+	next := stoppedNode("A", false)
+	RegisterBranch(next)
+	if got := queuedTypes(next); len(got) != 1 || got[0] != protocol.CoordinatorAbort {
+		t.Errorf("queue after loss = %v, want abort", got)
+	}
+}
+
+func TestRefusedHandshake(t *testing.T) {
+	host = Node{Id: "B"}
+	nodes.Init()
+	retired.Init()
+	transactions.Init()
+	liveness.Init()
+	liveness.Set("A", &Liveness{Id: "A"})
+	// A is not a member here, so it is not dialed again.
+	roster.Init(protocol.Member{Id: "B"})
+
+	// A refusal drops the connection and marks the branch for backoff, but
+	// leaves this branch running.
+	node := stoppedNode("A", true)
+	RegisterBranch(node)
+	HandleHandshakeResponse(node, protocol.Packet{CommandType: protocol.HandshakeResponse, Response: protocol.Response{Status: protocol.StatusRefused, Message: "unknown branch"}})
+	if nodes.Contains("A") || node.IsOpen() {
+		t.Error("refused connection is still registered or open")
+	}
+	if !GetLiveness("A").GetRefused() {
+		t.Error("refusal was not recorded")
+	}
+	GetLiveness("A").Negotiated([]string{"heartbeat"})
+	if GetLiveness("A").GetRefused() {
+		t.Error("refusal outlived a successful handshake")
+	}
+}
+
+func TestHandshakeVersionMismatch(t *testing.T) {
+	host = Node{Id: "B"}
+	clusterId = "default"
+	roster.Init(protocol.Member{Id: "B"})
+
+	// Only a version the branch does not speak is a mismatch; any other
+	// refusal stays REFUSED.
+	tests := []struct {
+		version   int
+		handshake int
+		cluster   string
+		status    protocol.Status
+	}{
+		{protocol.ProtocolVersion + 1, protocol.ProtocolVersion, "default", protocol.StatusVersionMismatch},
+		{protocol.ProtocolVersion, protocol.ProtocolVersion - 1, "default", protocol.StatusVersionMismatch},
+		{protocol.ProtocolVersion, protocol.ProtocolVersion, "other", protocol.StatusRefused},
+	}
+	for _, test := range tests {
+		node := stoppedNode("", false)
+		node.Output = make(chan protocol.Packet, 1)
+		node.Output <- protocol.Packet{Version: test.version, Id: "A", CommandType: protocol.HandshakeRequest, Handshake: protocol.Handshake{Version: test.handshake, Role: protocol.BranchRole, Id: "A", ClusterId: test.cluster}}
+		HandleIncomingConnection(node)
+		answer := <-node.Input
+		if answer.CommandType != protocol.HandshakeResponse || answer.Response.Status != test.status {
+			t.Errorf("version %d, handshake %d, cluster %s: answer = %v %v, want %v", test.version, test.handshake, test.cluster, answer.CommandType, answer.Response.Status, test.status)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"bank/logging"
+	"bank/protocol"
+)
+
+// Branches send each other a heartbeat every heartbeatInterval. A branch that
+// has not been heard from for suspectTimeout is suspected, and after
+// deadTimeout it is declared dead: its connection is dropped, transactions
+// that need it are aborted, and it is dialed again with backoff until it
+// returns. The timeouts in the configuration file set the durations.
+//
+// As in SWIM, a silent branch is first probed indirectly: a few other
+// members are asked whether they still hear it. Only if none does within a
+// heartbeat is it reported suspect, and only if none does by deadTimeout is
+// it reported dead. Otherwise only this branch's link to it has failed, so
+// the connection is dropped and dialed again without telling the cluster.
+var heartbeatInterval = time.Second
+var suspectTimeout = 3 * time.Second
+var deadTimeout = 10 * time.Second
+
+const initialBackoff = time.Second
+const maxBackoff = 30 * time.Second
+
+type Health int
+
+const (
+	Alive Health = iota
+	Suspected
+	Dead
+)
+
+func (h Health) String() string {
+	switch h {
+	case Alive:
+		return "ALIVE"
+	case Suspected:
+		return "SUSPECTED"
+	}
+	return "DEAD"
+}
+
+// Liveness is what the failure detector knows about a branch. It is kept by
+// branch id rather than per connection, since a packet on any connection
+// from the branch shows that it is alive.
+type Liveness struct {
+	Id        string
+	LastHeard time.Time
+	Health    Health
+	// Silent is set when the branch's handshake did not offer heartbeats,
+	// so its silence means nothing.
+	Silent bool
+	// Refused is set when the branch refused the handshake, until one
+	// succeeds.
+	Refused bool
+	// Probing is when ping requests about the branch began, zero while it
+	// is heard from, and Vouched is when another member last said it hears
+	// the branch.
+	Probing time.Time
+	Vouched time.Time
+	Mutex   sync.Mutex
+}
+
+// liveness holds a *Liveness for every other branch.
+var liveness Map
+
+// dialing holds the branches ConnectToServer is dialing.
+var dialing Map
+
+func GetLiveness(branch string) *Liveness {
+	return liveness.Get(branch).(*Liveness)
+}
+
+// Heard records that a packet arrived from branch.
+func (l *Liveness) Heard() {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	l.LastHeard = time.Now()
+	l.Probing = time.Time{}
+	if l.Health != Alive {
+		logging.Network.Info("Branch alive again", logging.Peer(l.Id), "was", l.Health.String())
+	}
+	l.Health = Alive
+}
+
+// Probe records that ping requests about the branch are going out and
+// returns how long they have been.
+func (l *Liveness) Probe(now time.Time) time.Duration {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	if l.Probing.IsZero() {
+		l.Probing = now
+	}
+	return now.Sub(l.Probing)
+}
+
+// Vouch records that another member hears the branch.
+func (l *Liveness) Vouch() {
+	l.Mutex.Lock()
+	l.Vouched = time.Now()
+	l.Mutex.Unlock()
+}
+
+// IsVouched reports whether another member has heard the branch within
+// suspectTimeout.
+func (l *Liveness) IsVouched(now time.Time) bool {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	return !l.Vouched.IsZero() && now.Sub(l.Vouched) < suspectTimeout
+}
+
+// Hears reports whether the branch is connected and has been heard from
+// within suspectTimeout, which is what a ping request asks.
+func (l *Liveness) Hears(now time.Time) bool {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	return nodes.Contains(l.Id) && now.Sub(l.LastHeard) < suspectTimeout
+}
+
+// Connected gives a new connection to the branch until deadTimeout to be
+// heard from.
+func (l *Liveness) Connected() {
+	l.Mutex.Lock()
+	l.LastHeard = time.Now()
+	l.Mutex.Unlock()
+}
+
+// Check updates the health from the time since the branch was last heard
+// and reports whether it has been silent for long enough to be dead.
+func (l *Liveness) Check(now time.Time) bool {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	if l.Silent {
+		return false
+	}
+	silence := now.Sub(l.LastHeard)
+	if silence >= deadTimeout {
+		l.Health = Dead
+		return true
+	}
+	if silence >= suspectTimeout && l.Health == Alive {
+		logging.Network.Warn("Branch suspected", logging.Peer(l.Id), "silence", silence)
+		l.Health = Suspected
+	}
+	return false
+}
+
+func (l *Liveness) GetHealth() Health {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	return l.Health
+}
+
+// Negotiated records whether the branch's latest handshake offered
+// heartbeats.
+func (l *Liveness) Negotiated(features []string) {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	l.Refused = false
+	l.Silent = true
+	for _, feature := range features {
+		if feature == "heartbeat" {
+			l.Silent = false
+		}
+	}
+}
+
+func (l *Liveness) SetRefused(refused bool) {
+	l.Mutex.Lock()
+	l.Refused = refused
+	l.Mutex.Unlock()
+}
+
+func (l *Liveness) GetRefused() bool {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	return l.Refused
+}
+
+func (l *Liveness) SetHealth(health Health) {
+	l.Mutex.Lock()
+	l.Health = health
+	l.Mutex.Unlock()
+}
+
+// MonitorBranches sends heartbeats and declares silent branches dead. A
+// connection whose handshake is never answered is judged like any other.
+func MonitorBranches() {
+	for now := range time.Tick(heartbeatInterval) {
+		for _, id := range Members() {
+			if id == host.Id {
+				continue
+			}
+			node, ok := nodes.Get(id).(*Node)
+			if !ok {
+				continue
+			}
+			node.TrySend(protocol.Packet{Version: protocol.ProtocolVersion, Id: host.Id, CommandType: protocol.Heartbeat})
+			live := GetLiveness(id)
+			if live.Check(now) {
+				if live.IsVouched(now) {
+					logging.Network.Warn("Link to branch lost, but others hear it", logging.Peer(id), "silence", deadTimeout)
+					DropBranch(node)
+				} else {
+					logging.Network.Warn("Branch dead", logging.Peer(id), "silence", deadTimeout)
+					LoseBranch(node, protocol.AbortParticipantTimeout)
+				}
+			} else if live.GetHealth() == Suspected {
+				RequestPings(id)
+				if live.Probe(now) > heartbeatInterval && !live.IsVouched(now) {
+					ReportMember(id, protocol.MemberSuspect)
+				}
+			}
+		}
+	}
+}
+
+// LoseBranch gives up on a branch's connection. If it was the branch's
+// registered connection, the branch is dead until it is dialed again, which
+// only happens while it is still a member. Transactions aborted for it give
+// code as their reason.
+func LoseBranch(node *Node, code protocol.AbortCode) {
+	node.Close()
+	if !RetireBranch(node) {
+		return
+	}
+	GetLiveness(node.Id).SetHealth(Dead)
+	ReportMember(node.Id, protocol.MemberDead)
+	AbortTransactionsWith(node.Id, code)
+	if branch, ok := MemberAddress(node.Id); ok {
+		go ConnectToServer(branch.Id, branch.Address, branch.Port)
+	}
+}
+
+// DropBranch gives up on a connection to a branch that other members still
+// hear. Transactions that needed the connection abort, but the branch is not
+// reported, and it is dialed again at once.
+func DropBranch(node *Node) {
+	retired := RetireBranch(node)
+	node.Close()
+	if !retired {
+		return
+	}
+	AbortTransactionsWith(node.Id, protocol.AbortParticipantTimeout)
+	if branch, ok := MemberAddress(node.Id); ok {
+		go ConnectToServer(branch.Id, branch.Address, branch.Port)
+	}
+}
+
+// RequestPings asks a few other members that offer ping requests whether
+// they hear branch.
+func RequestPings(branch string) {
+	packet := protocol.Packet{Version: protocol.ProtocolVersion, Id: host.Id, CommandType: protocol.PingRequest, Request: protocol.Request{Branch: branch}}
+	for _, id := range roster.Targets(gossipFanout + 1) {
+		node, ok := nodes.Get(id).(*Node)
+		if id == branch || !ok || !slices.Contains(node.Features, "ping-req") {
+			continue
+		}
+		node.TrySend(packet)
+	}
+}
+
+// HandlePingRequest answers a ping request if this branch hears the branch
+// asked about, and stays silent otherwise.
+func HandlePingRequest(node *Node, packet protocol.Packet) {
+	branch := packet.Request.Branch
+	if live, ok := liveness.Get(branch).(*Liveness); ok && live.Hears(time.Now()) {
+		node.TrySend(protocol.Packet{Version: protocol.ProtocolVersion, Id: host.Id, CommandType: protocol.PingAck, Request: packet.Request})
+	}
+}
+
+func HandlePingAck(node *Node, packet protocol.Packet) {
+	if live, ok := liveness.Get(packet.Request.Branch).(*Liveness); ok {
+		live.Vouch()
+	}
+}
+
+// RefuseBranch drops a connection whose handshake failed. The branch answered,
+// so it is not reported dead; it is dialed again after maxBackoff, since the
+// refusal may be a JOIN the branch has not heard of yet or a configuration
+// that is being fixed.
+func RefuseBranch(node *Node, reason string) {
+	logging.Network.Error("Branch refused connection", logging.Peer(node.Id), "reason", reason)
+	GetLiveness(node.Id).SetRefused(true)
+	retired := RetireBranch(node)
+	node.Close()
+	if !retired {
+		return
+	}
+	AbortTransactionsWith(node.Id, protocol.AbortPeerFailure)
+	if branch, ok := MemberAddress(node.Id); ok {
+		go ConnectToServer(branch.Id, branch.Address, branch.Port)
+	}
+}
+
+// AbortTransactionsWith aborts the transactions that can no longer finish
+// because branch is gone. Those coordinated here abort if they sent branch a
+// command or are waiting for its vote, and tell their client why. Those
+// coordinated by branch abort here unless this branch already voted, in
+// which case they must wait for the coordinator's decision.
+func AbortTransactionsWith(branch string, code protocol.AbortCode) {
+	transactions.RWMutex.RLock()
+	pending := make([]*Transaction, 0)
+	for _, value := range transactions.Data {
+		pending = append(pending, value.(*Transaction))
+	}
+	transactions.RWMutex.RUnlock()
+	for _, transaction := range pending {
+		state := transaction.GetState()
+		if strings.HasSuffix(transaction.Id, ":"+host.Id) {
+			if transaction.HasParticipant(branch) || state == protocol.Prepare {
+				AbortTransaction(transaction, UnavailableResponse(branch, code))
+			}
+		} else if strings.HasSuffix(transaction.Id, ":"+branch) && state == protocol.Open {
+			logging.Commit.Warn("Coordinator dead, aborting", logging.Txn(transaction.Id), logging.Peer(branch))
+			AbortParticipant(transaction.Id)
+		}
+	}
+
+	snapshots.RWMutex.RLock()
+	snapshotIds := make([]string, 0)
+	for id := range snapshots.Data {
+		snapshotIds = append(snapshotIds, id)
+	}
+	snapshots.RWMutex.RUnlock()
+	for _, id := range snapshotIds {
+		HandleSnapshotFromParticipant(&Node{Id: branch}, StatusPacket(id, protocol.ParticipantSnapshot, protocol.StatusSnapshotFailed))
+	}
+}
+
+// UnavailableResponse aborts a transaction that needs branch, which timed out
+// or failed as code says.
+func UnavailableResponse(branch string, code protocol.AbortCode) protocol.Response {
+	return protocol.Response{Status: protocol.StatusAborted, Message: fmt.Sprintf("branch %s is unavailable", branch), Abort: protocol.AbortReason{Code: code}}
+}
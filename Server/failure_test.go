@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"bank/protocol"
+)
+
+func TestFailureDetection(t *testing.T) {
+	host = Node{Id: "A"}
+	nodes.Init()
+	clients.Init()
+	transactions.Init()
+	snapshots.Init()
+	b := &Node{Id: "B", Input: make(chan protocol.Packet, 100), Done: make(chan struct{})}
+	nodes.Set("B", b)
+	session := &Node{Id: "tcp:1", Input: make(chan protocol.Packet, 100)}
+	clients.Set("tcp:1", session)
+
+	// B has a command of one transaction coordinated here but not of the
+	// other.
+	involved := &Transaction{}
+	involved.Init("10:A", "tcp:1")
+	involved.Members = []string{"A", "B"}
+	involved.AddParticipant("B")
+	transactions.Set(involved.Id, involved)
+	untouched := &Transaction{}
+	untouched.Init("20:A", "tcp:2")
+	untouched.Members = []string{"A", "B"}
+	transactions.Set(untouched.Id, untouched)
+
+	heard := time.Now()
+	detector := &Liveness{Id: "B", LastHeard: heard}
+	if detector.Check(heard.Add(suspectTimeout-time.Millisecond)) || detector.GetHealth() != Alive {
+		t.Fatalf("B is %v before suspectTimeout", detector.GetHealth())
+	}
+	if detector.Check(heard.Add(suspectTimeout)) || detector.GetHealth() != Suspected {
+		t.Fatalf("B is %v after suspectTimeout, want suspected", detector.GetHealth())
+	}
+	if !detector.Check(heard.Add(deadTimeout)) || detector.GetHealth() != Dead {
+		t.Fatalf("B is %v after deadTimeout, want dead", detector.GetHealth())
+	}
+
+	AbortTransactionsWith("B", protocol.AbortPeerFailure)
+	if len(session.Input) != 1 {
+		t.Fatalf("client was sent %d answers, want the abort", len(session.Input))
+	}
+	if answer := <-session.Input; answer.Response.Status != protocol.StatusAborted || answer.Response.Message != "branch B is unavailable" || answer.Response.Abort.Code != protocol.AbortPeerFailure {
+		t.Errorf("answer = %+v, want a PEER_FAILURE abort naming B", answer.Response)
+	}
+	if involved.IsActive() || !untouched.IsActive() {
+		t.Error("aborted the wrong transactions")
+	}
+	if packet := <-b.Input; packet.CommandType != protocol.CoordinatorAbort || packet.TransactionId != involved.Id {
+		t.Errorf("B was sent %v for %s, want the abort", packet.CommandType, packet.TransactionId)
+	}
+}
+
+func TestPingRequest(t *testing.T) {
+	host = Node{Id: "A"}
+	nodes.Init()
+	liveness.Init()
+	roster.Init(protocol.Member{Id: "A"})
+	roster.Merge(protocol.Membership{Branches: []protocol.Member{{Id: "B"}, {Id: "C"}, {Id: "D"}}})
+	for _, id := range []string{"B", "C", "D"} {
+		liveness.Set(id, &Liveness{Id: id, LastHeard: time.Now()})
+	}
+	b := stoppedNode("B", true)
+	b.Features = []string{"ping-req"}
+	c := stoppedNode("C", true)
+	c.Features = []string{"ping-req"}
+	d := stoppedNode("D", true)
+	for _, node := range []*Node{b, c, d} {
+		nodes.Set(node.Id, node)
+	}
+
+	// Only members that offer ping requests are asked, never the branch
+	// asked about.
+	RequestPings("B")
+	if got := queuedTypes(c); len(got) != 1 || got[0] != protocol.PingRequest {
+		t.Errorf("C was sent %v, want a ping request", got)
+	}
+	if got := queuedTypes(b); len(got) != 0 {
+		t.Errorf("B was asked about itself: %v", got)
+	}
+	if got := queuedTypes(d); len(got) != 0 {
+		t.Errorf("D does not offer ping requests but was sent %v", got)
+	}
+
+	request := protocol.Packet{CommandType: protocol.PingRequest, Request: protocol.Request{Branch: "B"}}
+	HandlePingRequest(c, request)
+	ack := <-c.Input
+	if ack.CommandType != protocol.PingAck || ack.Request.Branch != "B" {
+		t.Fatalf("answer = %+v, want an ack for B", ack)
+	}
+	GetLiveness("B").LastHeard = time.Now().Add(-2 * suspectTimeout)
+	HandlePingRequest(c, request)
+	if got := queuedTypes(c); len(got) != 0 {
+		t.Errorf("answered for a branch not heard from: %v", got)
+	}
+
+	if GetLiveness("B").IsVouched(time.Now()) {
+		t.Fatal("vouched for before any ack")
+	}
+	HandlePingAck(c, ack)
+	if !GetLiveness("B").IsVouched(time.Now()) {
+		t.Error("ack did not vouch for B")
+	}
+	if GetLiveness("B").IsVouched(time.Now().Add(suspectTimeout)) {
+		t.Error("vouch outlived suspectTimeout")
+	}
+}
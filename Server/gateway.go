@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"bank/logging"
+	"bank/protocol"
+)
+
+const gatewayTimeout = 10 * time.Second
+
+// gatewayIdleTimeout is how long an HTTP transaction may go without requests
+// before it is aborted. Sockets abort when they close; HTTP clients that
+// walk away give no such sign.
+const gatewayIdleTimeout = time.Minute
+
+var gatewaySessions Map
+
+// GatewaySession is the transaction of an HTTP or gRPC client. It owns an
+// in-process client node whose channels are read by HandleClient exactly like
+// a socket's.
+// Closed, LastUsed and the node's Output are guarded by Mutex.
+type GatewaySession struct {
+	Node     *Node
+	Closed   bool
+	LastUsed time.Time
+	Timer    *time.Timer
+	Mutex    sync.Mutex
+}
+
+type GatewayRequest struct {
+	Account string `json:"account"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Amount  int    `json:"amount"`
+}
+
+type GatewayResponse struct {
+	TransactionId string             `json:"transaction_id,omitempty"`
+	Status        string             `json:"status"`
+	Balances      []protocol.Balance `json:"balances,omitempty"`
+	Error         string             `json:"error,omitempty"`
+	Abort         *GatewayAbort      `json:"abort,omitempty"`
+}
+
+// GatewayAbort is why a transaction aborted, as protocol.AbortReason.
+type GatewayAbort struct {
+	Code     string `json:"code"`
+	Account  string `json:"account,omitempty"`
+	Conflict string `json:"conflict,omitempty"`
+}
+
+// gatewayOperations are the operations on one account, by their path.
+var gatewayOperations = map[string]protocol.Operation{
+	"deposit":  protocol.OpDeposit,
+	"withdraw": protocol.OpWithdraw,
+	"balance":  protocol.OpBalance,
+}
+
+func ServeGateway(address string) {
+	mux := GatewayMux()
+	if tlsConfig == nil {
+		logging.Fatalf("HTTP gateway stopped: %v", http.ListenAndServe(address, mux))
+	}
+	server := &http.Server{Addr: address, Handler: RequireClientCertificate(mux), TLSConfig: tlsConfig}
+	logging.Fatalf("HTTP gateway stopped: %v", server.ListenAndServeTLS("", ""))
+}
+
+func GatewayMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /transactions", HandleGatewayBegin)
+	mux.HandleFunc("GET /transactions/{id}/balance", HandleGatewayOperation)
+	mux.HandleFunc("POST /transactions/{id}/{operation}", HandleGatewayOperation)
+	return mux
+}
+
+// RequireClientCertificate turns away callers whose certificate, verified
+// by the TLS handshake, was issued to a branch.
+func RequireClientCertificate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, _, err := protocol.CertificateIdentity(r.TLS.PeerCertificates[0])
+		if err != nil || role != protocol.ClientRole {
+			WriteGatewayResponse(w, http.StatusForbidden, GatewayResponse{Status: "REFUSED", Error: "client certificate required"})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// GatewayClient returns who sent r, or why it could not be authenticated.
+// Clients name themselves as the basic auth user, which over TLS must be the
+// certificate's holder, and give their token as the password.
+func GatewayClient(r *http.Request) (string, string) {
+	client, token, _ := r.BasicAuth()
+	if r.TLS != nil {
+		_, id, _ := protocol.CertificateIdentity(r.TLS.PeerCertificates[0])
+		if client != "" && client != id {
+			return "", fmt.Sprintf("user %q does not match certificate for %q", client, id)
+		}
+		client = id
+	}
+	if reason := CheckClientId(client); reason != "" {
+		return "", reason
+	}
+	return client, Authenticate(client, token)
+}
+
+func HandleGatewayBegin(w http.ResponseWriter, r *http.Request) {
+	client, reason := GatewayClient(r)
+	if reason != "" {
+		WriteGatewayResponse(w, http.StatusUnauthorized, GatewayResponse{Status: protocol.StatusRefused.String(), Error: reason})
+		return
+	}
+	session := OpenSession("http", client)
+	session.Mutex.Lock()
+	defer session.Mutex.Unlock()
+	response, ok := session.Begin()
+	if !ok {
+		WriteGatewayResponse(w, http.StatusGatewayTimeout, GatewayResponse{Status: "TIMEOUT"})
+		return
+	}
+	WriteGatewayResponse(w, http.StatusCreated, GatewayResponse{TransactionId: response.TransactionId, Status: response.Response.Status.String()})
+}
+
+func HandleGatewayOperation(w http.ResponseWriter, r *http.Request) {
+	transactionId := r.PathValue("id")
+	session, ok := gatewaySessions.Get(transactionId).(*GatewaySession)
+	if !ok {
+		WriteGatewayResponse(w, http.StatusNotFound, GatewayResponse{TransactionId: transactionId, Status: "NOT FOUND", Error: "unknown transaction"})
+		return
+	}
+	client, reason := GatewayClient(r)
+	if reason == "" && client != session.Node.ClientId {
+		reason = fmt.Sprintf("transaction belongs to %q", session.Node.ClientId)
+	}
+	if reason != "" {
+		WriteGatewayResponse(w, http.StatusUnauthorized, GatewayResponse{TransactionId: transactionId, Status: protocol.StatusRefused.String(), Error: reason})
+		return
+	}
+	body := GatewayRequest{}
+	if r.Method == http.MethodGet {
+		body.Account = r.URL.Query().Get("account")
+	} else if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			WriteGatewayResponse(w, http.StatusBadRequest, GatewayResponse{TransactionId: transactionId, Status: protocol.StatusInvalid.String(), Error: err.Error()})
+			return
+		}
+	}
+	var requests []protocol.Request
+	var err error
+	operation := r.PathValue("operation")
+	if r.Method == http.MethodGet {
+		operation = "balance"
+	}
+	switch operation {
+	case "deposit", "withdraw", "balance":
+		var request protocol.Request
+		request, err = AccountRequest(gatewayOperations[operation], body.Account, body.Amount)
+		requests = []protocol.Request{request}
+	case "transfer":
+		var withdraw, deposit protocol.Request
+		withdraw, err = AccountRequest(protocol.OpWithdraw, body.From, body.Amount)
+		if err == nil {
+			deposit, err = AccountRequest(protocol.OpDeposit, body.To, body.Amount)
+		}
+		requests = []protocol.Request{withdraw, deposit}
+	case "commit":
+		requests = []protocol.Request{{Operation: protocol.OpCommit}}
+	case "abort":
+		requests = []protocol.Request{{Operation: protocol.OpAbort}}
+	default:
+		WriteGatewayResponse(w, http.StatusNotFound, GatewayResponse{TransactionId: transactionId, Status: "NOT FOUND", Error: "unknown operation " + operation})
+		return
+	}
+	// A request the text protocol would not parse is refused before it
+	// reaches the transaction, which stays open.
+	if err != nil {
+		WriteGatewayResponse(w, http.StatusBadRequest, GatewayResponse{TransactionId: transactionId, Status: protocol.StatusInvalid.String(), Error: err.Error()})
+		return
+	}
+	// Both halves of a transfer are checked before either is sent, so a
+	// denied deposit cannot follow a withdrawal that went through.
+	for _, request := range requests {
+		if !Permitted(client, request) {
+			WriteGatewayResponse(w, http.StatusForbidden, GatewayResponse{TransactionId: transactionId, Status: protocol.StatusPermissionDenied.String(), Error: fmt.Sprintf("%s %s.%s is not permitted", request.Operation, request.Branch, request.Account)})
+			return
+		}
+	}
+
+	session.Mutex.Lock()
+	defer session.Mutex.Unlock()
+	// The transaction may have finished or expired while this request waited.
+	if session.Closed {
+		WriteGatewayResponse(w, http.StatusNotFound, GatewayResponse{TransactionId: transactionId, Status: "NOT FOUND", Error: "unknown transaction"})
+		return
+	}
+	packet, ok := session.Run(transactionId, requests)
+	if !ok {
+		WriteGatewayResponse(w, http.StatusGatewayTimeout, GatewayResponse{TransactionId: transactionId, Status: "TIMEOUT"})
+		return
+	}
+	status := packet.Response.Status
+	response := GatewayResponse{TransactionId: transactionId, Status: status.String(), Balances: packet.Response.Balances, Error: packet.Response.Message}
+	if abort := packet.Response.Abort; abort.Code != protocol.NoAbortCode {
+		response.Abort = &GatewayAbort{Code: abort.Code.String(), Account: abort.Account, Conflict: abort.Conflict}
+	}
+	WriteGatewayResponse(w, GatewayStatusCode(status), response)
+}
+
+// AccountRequest builds a request from the branch.account notation the text
+// protocol uses, and fails for any account or amount the text listener
+// would also refuse.
+func AccountRequest(operation protocol.Operation, account string, amount int) (protocol.Request, error) {
+	if len(strings.Fields(account)) != 1 {
+		return protocol.Request{}, fmt.Errorf("%s takes a branch.account", operation)
+	}
+	command := fmt.Sprintf("%s %s", operation, account)
+	if operation == protocol.OpDeposit || operation == protocol.OpWithdraw {
+		command += fmt.Sprintf(" %d", amount)
+	}
+	return protocol.ParseRequest(command)
+}
+
+// OpenSession starts a session of kind served by HandleClient on behalf of
+// client.
+func OpenSession(kind string, client string) *GatewaySession {
+	id := NewSessionId(kind)
+	node := &Node{
+		Id:       id,
+		ClientId: client,
+		IsClient: true,
+		Input:    make(chan protocol.Packet, 100),
+		Output:   make(chan protocol.Packet, 100),
+		Done:     make(chan struct{}),
+	}
+	clients.Set(id, node)
+	go HandleClient(node)
+	return &GatewaySession{Node: node}
+}
+
+// Begin starts the session's transaction and files the session under its id
+// until it ends or expires. Mutex must be held.
+func (s *GatewaySession) Begin() (protocol.Packet, bool) {
+	response, ok := s.Send("", protocol.Request{Operation: protocol.OpBegin})
+	if !ok {
+		s.Close()
+		return response, false
+	}
+	transactionId := response.TransactionId
+	s.LastUsed = time.Now()
+	s.Timer = time.AfterFunc(gatewayIdleTimeout, func() { s.Expire(transactionId) })
+	gatewaySessions.Set(transactionId, s)
+	return response, true
+}
+
+// Run sends requests until one of them fails and returns the last answer.
+// Requests go together, so if one fails after another went through the
+// transaction is aborted rather than left with only some of them. The
+// session is closed once the transaction has ended or stopped answering.
+// Mutex must be held.
+func (s *GatewaySession) Run(transactionId string, requests []protocol.Request) (protocol.Packet, bool) {
+	var packet protocol.Packet
+	for i, request := range requests {
+		var ok bool
+		packet, ok = s.Send(transactionId, request)
+		if ok && i > 0 && packet.Response.Status != protocol.StatusOK && KeepsGatewaySession(packet.Response.Status) {
+			failed := packet.Response
+			packet, ok = s.Send(transactionId, protocol.Request{Operation: protocol.OpAbort})
+			packet.Response.Message = fmt.Sprintf("%s %s.%s failed: %s", request.Operation, request.Branch, request.Account, failed.Status)
+		}
+		if !ok {
+			s.Close()
+			gatewaySessions.Delete(transactionId)
+			return packet, false
+		}
+		if packet.Response.Status != protocol.StatusOK {
+			break
+		}
+	}
+	s.LastUsed = time.Now()
+	if !KeepsGatewaySession(packet.Response.Status) {
+		s.Close()
+		gatewaySessions.Delete(transactionId)
+	}
+	return packet, true
+}
+
+// KeepsGatewaySession reports whether a transaction is still open after an
+// answer with status.
+func KeepsGatewaySession(status protocol.Status) bool {
+	switch status {
+	case protocol.StatusOK, protocol.StatusInvalid, protocol.StatusSnapshotFailed, protocol.StatusPermissionDenied:
+		return true
+	}
+	return false
+}
+
+func (s *GatewaySession) Send(transactionId string, request protocol.Request) (protocol.Packet, bool) {
+	s.Node.Output <- protocol.Packet{Version: protocol.ProtocolVersion, IsClient: true, Id: s.Node.Id, TransactionId: transactionId, CommandType: protocol.ClientRequest, Request: request}
+	select {
+	case packet := <-s.Node.Input:
+		return packet, true
+	case <-time.After(gatewayTimeout):
+		return protocol.Packet{}, false
+	}
+}
+
+// Close ends the session, which aborts its transaction unless it already
+// finished. Mutex must be held.
+func (s *GatewaySession) Close() {
+	if s.Closed {
+		return
+	}
+	s.Closed = true
+	if s.Timer != nil {
+		s.Timer.Stop()
+	}
+	close(s.Node.Output)
+	close(s.Node.Done)
+}
+
+// Expire closes the session once it has been idle for gatewayIdleTimeout.
+func (s *GatewaySession) Expire(transactionId string) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	if s.Closed {
+		return
+	}
+	if idle := time.Since(s.LastUsed); idle < gatewayIdleTimeout {
+		s.Timer.Reset(gatewayIdleTimeout - idle)
+		return
+	}
+	logging.Commit.Info("Gateway transaction idle, aborting", logging.Txn(transactionId), "session", s.Node.Id)
+	s.Close()
+	gatewaySessions.Delete(transactionId)
+}
+
+func GatewayStatusCode(status protocol.Status) int {
+	switch status {
+	case protocol.StatusOK, protocol.StatusCommitOK:
+		return http.StatusOK
+	case protocol.StatusNotFound:
+		return http.StatusNotFound
+	case protocol.StatusInvalid:
+		return http.StatusBadRequest
+	case protocol.StatusPermissionDenied:
+		return http.StatusForbidden
+	}
+	return http.StatusConflict
+}
+
+func WriteGatewayResponse(w http.ResponseWriter, code int, response GatewayResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
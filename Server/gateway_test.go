@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"bank/protocol"
+)
+
+// openAccount files account id on this branch with value committed.
+func openAccount(t *testing.T, id string, value int) *Account {
+	account := &Account{}
+	account.Init(id)
+	if err := account.Write(value, "1:A"); err != nil {
+		t.Fatal(err)
+	}
+	if err := account.Commit("1:A"); err != nil {
+		t.Fatal(err)
+	}
+	accounts.Set(id, account)
+	return account
+}
+
+// gatewayCall sends body to path on the gateway as client, if one is given,
+// and returns the answer.
+func gatewayCall(t *testing.T, server *httptest.Server, client string, method string, path string, body string) (int, GatewayResponse) {
+	t.Helper()
+	request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client != "" {
+		request.SetBasicAuth(client, "")
+	}
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var answer GatewayResponse
+	if err := json.NewDecoder(response.Body).Decode(&answer); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return response.StatusCode, answer
+}
+
+func TestGateway(t *testing.T) {
+	startBranch(t)
+	x := openAccount(t, "x", 10)
+	server := httptest.NewServer(GatewayMux())
+	defer server.Close()
+
+	code, begun := gatewayCall(t, server, "", "POST", "/transactions", "")
+	if code != http.StatusCreated || begun.TransactionId == "" {
+		t.Fatalf("begin = %d %+v", code, begun)
+	}
+	transaction := "/transactions/" + begun.TransactionId
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		status string
+	}{
+		{"POST", "/deposit", `{"account": "A.x", "amount": 5}`, http.StatusOK, "OK"},
+		{"GET", "/balance", "", http.StatusBadRequest, "INVALID COMMAND"},
+		{"GET", "/balance?account=A", "", http.StatusBadRequest, "INVALID COMMAND"},
+		{"GET", "/balance?account=A.x+AS+OF+1:A", "", http.StatusBadRequest, "INVALID COMMAND"},
+		{"POST", "/deposit", `{"account": ".x", "amount": 5}`, http.StatusBadRequest, "INVALID COMMAND"},
+		{"POST", "/deposit", `{"account": "A.x", "amount": 0}`, http.StatusBadRequest, "INVALID COMMAND"},
+		{"POST", "/open", `{"account": "A.y"}`, http.StatusNotFound, "NOT FOUND"},
+		// None of the refused requests ended the transaction.
+		{"GET", "/balance?account=A.x", "", http.StatusOK, "OK"},
+		{"POST", "/commit", "", http.StatusOK, "COMMIT OK"},
+		{"POST", "/deposit", `{"account": "A.x", "amount": 5}`, http.StatusNotFound, "NOT FOUND"},
+	}
+	for _, test := range tests {
+		code, answer := gatewayCall(t, server, "", test.method, transaction+test.path, test.body)
+		if code != test.code || answer.Status != test.status {
+			t.Errorf("%s %s %s = %d %+v, want %d %s", test.method, test.path, test.body, code, answer, test.code, test.status)
+		}
+		if test.path == "/balance?account=A.x" && (len(answer.Balances) != 1 || answer.Balances[0].Value != 15) {
+			t.Errorf("balance = %+v, want A.x = 15", answer.Balances)
+		}
+	}
+	if value, err := x.Read(fmt.Sprintf("%d:A", time.Now().UnixNano())); err != nil || value != 15 {
+		t.Errorf("committed balance = %d, %v, want 15", value, err)
+	}
+	if _, ok := gatewaySessions.Get(begun.TransactionId).(*GatewaySession); ok {
+		t.Error("session outlived its commit")
+	}
+}
+
+func TestGatewayTransfer(t *testing.T) {
+	startBranch(t)
+	x := openAccount(t, "x", 10)
+	openAccount(t, "y", 0)
+	loadACL(t, "alice read,withdraw,deposit A.x\nalice read A.y\nbob read,withdraw,deposit A.*\n")
+	server := httptest.NewServer(GatewayMux())
+	defer server.Close()
+
+	tests := []struct {
+		client string
+		to     string
+		code   int
+		status string
+		open   bool
+	}{
+		// Neither half is sent unless both are well formed and permitted.
+		{"alice", "A.y.z", http.StatusBadRequest, "INVALID COMMAND", true},
+		{"alice", "A.y", http.StatusForbidden, "PERMISSION DENIED", true},
+		// A deposit that fails once the withdrawal went through aborts the
+		// transaction.
+		{"bob", "A.*", http.StatusConflict, "ABORTED", false},
+	}
+	for _, test := range tests {
+		_, begun := gatewayCall(t, server, test.client, "POST", "/transactions", "")
+		transaction := "/transactions/" + begun.TransactionId
+		body := fmt.Sprintf(`{"from": "A.x", "to": %q, "amount": 3}`, test.to)
+		code, answer := gatewayCall(t, server, test.client, "POST", transaction+"/transfer", body)
+		if code != test.code || answer.Status != test.status {
+			t.Errorf("%s transfer to %s = %d %+v, want %d %s", test.client, test.to, code, answer, test.code, test.status)
+		}
+		if _, open := gatewaySessions.Get(begun.TransactionId).(*GatewaySession); open != test.open {
+			t.Errorf("%s transfer to %s left the transaction open = %v", test.client, test.to, open)
+		}
+		if !test.open {
+			continue
+		}
+		if _, answer := gatewayCall(t, server, test.client, "GET", transaction+"/balance?account=A.x", ""); len(answer.Balances) != 1 || answer.Balances[0].Value != 10 {
+			t.Errorf("%s transfer to %s withdrew anyway: %+v", test.client, test.to, answer)
+		}
+		gatewayCall(t, server, test.client, "POST", transaction+"/abort", "")
+	}
+
+	_, begun := gatewayCall(t, server, "bob", "POST", "/transactions", "")
+	transaction := "/transactions/" + begun.TransactionId
+	if code, answer := gatewayCall(t, server, "bob", "POST", transaction+"/transfer", `{"from": "A.x", "to": "A.y", "amount": 3}`); code != http.StatusOK {
+		t.Fatalf("transfer = %d %+v", code, answer)
+	}
+	if code, answer := gatewayCall(t, server, "bob", "POST", transaction+"/commit", ""); code != http.StatusOK {
+		t.Fatalf("commit = %d %+v", code, answer)
+	}
+	now := fmt.Sprintf("%d:A", time.Now().UnixNano())
+	if value, err := x.Read(now); err != nil || value != 7 {
+		t.Errorf("A.x = %d, %v, want 7", value, err)
+	}
+	if value, err := LookupAccount("y").Read(now); err != nil || value != 3 {
+		t.Errorf("A.y = %d, %v, want 3", value, err)
+	}
+}
+
+func TestAccountRequest(t *testing.T) {
+	request, err := AccountRequest(protocol.OpWithdraw, "B.y", 3)
+	if want := (protocol.Request{Operation: protocol.OpWithdraw, Branch: "B", Account: "y", Amount: 3}); err != nil || request != want {
+		t.Errorf("AccountRequest = %+v, %v, want %+v", request, err, want)
+	}
+	for _, account := range []string{"", "B", "B.y.z", "B.y LIMIT 2"} {
+		if _, err := AccountRequest(protocol.OpBalance, account, 0); err == nil {
+			t.Errorf("AccountRequest(%q) succeeded, want an error", account)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"bank/logging"
+	bankpb "bank/proto"
+	"bank/protocol"
+)
+
+// With transport=grpc the branch port serves the services in
+// proto/bank.proto instead of gob. Client calls drive a GatewaySession per
+// transaction, as the HTTP gateway does, and each Exchange stream between
+// branches becomes a Node whose packets StreamCodec converts to messages, so
+// HandleServer cannot tell it from a socket.
+
+func ServeGRPC(address string) {
+	listen, err := net.Listen("tcp", address)
+	if err != nil {
+		logging.Fatalf("Unable to listen on %s: %v", address, err)
+	}
+	options := []grpc.ServerOption{}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	bankpb.RegisterBankServer(server, BankService{})
+	bankpb.RegisterBranchServer(server, BranchService{})
+	logging.Fatalf("gRPC server stopped: %v", server.Serve(listen))
+}
+
+type BankService struct {
+	bankpb.UnimplementedBankServer
+}
+
+// Handshake refuses what a socket handshake would refuse. Branches only
+// shake hands on their Exchange streams.
+func (s BankService) Handshake(ctx context.Context, message *bankpb.Handshake) (*bankpb.Handshake, error) {
+	handshake := protocol.HandshakeFromProto(message)
+	reason := "branches shake hands on the Branch service"
+	if handshake.Role == protocol.ClientRole {
+		reason = CheckHandshake(handshake)
+	}
+	if reason == "" {
+		reason = CheckCaller(ctx, protocol.ClientRole, handshake.Id)
+	}
+	if reason == "" {
+		reason = Authenticate(handshake.Id, handshake.Token)
+	}
+	if reason != "" {
+		return nil, status.Error(codes.FailedPrecondition, reason)
+	}
+	local := LocalHandshake()
+	local.Features = NegotiateFeatures(handshake.Features)
+	return protocol.HandshakeToProto(local), nil
+}
+
+func (s BankService) Begin(ctx context.Context, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	return Call(ctx, protocol.OpBegin, message)
+}
+
+func (s BankService) Deposit(ctx context.Context, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	return Call(ctx, protocol.OpDeposit, message)
+}
+
+func (s BankService) Withdraw(ctx context.Context, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	return Call(ctx, protocol.OpWithdraw, message)
+}
+
+func (s BankService) Balance(ctx context.Context, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	return Call(ctx, protocol.OpBalance, message)
+}
+
+func (s BankService) Open(ctx context.Context, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	return Call(ctx, protocol.OpOpen, message)
+}
+
+func (s BankService) Close(ctx context.Context, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	return Call(ctx, protocol.OpClose, message)
+}
+
+func (s BankService) History(ctx context.Context, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	return Call(ctx, protocol.OpHistory, message)
+}
+
+func (s BankService) Snapshot(ctx context.Context, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	return Call(ctx, protocol.OpSnapshot, message)
+}
+
+func (s BankService) Commit(ctx context.Context, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	return Call(ctx, protocol.OpCommit, message)
+}
+
+func (s BankService) Abort(ctx context.Context, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	return Call(ctx, protocol.OpAbort, message)
+}
+
+func (s BankService) Join(ctx context.Context, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	return Call(ctx, protocol.OpJoin, message)
+}
+
+func (s BankService) Leave(ctx context.Context, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	return Call(ctx, protocol.OpLeave, message)
+}
+
+// Call performs operation for the client that sent message. Outcomes of the
+// command, aborts included, are answered in the response; errors are for
+// calls that never reached a transaction.
+func Call(ctx context.Context, operation protocol.Operation, message *bankpb.TransactionRequest) (*bankpb.TransactionResponse, error) {
+	if message.GetClientId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "client_id is required")
+	}
+	if reason := CheckClientId(message.GetClientId()); reason != "" {
+		return nil, status.Error(codes.InvalidArgument, reason)
+	}
+	if reason := CheckCaller(ctx, protocol.ClientRole, message.GetClientId()); reason != "" {
+		return nil, status.Error(codes.PermissionDenied, reason)
+	}
+	if reason := Authenticate(message.GetClientId(), message.GetToken()); reason != "" {
+		return nil, status.Error(codes.Unauthenticated, reason)
+	}
+	request := protocol.RequestFromProto(message.GetRequest())
+	request.Operation = operation
+	transactionId := message.GetTransactionId()
+	if operation == protocol.OpBegin {
+		session := OpenSession("grpc", message.GetClientId())
+		session.Mutex.Lock()
+		defer session.Mutex.Unlock()
+		packet, ok := session.Begin()
+		if !ok {
+			return nil, status.Error(codes.DeadlineExceeded, "branch did not answer")
+		}
+		return &bankpb.TransactionResponse{TransactionId: packet.TransactionId, Response: protocol.ResponseToProto(packet.Response)}, nil
+	}
+	session, ok := gatewaySessions.Get(transactionId).(*GatewaySession)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "unknown transaction")
+	}
+	if session.Node.ClientId != message.GetClientId() {
+		return nil, status.Error(codes.PermissionDenied, "transaction belongs to another client")
+	}
+	session.Mutex.Lock()
+	defer session.Mutex.Unlock()
+	if session.Closed {
+		return nil, status.Error(codes.NotFound, "unknown transaction")
+	}
+	packet, ok := session.Run(transactionId, []protocol.Request{request})
+	if !ok {
+		return nil, status.Error(codes.DeadlineExceeded, "branch did not answer")
+	}
+	return &bankpb.TransactionResponse{TransactionId: transactionId, Response: protocol.ResponseToProto(packet.Response)}, nil
+}
+
+// CheckCaller returns why the caller of ctx may not act as id, or an empty
+// string if it may or TLS is off.
+func CheckCaller(ctx context.Context, role protocol.Role, id string) string {
+	if tlsConfig == nil {
+		return ""
+	}
+	return protocol.CheckPeerIdentity(ContextCertificates(ctx), role, id)
+}
+
+// ContextCertificates are the certificates the peer of a call presented.
+func ContextCertificates(ctx context.Context) []*x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return info.State.PeerCertificates
+}
+
+type BranchService struct {
+	bankpb.UnimplementedBranchServer
+}
+
+// Exchange serves a stream as Listen serves a connection, until either side
+// closes it.
+func (s BranchService) Exchange(stream bankpb.Branch_ExchangeServer) error {
+	connection := NewStreamConnection(stream.Context(), stream, nil)
+	Accept(connection, StreamCodec{})
+	select {
+	case <-connection.Done:
+	case <-stream.Context().Done():
+	}
+	return nil
+}
+
+// DialExchange opens an Exchange stream to branch at address.
+func DialExchange(branch string, address string) (net.Conn, error) {
+	credential := insecure.NewCredentials()
+	if tlsConfig != nil {
+		credential = credentials.NewTLS(DialConfig(branch))
+	}
+	client, err := grpc.NewClient(address, grpc.WithTransportCredentials(credential))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := bankpb.NewBranchClient(client).Exchange(ctx)
+	if err != nil {
+		cancel()
+		client.Close()
+		return nil, err
+	}
+	return NewStreamConnection(stream.Context(), stream, func() {
+		cancel()
+		client.Close()
+	}), nil
+}
+
+// PacketStream is either end of an Exchange stream.
+type PacketStream interface {
+	Send(*bankpb.Packet) error
+	Recv() (*bankpb.Packet, error)
+}
+
+var errStreamOnly = errors.New("gRPC streams carry packets, not bytes")
+
+// StreamConnection stands in for the socket of a Node on an Exchange stream.
+// Packets travel through StreamCodec; Read and Write fail.
+type StreamConnection struct {
+	Stream PacketStream
+	Local  net.Addr
+	Remote net.Addr
+	// Certificates were presented by the other branch, over TLS.
+	Certificates []*x509.Certificate
+	// Done is closed by Close.
+	Done   chan struct{}
+	cancel func()
+	once   sync.Once
+}
+
+func NewStreamConnection(ctx context.Context, stream PacketStream, cancel func()) *StreamConnection {
+	connection := &StreamConnection{Stream: stream, Done: make(chan struct{}), cancel: cancel}
+	if p, ok := peer.FromContext(ctx); ok {
+		connection.Local, connection.Remote = p.LocalAddr, p.Addr
+	}
+	connection.Certificates = ContextCertificates(ctx)
+	return connection
+}
+
+func (c *StreamConnection) Read(b []byte) (int, error) {
+	return 0, errStreamOnly
+}
+
+func (c *StreamConnection) Write(b []byte) (int, error) {
+	return 0, errStreamOnly
+}
+
+// Close ends the stream. It may be called more than once.
+func (c *StreamConnection) Close() error {
+	c.once.Do(func() {
+		close(c.Done)
+		if c.cancel != nil {
+			c.cancel()
+		}
+	})
+	return nil
+}
+
+func (c *StreamConnection) LocalAddr() net.Addr {
+	return c.Local
+}
+
+func (c *StreamConnection) RemoteAddr() net.Addr {
+	return c.Remote
+}
+
+func (c *StreamConnection) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *StreamConnection) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *StreamConnection) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// StreamCodec sends packets as messages on a StreamConnection.
+type StreamCodec struct {
+}
+
+func (c StreamCodec) NewEncoder(w io.Writer) protocol.Encoder {
+	return streamEncoder{w.(*StreamConnection)}
+}
+
+func (c StreamCodec) NewDecoder(r io.Reader) protocol.Decoder {
+	return streamDecoder{r.(*StreamConnection)}
+}
+
+type streamEncoder struct {
+	connection *StreamConnection
+}
+
+func (e streamEncoder) Encode(v interface{}) error {
+	return e.connection.Stream.Send(protocol.PacketToProto(v.(protocol.Packet)))
+}
+
+type streamDecoder struct {
+	connection *StreamConnection
+}
+
+// Decode closes the connection once the stream ends, as nothing else would
+// release a dialed stream's client.
+func (d streamDecoder) Decode(v interface{}) error {
+	message, err := d.connection.Stream.Recv()
+	if err != nil {
+		d.connection.Close()
+		return err
+	}
+	*v.(*protocol.Packet) = protocol.PacketFromProto(message)
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	bankpb "bank/proto"
+	"bank/protocol"
+)
+
+// startGRPC serves the branch's services on an in-memory listener and
+// returns a client connection to them.
+func startGRPC(t *testing.T) *grpc.ClientConn {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	bankpb.RegisterBankServer(server, BankService{})
+	bankpb.RegisterBranchServer(server, BranchService{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	client, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestBankService(t *testing.T) {
+	startBranch(t)
+	x := openAccount(t, "x", 10)
+	bank := bankpb.NewBankClient(startGRPC(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	begun, err := bank.Begin(ctx, &bankpb.TransactionRequest{ClientId: "alice"})
+	if err != nil || protocol.ResponseFromProto(begun.GetResponse()).Status != protocol.StatusOK {
+		t.Fatalf("begin = %v, %v", begun, err)
+	}
+	transactionId := begun.GetTransactionId()
+	call := func(name string, method func(context.Context, *bankpb.TransactionRequest, ...grpc.CallOption) (*bankpb.TransactionResponse, error), request protocol.Request) protocol.Response {
+		t.Helper()
+		answer, err := method(ctx, &bankpb.TransactionRequest{ClientId: "alice", TransactionId: transactionId, Request: protocol.RequestToProto(request)})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return protocol.ResponseFromProto(answer.GetResponse())
+	}
+	if response := call("deposit", bank.Deposit, protocol.Request{Branch: "A", Account: "x", Amount: 5}); response.Status != protocol.StatusOK {
+		t.Errorf("deposit = %+v", response)
+	}
+	if response := call("balance", bank.Balance, protocol.Request{Branch: "A", Account: "x"}); response.Status != protocol.StatusOK || len(response.Balances) != 1 || response.Balances[0].Value != 15 {
+		t.Errorf("balance = %+v, want A.x = 15", response)
+	}
+	if response := call("commit", bank.Commit, protocol.Request{}); response.Status != protocol.StatusCommitOK {
+		t.Errorf("commit = %+v", response)
+	}
+	if value, err := x.Read(fmt.Sprintf("%d:A", time.Now().UnixNano())); err != nil || value != 15 {
+		t.Errorf("committed balance = %d, %v, want 15", value, err)
+	}
+	// The session is gone with its transaction.
+	if _, err := bank.Balance(ctx, &bankpb.TransactionRequest{ClientId: "alice", TransactionId: transactionId}); err == nil {
+		t.Error("balance after commit succeeded")
+	}
+}
+
+func TestBranchExchange(t *testing.T) {
+	startBranch(t)
+	retired.Init()
+	liveness.Init()
+	roster.Merge(protocol.Membership{Branches: []protocol.Member{{Id: "B", Address: "localhost", Port: "1", State: protocol.MemberAlive}}})
+	openAccount(t, "x", 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := bankpb.NewBranchClient(startGRPC(t)).Exchange(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// B shakes hands and coordinates a deposit over the stream as it would
+	// over a socket.
+	connection := NewStreamConnection(ctx, stream, cancel)
+	encoder := StreamCodec{}.NewEncoder(connection)
+	decoder := StreamCodec{}.NewDecoder(connection)
+	receive := func(commandType protocol.CommandType) protocol.Packet {
+		t.Helper()
+		for {
+			var packet protocol.Packet
+			if err := decoder.Decode(&packet); err != nil {
+				t.Fatalf("waiting for %v: %v", commandType, err)
+			}
+			if packet.CommandType == commandType {
+				return packet
+			}
+		}
+	}
+	handshake := protocol.Handshake{Version: protocol.ProtocolVersion, Role: protocol.BranchRole, Id: "B", ClusterId: clusterId, Features: protocol.SupportedFeatures}
+	if err := encoder.Encode(protocol.Packet{Version: protocol.ProtocolVersion, Id: "B", CommandType: protocol.HandshakeRequest, Handshake: handshake}); err != nil {
+		t.Fatal(err)
+	}
+	if answer := receive(protocol.HandshakeResponse); answer.Response.Status != protocol.StatusOK {
+		t.Fatalf("handshake = %+v", answer.Response)
+	}
+	transactionId := fmt.Sprintf("%d:B", time.Now().UnixNano())
+	deposit := protocol.Packet{Version: protocol.ProtocolVersion, Id: "B", TransactionId: transactionId, CommandType: protocol.CoordinatorRequest, Request: protocol.Request{Operation: protocol.OpDeposit, Branch: "A", Account: "x", Amount: 5}}
+	if err := encoder.Encode(deposit); err != nil {
+		t.Fatal(err)
+	}
+	if answer := receive(protocol.ParticipantResponse); answer.TransactionId != transactionId || answer.Response.Status != protocol.StatusOK {
+		t.Errorf("deposit = %s %+v", answer.TransactionId, answer.Response)
+	}
+
+	// With its connection retired, B's stream ends without the branch
+	// losing B, which would carry on after the test.
+	RetireBranch(nodes.Get("B").(*Node))
+	connection.Close()
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"bank/logging"
+	"bank/protocol"
+)
+
+// Branches keep the membership in the manner of SWIM. Each branch gossips its
+// view to gossipFanout random members every heartbeatInterval, and passes on
+// at once whatever it learns, so joins, leaves and failures reach everyone
+// in a few rounds. JOIN and LEAVE from a client start such an update, as do
+// the failure detector's suspicions once ping requests confirm them. With
+// discovery set to gossip, a branch only needs to know one seed in the
+// configuration file, and any branch that connects with the cluster's id
+// joins. A transaction keeps the members it began with until it finishes.
+var roster Roster
+var discovery = "static"
+
+const gossipFanout = 3
+
+// Roster is one branch's view of the membership. Views are merged member by
+// member, so news from different branches never overwrites each other, and a
+// branch that hears itself suspected or declared dead refutes it by raising
+// its incarnation.
+type Roster struct {
+	Self    string
+	Members map[string]protocol.Member
+	RWMutex sync.RWMutex
+}
+
+func (r *Roster) Init(self protocol.Member) {
+	r.RWMutex.Lock()
+	r.Self = self.Id
+	r.Members = map[string]protocol.Member{self.Id: self}
+	r.RWMutex.Unlock()
+}
+
+func (r *Roster) Get(id string) (protocol.Member, bool) {
+	r.RWMutex.RLock()
+	defer r.RWMutex.RUnlock()
+	member, ok := r.Members[id]
+	return member, ok
+}
+
+// View returns every member, including those that left, ordered by id.
+func (r *Roster) View() protocol.Membership {
+	r.RWMutex.RLock()
+	defer r.RWMutex.RUnlock()
+	view := protocol.Membership{Branches: make([]protocol.Member, 0, len(r.Members))}
+	for _, member := range r.Members {
+		view.Branches = append(view.Branches, member)
+	}
+	sort.Slice(view.Branches, func(i, j int) bool { return view.Branches[i].Id < view.Branches[j].Id })
+	return view
+}
+
+// Active returns the ids of the members that have not left, ordered by id.
+// A dead member still counts until it is removed with LEAVE.
+func (r *Roster) Active() []string {
+	r.RWMutex.RLock()
+	defer r.RWMutex.RUnlock()
+	ids := make([]string, 0, len(r.Members))
+	for id, member := range r.Members {
+		if member.State != protocol.MemberLeft {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Merge folds a view from another branch into this one and returns the
+// members that changed, which are news to pass on.
+func (r *Roster) Merge(view protocol.Membership) []protocol.Member {
+	r.RWMutex.Lock()
+	defer r.RWMutex.Unlock()
+	changes := make([]protocol.Member, 0)
+	for _, member := range view.Branches {
+		if changed, ok := r.merge(member); ok {
+			changes = append(changes, changed)
+		}
+	}
+	return changes
+}
+
+func (r *Roster) merge(member protocol.Member) (protocol.Member, bool) {
+	current, known := r.Members[member.Id]
+	if known && !member.Supersedes(current) {
+		return protocol.Member{}, false
+	}
+	if member.Id == r.Self && (member.State == protocol.MemberSuspect || member.State == protocol.MemberDead) {
+		current.Incarnation = member.Incarnation + 1
+		current.State = protocol.MemberAlive
+		member = current
+	}
+	r.Members[member.Id] = member
+	return member, true
+}
+
+// Mark records that this branch believes id to be in state, unless the
+// roster already knows as much. It returns the member as changed.
+func (r *Roster) Mark(id string, state protocol.MemberState) (protocol.Member, bool) {
+	r.RWMutex.Lock()
+	defer r.RWMutex.Unlock()
+	member, ok := r.Members[id]
+	if !ok || id == r.Self || member.State >= state {
+		return protocol.Member{}, false
+	}
+	member.State = state
+	r.Members[id] = member
+	return member, true
+}
+
+// Join adds id at address, or brings it back after it left, in an
+// incarnation above any the cluster has seen for it.
+func (r *Roster) Join(id string, address string, port string) (protocol.Member, error) {
+	r.RWMutex.Lock()
+	defer r.RWMutex.Unlock()
+	member, ok := r.Members[id]
+	if ok && member.State != protocol.MemberLeft {
+		return protocol.Member{}, fmt.Errorf("branch %s is already a member", id)
+	}
+	if ok {
+		member.Incarnation++
+	}
+	member = protocol.Member{Id: id, Address: address, Port: port, Incarnation: member.Incarnation, State: protocol.MemberAlive}
+	r.Members[id] = member
+	return member, nil
+}
+
+// Leave removes id from the membership. A branch cannot remove itself, since
+// it would stop coordinating with no one to tell its clients.
+func (r *Roster) Leave(id string) (protocol.Member, error) {
+	r.RWMutex.Lock()
+	defer r.RWMutex.Unlock()
+	member, ok := r.Members[id]
+	if !ok || member.State == protocol.MemberLeft {
+		return protocol.Member{}, fmt.Errorf("branch %s is not a member", id)
+	}
+	if id == r.Self {
+		return protocol.Member{}, fmt.Errorf("a branch cannot remove itself, ask another branch")
+	}
+	member.State = protocol.MemberLeft
+	r.Members[id] = member
+	return member, nil
+}
+
+// Targets picks up to n other active members at random to gossip to.
+func (r *Roster) Targets(n int) []string {
+	ids := make([]string, 0)
+	for _, id := range r.Active() {
+		if id != r.Self {
+			ids = append(ids, id)
+		}
+	}
+	rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	return ids[:min(n, len(ids))]
+}
+
+// Members returns the ids of the current branches.
+func Members() []string {
+	return roster.Active()
+}
+
+// MemberAddress returns where the branch id listens, if it is a member.
+func MemberAddress(id string) (protocol.Member, bool) {
+	member, ok := roster.Get(id)
+	if !ok || member.State == protocol.MemberLeft {
+		return protocol.Member{}, false
+	}
+	return member, true
+}
+
+func IsBranch(id string) bool {
+	_, ok := MemberAddress(id)
+	return ok
+}
+
+// CanJoin reports whether a branch this one has not heard of may join by
+// connecting. Branches that were removed must be added back with JOIN.
+func CanJoin(handshake protocol.Handshake) bool {
+	_, known := roster.Get(handshake.Id)
+	return discovery == "gossip" && !known && handshake.Address != ""
+}
+
+// Packet carries membership from this roster's branch.
+func (r *Roster) Packet(membership protocol.Membership) protocol.Packet {
+	return protocol.Packet{Version: protocol.ProtocolVersion, Id: r.Self, CommandType: protocol.MembershipUpdate, Membership: membership}
+}
+
+// Spread passes changes on with send to a few random members, which pass
+// them on in turn if they are news to them. Gossip no longer reaches a
+// branch that left, so it is told directly.
+func (r *Roster) Spread(changes []protocol.Member, send func(id string, packet protocol.Packet) bool) {
+	if len(changes) == 0 {
+		return
+	}
+	packet := r.Packet(protocol.Membership{Branches: changes})
+	for _, id := range r.Targets(gossipFanout) {
+		send(id, packet)
+	}
+	for _, member := range changes {
+		if member.State == protocol.MemberLeft && member.Id != r.Self {
+			send(member.Id, packet)
+		}
+	}
+}
+
+// GossipMembership sends this branch's view to a few random members every
+// heartbeatInterval.
+func GossipMembership() {
+	for range time.Tick(heartbeatInterval) {
+		packet := roster.Packet(roster.View())
+		for _, id := range roster.Targets(gossipFanout) {
+			if node, ok := nodes.Get(id).(*Node); ok {
+				node.TrySend(packet)
+			}
+		}
+	}
+}
+
+// MembershipChanged acts on news about members and spreads it. Branches that
+// left keep their connections for the transactions that still include them,
+// but are no longer monitored or redialed.
+func MembershipChanged(changes []protocol.Member) {
+	if len(changes) == 0 {
+		return
+	}
+	for _, member := range changes {
+		logging.Network.Info("Membership changed", logging.Peer(member.Id), "state", member.State.String(), "incarnation", member.Incarnation)
+		if member.Id == host.Id {
+			if member.State == protocol.MemberLeft {
+				logging.Network.Warn("This branch is no longer a member of the cluster")
+			}
+			continue
+		}
+		liveness.SetIfAbsent(member.Id, &Liveness{Id: member.Id, LastHeard: time.Now()})
+		if member.State != protocol.MemberLeft && !nodes.Contains(member.Id) {
+			go ConnectToServer(member.Id, member.Address, member.Port)
+		}
+	}
+	roster.Spread(changes, SendPacketToParticipant)
+}
+
+func HandleMembershipUpdate(node *Node, packet protocol.Packet) {
+	MembershipChanged(roster.Merge(packet.Membership))
+}
+
+// JoinBranch adds a branch that connected with the handshake in CanJoin.
+func JoinBranch(handshake protocol.Handshake) {
+	address, port, _ := net.SplitHostPort(handshake.Address)
+	MembershipChanged(roster.Merge(protocol.Membership{Branches: []protocol.Member{{Id: handshake.Id, Address: address, Port: port}}}))
+}
+
+// ReportMember spreads the failure detector's belief about branch.
+func ReportMember(branch string, state protocol.MemberState) {
+	if member, ok := roster.Mark(branch, state); ok {
+		MembershipChanged([]protocol.Member{member})
+	}
+}
+
+// ChangeMembership carries out a client's JOIN or LEAVE.
+func ChangeMembership(request protocol.Request) protocol.Response {
+	var member protocol.Member
+	var err error
+	if request.Operation == protocol.OpJoin {
+		address, port, _ := net.SplitHostPort(request.Address)
+		member, err = roster.Join(request.Branch, address, port)
+	} else {
+		member, err = roster.Leave(request.Branch)
+	}
+	if err != nil {
+		return protocol.Response{Status: protocol.StatusInvalid, Message: err.Error()}
+	}
+	MembershipChanged([]protocol.Member{member})
+	return protocol.Response{Status: protocol.StatusOK}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bank/protocol"
+)
+
+// cluster is a set of rosters that gossip to each other in rounds, standing
+// in for branches and the links between them. A stopped branch neither sends
+// nor receives.
+type cluster struct {
+	rosters map[string]*Roster
+	stopped map[string]bool
+}
+
+// newCluster starts branches that each know only themselves and the seed,
+// and have introduced themselves to the seed by connecting.
+func newCluster(seed string, ids ...string) *cluster {
+	c := &cluster{rosters: make(map[string]*Roster), stopped: make(map[string]bool)}
+	for i, id := range ids {
+		roster := &Roster{}
+		roster.Init(protocol.Member{Id: id, Address: "127.0.0.1", Port: fmt.Sprint(7400 + i)})
+		c.rosters[id] = roster
+	}
+	for _, id := range ids {
+		if id != seed {
+			self, _ := c.rosters[id].Get(id)
+			introduction := protocol.Membership{Branches: []protocol.Member{self}}
+			c.rosters[seed].Merge(introduction)
+			seedSelf, _ := c.rosters[seed].Get(seed)
+			c.rosters[id].Merge(protocol.Membership{Branches: []protocol.Member{seedSelf}})
+		}
+	}
+	return c
+}
+
+// round has every running branch gossip its view to a few random members.
+func (c *cluster) round() {
+	for id, roster := range c.rosters {
+		if c.stopped[id] {
+			continue
+		}
+		view := roster.View()
+		for _, target := range roster.Targets(2) {
+			if !c.stopped[target] {
+				c.rosters[target].Merge(view)
+			}
+		}
+	}
+}
+
+// converge runs rounds until every running branch agrees with agreed, and
+// fails the test if they have not after many rounds.
+func (c *cluster) converge(t *testing.T, what string, agreed func(roster *Roster) bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		done := true
+		for id, roster := range c.rosters {
+			if !c.stopped[id] && !agreed(roster) {
+				done = false
+			}
+		}
+		if done {
+			return
+		}
+		c.round()
+	}
+	t.Fatalf("branches did not agree that %s", what)
+}
+
+func (c *cluster) member(roster *Roster, id string) protocol.Member {
+	member, _ := roster.Get(id)
+	return member
+}
+
+func TestGossipMembership(t *testing.T) {
+	ids := []string{"A", "B", "C", "D", "E"}
+	c := newCluster("A", ids...)
+
+	c.converge(t, "all five joined", func(roster *Roster) bool {
+		return reflect.DeepEqual(roster.Active(), ids)
+	})
+
+	c.stopped["D"] = true
+	if _, ok := c.rosters["A"].Mark("D", protocol.MemberSuspect); !ok {
+		t.Fatal("A could not suspect D")
+	}
+	c.rosters["B"].Mark("D", protocol.MemberDead)
+	c.converge(t, "D is dead", func(roster *Roster) bool {
+		return c.member(roster, "D").State == protocol.MemberDead
+	})
+
+	delete(c.stopped, "D")
+	c.converge(t, "D refuted its death", func(roster *Roster) bool {
+		d := c.member(roster, "D")
+		return d.State == protocol.MemberAlive && d.Incarnation == 1
+	})
+
+	if _, err := c.rosters["B"].Leave("E"); err != nil {
+		t.Fatal(err)
+	}
+	// Gossip skips a branch that left, so B tells it directly.
+	view := c.rosters["B"].View()
+	c.rosters["E"].Merge(view)
+	c.converge(t, "E left", func(roster *Roster) bool {
+		return reflect.DeepEqual(roster.Active(), ids[:4])
+	})
+
+	if _, err := c.rosters["C"].Join("E", "127.0.0.1", "7404"); err != nil {
+		t.Fatal(err)
+	}
+	c.converge(t, "E joined again", func(roster *Roster) bool {
+		return reflect.DeepEqual(roster.Active(), ids)
+	})
+}
+
+func TestRosterChanges(t *testing.T) {
+	roster := &Roster{}
+	roster.Init(protocol.Member{Id: "A", Address: "127.0.0.1", Port: "7400"})
+	b := protocol.Member{Id: "B", Address: "127.0.0.1", Port: "7401"}
+
+	if changes := roster.Merge(protocol.Membership{Branches: []protocol.Member{b}}); len(changes) != 1 {
+		t.Fatalf("new member gave %d changes, want 1", len(changes))
+	}
+	if changes := roster.Merge(protocol.Membership{Branches: []protocol.Member{b}}); len(changes) != 0 {
+		t.Fatalf("known member gave %d changes, want 0", len(changes))
+	}
+	if _, err := roster.Join("B", "127.0.0.1", "7401"); err == nil {
+		t.Error("joined a branch that is already a member")
+	}
+	if _, err := roster.Leave("A"); err == nil {
+		t.Error("a branch removed itself")
+	}
+
+	suspicion := protocol.Member{Id: "A", Address: "127.0.0.1", Port: "7400", Incarnation: 3, State: protocol.MemberSuspect}
+	changes := roster.Merge(protocol.Membership{Branches: []protocol.Member{suspicion}})
+	want := []protocol.Member{{Id: "A", Address: "127.0.0.1", Port: "7400", Incarnation: 4, State: protocol.MemberAlive}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("refutation = %v, want %v", changes, want)
+	}
+
+	stale := b
+	stale.State = protocol.MemberAlive
+	roster.Mark("B", protocol.MemberDead)
+	if changes := roster.Merge(protocol.Membership{Branches: []protocol.Member{stale}}); len(changes) != 0 {
+		t.Errorf("stale alive overrode dead: %v", changes)
+	}
+}
+
+// loopbackBranch is a roster with its own listener on a loopback port. It
+// gossips to the others over TCP in the codec branches use, standing in for
+// a branch without the rest of its state. A stopped branch neither sends nor
+// handles what it receives.
+type loopbackBranch struct {
+	roster      Roster
+	listener    net.Listener
+	stopped     atomic.Bool
+	mutex       sync.Mutex
+	encoders    map[string]protocol.Encoder
+	connections []net.Conn
+	done        chan struct{}
+	running     sync.WaitGroup
+}
+
+// startLoopbackBranch starts a branch that knows only itself and seed, and
+// introduces itself to seed as a branch does by connecting. With no seed it
+// is the seed.
+func startLoopbackBranch(t *testing.T, id string, seed *loopbackBranch) *loopbackBranch {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	b := &loopbackBranch{listener: listener, encoders: make(map[string]protocol.Encoder), done: make(chan struct{})}
+	b.roster.Init(protocol.Member{Id: id, Address: "127.0.0.1", Port: port})
+	t.Cleanup(b.stop)
+	b.running.Add(2)
+	go b.accept()
+	go b.gossip()
+	if seed != nil {
+		seedSelf, _ := seed.roster.Get(seed.roster.Self)
+		b.roster.Merge(protocol.Membership{Branches: []protocol.Member{seedSelf}})
+		self, _ := b.roster.Get(id)
+		b.send(seedSelf.Id, b.roster.Packet(protocol.Membership{Branches: []protocol.Member{self}}))
+	}
+	return b
+}
+
+func (b *loopbackBranch) accept() {
+	defer b.running.Done()
+	for {
+		connection, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.mutex.Lock()
+		b.connections = append(b.connections, connection)
+		b.mutex.Unlock()
+		b.running.Add(1)
+		go b.receive(connection)
+	}
+}
+
+func (b *loopbackBranch) receive(connection net.Conn) {
+	defer b.running.Done()
+	decoder := protocol.GobCodec{}.NewDecoder(connection)
+	for {
+		var packet protocol.Packet
+		if decoder.Decode(&packet) != nil {
+			return
+		}
+		if !b.stopped.Load() && packet.CommandType == protocol.MembershipUpdate {
+			b.roster.Spread(b.roster.Merge(packet.Membership), b.send)
+		}
+	}
+}
+
+// send writes packet to the member id, dialing it the first time, and
+// reports false if it could not.
+func (b *loopbackBranch) send(id string, packet protocol.Packet) bool {
+	if b.stopped.Load() {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	encoder, ok := b.encoders[id]
+	if !ok {
+		member, _ := b.roster.Get(id)
+		connection, err := net.Dial("tcp", net.JoinHostPort(member.Address, member.Port))
+		if err != nil {
+			return false
+		}
+		b.connections = append(b.connections, connection)
+		encoder = protocol.GobCodec{}.NewEncoder(connection)
+		b.encoders[id] = encoder
+	}
+	if encoder.Encode(packet) != nil {
+		delete(b.encoders, id)
+		return false
+	}
+	return true
+}
+
+// gossip sends the branch's view to a few random members, much faster than
+// heartbeatInterval so the test is quick.
+func (b *loopbackBranch) gossip() {
+	defer b.running.Done()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+		packet := b.roster.Packet(b.roster.View())
+		for _, id := range b.roster.Targets(gossipFanout) {
+			b.send(id, packet)
+		}
+	}
+}
+
+func (b *loopbackBranch) stop() {
+	close(b.done)
+	b.listener.Close()
+	b.mutex.Lock()
+	for _, connection := range b.connections {
+		connection.Close()
+	}
+	b.mutex.Unlock()
+	b.running.Wait()
+}
+
+// waitFor fails the test unless every running branch agrees with agreed
+// within ten seconds.
+func waitFor(t *testing.T, what string, branches []*loopbackBranch, agreed func(roster *Roster) bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		done := true
+		for _, branch := range branches {
+			if !branch.stopped.Load() && !agreed(&branch.roster) {
+				done = false
+			}
+		}
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, branch := range branches {
+				t.Logf("%s sees %+v", branch.roster.Self, branch.roster.View())
+			}
+			t.Fatalf("branches did not agree that %s", what)
+		}
+	}
+}
+
+func TestLoopbackCluster(t *testing.T) {
+	ids := []string{"A", "B", "C", "D", "E"}
+	seed := startLoopbackBranch(t, "A", nil)
+	branches := []*loopbackBranch{seed}
+	for _, id := range ids[1:] {
+		branches = append(branches, startLoopbackBranch(t, id, seed))
+	}
+	a, b, c, d, e := branches[0], branches[1], branches[2], branches[3], branches[4]
+	state := func(roster *Roster, id string) protocol.Member {
+		member, _ := roster.Get(id)
+		return member
+	}
+	waitFor(t, "all five joined through the seed", branches, func(roster *Roster) bool {
+		return reflect.DeepEqual(roster.Active(), ids)
+	})
+
+	// The failure detector's verdict on a stopped branch reaches the rest,
+	// and the branch refutes it once it runs again.
+	d.stopped.Store(true)
+	if member, ok := a.roster.Mark("D", protocol.MemberDead); ok {
+		a.roster.Spread([]protocol.Member{member}, a.send)
+	}
+	waitFor(t, "D is dead", branches, func(roster *Roster) bool {
+		return state(roster, "D").State == protocol.MemberDead
+	})
+	d.stopped.Store(false)
+	waitFor(t, "D refuted its death", branches, func(roster *Roster) bool {
+		member := state(roster, "D")
+		return member.State == protocol.MemberAlive && member.Incarnation == 1
+	})
+
+	// LEAVE at one branch reaches every other, the one that left included.
+	member, err := b.roster.Leave("E")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.roster.Spread([]protocol.Member{member}, b.send)
+	waitFor(t, "E left", branches, func(roster *Roster) bool {
+		return reflect.DeepEqual(roster.Active(), ids[:4])
+	})
+
+	self, _ := e.roster.Get("E")
+	if member, err = c.roster.Join("E", self.Address, self.Port); err != nil {
+		t.Fatal(err)
+	}
+	c.roster.Spread([]protocol.Member{member}, c.send)
+	waitFor(t, "E joined again", branches, func(roster *Roster) bool {
+		return reflect.DeepEqual(roster.Active(), ids)
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bank/logging"
+	"bank/protocol"
+)
+
+// A branch with a metrics address serves /metrics in the Prometheus text
+// format. Counters and histograms are updated as transactions run; channel
+// depths and in-flight transactions are read when scraped.
+var metricsAddress string
+
+// latencyBuckets are the upper bounds, in seconds, of latency histograms.
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var commits atomic.Int64
+var inFlight atomic.Int64
+var aborts = CounterVec{Values: make(map[string]int64)}
+
+// phaseLatency times the phases of transactions coordinated here: execute
+// from BEGIN to COMMIT, prepare from COMMIT to the decision, and commit
+// while the decision is sent to participants.
+var phaseLatency = map[string]*Histogram{
+	"execute": NewHistogram(latencyBuckets),
+	"prepare": NewHistogram(latencyBuckets),
+	"commit":  NewHistogram(latencyBuckets),
+}
+
+// accountWait times reads, commits and snapshots blocked on an account's
+// condition variable.
+var accountWait = NewHistogram(latencyBuckets)
+
+// Abort reasons, as labels of bank_aborts_total.
+const (
+	AbortTimestampConflict   = "timestamp_conflict"
+	AbortNotFound            = "not_found"
+	AbortNegativeBalance     = "negative_balance"
+	AbortClientAbort         = "client_abort"
+	AbortClientDisconnected  = "client_disconnected"
+	AbortParticipantFailure  = "participant_failure"
+	AbortAccountExists       = "account_exists"
+	AbortNonzeroBalance      = "nonzero_balance"
+	AbortVersionNotAvailable = "version_not_available"
+)
+
+// AbortReason classifies the response a transaction aborted with, by its
+// abort code where it has one and otherwise by its status.
+func AbortReason(response protocol.Response) string {
+	switch response.Abort.Code {
+	case protocol.AbortReadTooLate, protocol.AbortWriteTooLate, protocol.AbortReadBlocked:
+		return AbortTimestampConflict
+	case protocol.AbortNegativeBalance:
+		return AbortNegativeBalance
+	case protocol.AbortCloseNonzeroBalance:
+		return AbortNonzeroBalance
+	case protocol.AbortParticipantTimeout, protocol.AbortPeerFailure:
+		return AbortParticipantFailure
+	case protocol.AbortClientRequested:
+		return AbortClientAbort
+	}
+	switch response.Status {
+	case protocol.StatusNotFound:
+		return AbortNotFound
+	case protocol.StatusAccountExists:
+		return AbortAccountExists
+	case protocol.StatusNonzeroBalance:
+		return AbortNonzeroBalance
+	case protocol.StatusNotRetained, protocol.StatusNotStable:
+		return AbortVersionNotAvailable
+	}
+	if response.Message != "" {
+		return AbortParticipantFailure
+	}
+	return AbortTimestampConflict
+}
+
+// CounterVec counts by a single label.
+type CounterVec struct {
+	Mutex  sync.Mutex
+	Values map[string]int64
+}
+
+func (c *CounterVec) Inc(label string) {
+	c.Mutex.Lock()
+	c.Values[label]++
+	c.Mutex.Unlock()
+}
+
+func (c *CounterVec) Get(label string) int64 {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return c.Values[label]
+}
+
+// Histogram counts observations into buckets by their upper bounds, keeping
+// their sum, as Prometheus histograms do.
+type Histogram struct {
+	Mutex  sync.Mutex
+	Bounds []float64
+	Counts []int64
+	Sum    float64
+	Count  int64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{Bounds: bounds, Counts: make([]int64, len(bounds))}
+}
+
+func (h *Histogram) Observe(duration time.Duration) {
+	seconds := duration.Seconds()
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	for i, bound := range h.Bounds {
+		if seconds <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Sum += seconds
+	h.Count++
+}
+
+// write writes the histogram's series, with labels such as `phase="commit"`
+// on each.
+func (h *Histogram) write(w io.Writer, name string, labels string) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	separator := ""
+	if labels != "" {
+		separator = ","
+	}
+	for i, bound := range h.Bounds {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, separator, bound, h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, separator, h.Count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.Sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.Count)
+}
+
+// ChannelDepths returns the packets queued in each connection's Input and
+// Output, keyed by node and then channel.
+func ChannelDepths() map[string]map[string]int {
+	depths := make(map[string]map[string]int)
+	for _, m := range []*Map{&nodes, &clients} {
+		m.RWMutex.RLock()
+		for id, value := range m.Data {
+			node := value.(*Node)
+			depths[id] = map[string]int{"input": len(node.Input), "output": len(node.Output)}
+		}
+		m.RWMutex.RUnlock()
+	}
+	return depths
+}
+
+// WriteMetrics writes every metric in the Prometheus text format.
+func WriteMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP bank_commits_total Transactions coordinated here that committed.")
+	fmt.Fprintln(w, "# TYPE bank_commits_total counter")
+	fmt.Fprintf(w, "bank_commits_total %d\n", commits.Load())
+
+	fmt.Fprintln(w, "# HELP bank_aborts_total Transactions coordinated here that aborted, by reason.")
+	fmt.Fprintln(w, "# TYPE bank_aborts_total counter")
+	aborts.Mutex.Lock()
+	reasons := make([]string, 0, len(aborts.Values))
+	for reason := range aborts.Values {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "bank_aborts_total{reason=%q} %d\n", reason, aborts.Values[reason])
+	}
+	aborts.Mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP bank_transactions_in_flight Transactions coordinated here that have not finished.")
+	fmt.Fprintln(w, "# TYPE bank_transactions_in_flight gauge")
+	fmt.Fprintf(w, "bank_transactions_in_flight %d\n", inFlight.Load())
+
+	fmt.Fprintln(w, "# HELP bank_transaction_phase_seconds Time spent in each phase of transactions coordinated here.")
+	fmt.Fprintln(w, "# TYPE bank_transaction_phase_seconds histogram")
+	for _, phase := range []string{"execute", "prepare", "commit"} {
+		phaseLatency[phase].write(w, "bank_transaction_phase_seconds", fmt.Sprintf("phase=%q", phase))
+	}
+
+	fmt.Fprintln(w, "# HELP bank_channel_depth Packets queued on a connection's channels.")
+	fmt.Fprintln(w, "# TYPE bank_channel_depth gauge")
+	depths := ChannelDepths()
+	ids := make([]string, 0, len(depths))
+	for id := range depths {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, channel := range []string{"input", "output"} {
+			fmt.Fprintf(w, "bank_channel_depth{node=%q,channel=%q} %d\n", id, channel, depths[id][channel])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP bank_account_wait_seconds Time reads, commits and snapshots spent blocked on an account.")
+	fmt.Fprintln(w, "# TYPE bank_account_wait_seconds histogram")
+	accountWait.write(w, "bank_account_wait_seconds", "")
+
+	fmt.Fprintln(w, "# HELP bank_spans_dropped_total Trace spans dropped because the exporter fell behind.")
+	fmt.Fprintln(w, "# TYPE bank_spans_dropped_total counter")
+	fmt.Fprintf(w, "bank_spans_dropped_total %d\n", droppedSpans.Load())
+}
+
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	var builder strings.Builder
+	WriteMetrics(&builder)
+	io.WriteString(w, builder.String())
+}
+
+func ServeMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", HandleMetrics)
+	logging.Fatalf("Metrics server stopped: %v", http.ListenAndServe(address, mux))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"bank/protocol"
+)
+
+func TestAbortReason(t *testing.T) {
+	tests := []struct {
+		response protocol.Response
+		reason   string
+	}{
+		{protocol.Response{Status: protocol.StatusAborted}, AbortTimestampConflict},
+		{protocol.Response{Status: protocol.StatusNotFound}, AbortNotFound},
+		{protocol.Response{Status: protocol.StatusAborted, Abort: protocol.AbortReason{Code: protocol.AbortNegativeBalance, Account: "B.x"}}, AbortNegativeBalance},
+		{protocol.Response{Status: protocol.StatusAborted, Abort: protocol.AbortReason{Code: protocol.AbortCloseNonzeroBalance, Account: "B.x"}}, AbortNonzeroBalance},
+		{UnavailableResponse("B", protocol.AbortParticipantTimeout), AbortParticipantFailure},
+		{protocol.Response{Status: protocol.StatusAborted, Abort: protocol.AbortReason{Code: protocol.AbortWriteTooLate}}, AbortTimestampConflict},
+		{protocol.Response{Status: protocol.StatusAborted, Abort: protocol.AbortReason{Code: protocol.AbortClientRequested}}, AbortClientAbort},
+		{protocol.Response{Status: protocol.StatusNotStable}, AbortVersionNotAvailable},
+	}
+	for _, test := range tests {
+		if reason := AbortReason(test.response); reason != test.reason {
+			t.Errorf("AbortReason(%v) = %s, want %s", test.response, reason, test.reason)
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	nodes.Init()
+	clients.Init()
+	aborts = CounterVec{Values: make(map[string]int64)}
+	phaseLatency["prepare"] = NewHistogram(latencyBuckets)
+	accountWait = NewHistogram(latencyBuckets)
+	node := stoppedNode("B", true, protocol.CoordinatorPrepare, protocol.CoordinatorCommit)
+	nodes.Set("B", node)
+	aborts.Inc(AbortClientAbort)
+	phaseLatency["prepare"].Observe(3 * time.Millisecond)
+
+	var builder strings.Builder
+	WriteMetrics(&builder)
+	metrics := builder.String()
+	for _, line := range []string{
+		`bank_aborts_total{reason="client_abort"} 1`,
+		`bank_transaction_phase_seconds_bucket{phase="prepare",le="0.0025"} 0`,
+		`bank_transaction_phase_seconds_bucket{phase="prepare",le="0.005"} 1`,
+		`bank_transaction_phase_seconds_bucket{phase="prepare",le="+Inf"} 1`,
+		`bank_transaction_phase_seconds_count{phase="prepare"} 1`,
+		`bank_channel_depth{node="B",channel="input"} 2`,
+		`bank_account_wait_seconds_count 0`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("metrics do not contain %s:\n%s", line, metrics)
+		}
+	}
+}
@@ -1,53 +1,172 @@
 package main
 
 import (
-	"encoding/gob"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"bank/config"
+	"bank/logging"
+	"bank/protocol"
 )
 
 var host Node
 var nodes Map
 var accounts Map
+var tombstones Map
+var catalogMutex sync.Mutex
+var catalogReadTimestamp = "0:A"
 var transactions Map
-var numServers int
-var serverIds []string
 
-func InitializeServer(hostBranch string, filename string) {
-	content, err := ioutil.ReadFile(filename)
+// clients holds client sessions by the session id this branch assigned them.
+// nodes only ever holds branches.
+var clients Map
+var sessionCount int64
+var snapshots Map
+var clusterId = "default"
+
+// listenAddress is where the branch port listens, and listeners hold the
+// address of the extra listener for each codec.
+var listenAddress string
+var listeners map[string]string
+
+// dataDir holds the files the branch writes, such as snapshots.
+var dataDir = "."
+
+// concurrency is "wait" or "no-wait", and decides whether a read that meets
+// an earlier transaction's tentative write waits for it or aborts.
+var concurrency = "wait"
+
+// transport is what the branch port speaks, to other branches and to clients:
+// "socket" for gob packets, "grpc" for the services in proto/bank.proto.
+var transport = "socket"
+var gatewayAddress string
+
+// With a CA configured every connection is mutual TLS. Each node presents
+// certs/<id>.crt unless its branch names a cert and key.
+var tlsFiles protocol.TLSFiles
+var certDir = "certs"
+var tlsConfig *tls.Config
+
+func InitializeServer(hostBranch string, filename string, overrides config.Overrides) {
+	cfg, err := config.Load(filename)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	branch, ok := cfg.Branch(hostBranch)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "%s: branches: no branch %q\n", filename, hostBranch)
+		os.Exit(1)
 	}
+	if err := cfg.Override(hostBranch, overrides); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	branch, _ = cfg.Branch(hostBranch)
+	ApplyConfig(cfg, branch)
 
-	lines := strings.Split(string(content), "\n")
-	numServers = len(lines)
-	for _, line := range lines {
-		serverInfo := strings.Fields(line)
-		if len(serverInfo) != 3 {
-			log.Fatal("Not enough arguments for line")
+	self := protocol.Member{Id: branch.Id, Address: branch.Host(), Port: branch.Port()}
+	peers := make([]protocol.Member, 0)
+	for _, peer := range cfg.Branches {
+		if peer.Id != hostBranch {
+			peers = append(peers, protocol.Member{Id: peer.Id, Address: peer.Host(), Port: peer.Port()})
+			liveness.Set(peer.Id, &Liveness{Id: peer.Id, LastHeard: time.Now()})
 		}
-		serverIds = append(serverIds, serverInfo[0])
-		if serverInfo[0] == hostBranch {
-			nodes.Get(hostBranch).(*Node).Port = serverInfo[2]
-		} else {
-			go ConnectToServer(serverInfo[0], serverInfo[1], serverInfo[2])
+	}
+	nodes.Get(hostBranch).(*Node).Port = branch.Port()
+	roster.Init(self)
+	roster.Merge(protocol.Membership{Branches: peers})
+	if tlsFiles.Enabled() {
+		tlsConfig, err = tlsFiles.Resolve(certDir, hostBranch).Load()
+		if err != nil {
+			logging.Fatalf("Unable to load TLS certificates: %v", err)
+		}
+	}
+	for _, member := range peers {
+		go ConnectToServer(member.Id, member.Address, member.Port)
+	}
+}
+
+// ApplyConfig sets up this branch from the cluster's configuration, which
+// has been validated, and its own entry in it.
+func ApplyConfig(cfg *config.Config, branch config.Branch) {
+	clusterId = cfg.Cluster
+	transport = cfg.Transport
+	discovery = cfg.Discovery
+	concurrency = cfg.Concurrency
+	dataDir = cfg.BranchDataDir(branch.Id)
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		logging.Fatalf("Unable to create data directory: %v", err)
+	}
+	if cfg.Trace != "" {
+		traceFile = cfg.Trace
+		if !filepath.IsAbs(traceFile) {
+			traceFile = filepath.Join(dataDir, traceFile)
+		}
+		if err := StartTracing(traceFile); err != nil {
+			logging.Fatalf("Unable to open trace file: %v", err)
 		}
 	}
+	timeouts := []struct {
+		value  string
+		target *time.Duration
+	}{{cfg.Timeouts.Heartbeat, &heartbeatInterval}, {cfg.Timeouts.Suspect, &suspectTimeout}, {cfg.Timeouts.Dead, &deadTimeout}}
+	for _, timeout := range timeouts {
+		if duration, err := config.ParseDuration(timeout.value); err == nil {
+			*timeout.target = duration
+		}
+	}
+	tlsFiles = protocol.TLSFiles{CA: cfg.TLS.CA, Cert: branch.Cert, Key: branch.Key}
+	certDir = cfg.TLS.Certs
+	if cfg.Tokens != "" {
+		if err := LoadTokens(cfg.Tokens); err != nil {
+			logging.Fatalf("Unable to load tokens: %v", err)
+		}
+	}
+	if cfg.ACL != "" {
+		if err := LoadACL(cfg.ACL); err != nil {
+			logging.Fatalf("Unable to load ACL: %v", err)
+		}
+	}
+	listenAddress = branch.ListenAddress()
+	listeners = branch.Listeners
+	gatewayAddress = branch.HTTP
+	metricsAddress = branch.Metrics
+	adminAddress = branch.Admin
 }
 
+// ConnectToServer dials branch until it is connected, backing off
+// exponentially between attempts. Only one call dials a branch at a time,
+// and a branch with a lower id is given the chance to dial first.
 func ConnectToServer(branch string, ip string, port string) {
-	for !nodes.Contains(branch) {
-		connection, err := net.Dial("tcp", ip+":"+port)
+	if !dialing.SetIfAbsent(branch, true) {
+		return
+	}
+	defer dialing.Delete(branch)
+	if !ShouldDial(branch) {
+		time.Sleep(suspectTimeout)
+	}
+	if GetLiveness(branch).GetRefused() {
+		time.Sleep(maxBackoff)
+	}
+	backoff := initialBackoff
+	for !nodes.Contains(branch) && IsBranch(branch) {
+		connection, codec, err := Dial(branch, ip+":"+port)
 		if err != nil {
-			log.Println("Unable to connect to", branch, ip, port)
-			time.Sleep(5 * time.Second)
+			logging.Network.Info("Unable to connect, retrying", logging.Peer(branch), "address", ip+":"+port, "backoff", backoff, "error", err)
+			time.Sleep(backoff)
+			backoff = min(2*backoff, maxBackoff)
 			continue
 		}
 		node := Node{
@@ -55,213 +174,665 @@ func ConnectToServer(branch string, ip string, port string) {
 			Address:    ip,
 			Port:       port,
 			Connection: connection,
+			Codec:      codec,
 			IsHost:     false,
 			IsClient:   false,
-			Input:      make(chan Packet, 100),
-			Output:     make(chan Packet, 100),
+			Input:      make(chan protocol.Packet, 100),
+			Output:     make(chan protocol.Packet, 100),
+			Done:       make(chan struct{}),
+			Outgoing:   true,
+			Stopped:    make(chan struct{}),
 		}
-		nodes.Set(branch, &node)
-		log.Println("Outgoing: Connected to", branch)
 		go Write(&node)
 		go Read(&node)
 		go HandleServer(&node)
-		node.Input <- Packet{false, host.Id, "", CoordinatorResponse, ""}
+		node.Input <- HandshakePacket(protocol.HandshakeRequest, protocol.Response{})
+		if RegisterBranch(&node) {
+			GetLiveness(branch).Connected()
+			logging.Network.Info("Connected", logging.Peer(branch), "direction", "outgoing")
+		}
+	}
+}
+
+// Dial connects to branch at address over the transport and returns the
+// codec that frames packets on the connection.
+func Dial(branch string, address string) (net.Conn, protocol.Codec, error) {
+	if transport == "grpc" {
+		connection, err := DialExchange(branch, address)
+		return connection, StreamCodec{}, err
+	}
+	if tlsConfig != nil {
+		connection, err := tls.Dial("tcp", address, DialConfig(branch))
+		return connection, protocol.GobCodec{}, err
+	}
+	connection, err := net.Dial("tcp", address)
+	return connection, protocol.GobCodec{}, err
+}
+
+// DialConfig is tlsConfig for dialing branch, whose certificate must name it.
+func DialConfig(branch string) *tls.Config {
+	config := tlsConfig.Clone()
+	config.ServerName = branch
+	return config
+}
+
+// PeerCertificates are the certificates the other end of connection
+// presented, if it is a TLS connection.
+func PeerCertificates(connection net.Conn) []*x509.Certificate {
+	switch connection := connection.(type) {
+	case *tls.Conn:
+		return connection.ConnectionState().PeerCertificates
+	case *StreamConnection:
+		return connection.Certificates
+	}
+	return nil
+}
+
+// CheckPeer returns why the peer on connection may not claim to be who
+// handshake says, or an empty string if it may or TLS is off.
+func CheckPeer(connection net.Conn, handshake protocol.Handshake) string {
+	if tlsConfig == nil {
+		return ""
+	}
+	return protocol.CheckPeerIdentity(PeerCertificates(connection), handshake.Role, handshake.Id)
+}
+
+func LocalHandshake() protocol.Handshake {
+	self, _ := roster.Get(host.Id)
+	return protocol.Handshake{Version: protocol.ProtocolVersion, Role: protocol.BranchRole, Id: host.Id, ClusterId: clusterId, Features: protocol.SupportedFeatures, Address: net.JoinHostPort(self.Address, self.Port)}
+}
+
+// CheckHandshake returns why a peer announcing handshake must be refused, or
+// an empty string if it is compatible with this branch.
+func CheckHandshake(handshake protocol.Handshake) string {
+	if handshake.Version != protocol.ProtocolVersion {
+		return fmt.Sprintf("protocol version %d is not supported, expected %d", handshake.Version, protocol.ProtocolVersion)
+	}
+	if handshake.ClusterId != clusterId {
+		return fmt.Sprintf("cluster %q does not match %q", handshake.ClusterId, clusterId)
+	}
+	if handshake.Role == protocol.BranchRole {
+		if !IsBranch(handshake.Id) && !CanJoin(handshake) {
+			return fmt.Sprintf("unknown branch %q", handshake.Id)
+		}
+		return ""
+	}
+	return CheckClientId(handshake.Id)
+}
+
+// CheckClientId returns why a client may not call itself id. Branch ids are
+// reserved so logs and ACLs never confuse the two.
+func CheckClientId(id string) string {
+	if IsBranch(id) {
+		return fmt.Sprintf("client id %q is reserved for a branch", id)
+	}
+	return ""
+}
+
+func NegotiateFeatures(features []string) []string {
+	output := make([]string, 0)
+	for _, feature := range features {
+		for _, supported := range protocol.SupportedFeatures {
+			if feature == supported {
+				output = append(output, feature)
+			}
+		}
+	}
+	return output
+}
+
+func HandleHandshakeResponse(node *Node, packet protocol.Packet) {
+	reason := packet.Response.Message
+	if packet.Response.Status == protocol.StatusOK {
+		reason = CheckHandshake(packet.Handshake)
+		if reason == "" && packet.Handshake.Id != node.Id {
+			reason = fmt.Sprintf("expected branch %q but connected to %q", node.Id, packet.Handshake.Id)
+		}
+		if reason == "" {
+			reason = CheckPeer(node.Connection, packet.Handshake)
+		}
+	}
+	if reason != "" {
+		RefuseBranch(node, reason)
+		return
 	}
+	node.Features = NegotiateFeatures(packet.Handshake.Features)
+	GetLiveness(node.Id).Negotiated(node.Features)
+	logging.Network.Info("Handshake", logging.Peer(node.Id), "features", node.Features)
+	node.Send(roster.Packet(roster.View()))
 }
 
-func NewTransaction(clientId string) string {
+// NewTransaction begins a transaction for a client session, whose trace
+// continues parent if the client sent one.
+func NewTransaction(sessionId string, parent protocol.TraceContext) string {
 	transactionId := fmt.Sprintf("%d:%s", time.Now().UnixNano(), host.Id)
 	transaction := Transaction{}
-	transaction.Init(transactionId, clientId)
+	transaction.Init(transactionId, sessionId)
+	transaction.Members = Members()
+	transaction.Span = StartSpan("transaction", spanKindServer, parent, "bank.txn", transactionId, "bank.session", sessionId)
 	transactions.Set(transactionId, &transaction)
+	inFlight.Add(1)
 	return transactionId
 }
 
 func HandleIncomingConnection(node *Node) {
-	packet := <-node.Output
-	node.IsClient = packet.IsClient
-	node.Id = packet.Id
+	packet, ok := <-node.Output
+	if !ok {
+		return
+	}
+	reason := ""
+	status := protocol.StatusRefused
+	if packet.Version != protocol.ProtocolVersion {
+		reason = fmt.Sprintf("protocol version %d is not supported, expected %d", packet.Version, protocol.ProtocolVersion)
+		status = protocol.StatusVersionMismatch
+	} else if packet.CommandType != protocol.HandshakeRequest {
+		reason = "expected a handshake"
+	} else {
+		if packet.Handshake.Version != protocol.ProtocolVersion {
+			status = protocol.StatusVersionMismatch
+		}
+		reason = CheckHandshake(packet.Handshake)
+		if reason == "" {
+			reason = CheckPeer(node.Connection, packet.Handshake)
+		}
+		if reason == "" && packet.Handshake.Role == protocol.ClientRole {
+			reason = Authenticate(packet.Handshake.Id, packet.Handshake.Token)
+		}
+	}
+	if reason != "" {
+		logging.Network.Warn("Refusing handshake", logging.Peer(packet.Id), "reason", reason)
+		node.Input <- HandshakePacket(protocol.HandshakeResponse, protocol.Response{Status: status, Message: reason})
+		return
+	}
+	node.IsClient = packet.Handshake.Role == protocol.ClientRole
+	node.Features = NegotiateFeatures(packet.Handshake.Features)
+	// The node is named before the answer is queued, since Write logs it.
+	if !node.IsClient {
+		node.Id = packet.Handshake.Id
+	} else {
+		node.Id = NewSessionId("tcp")
+		node.ClientId = packet.Handshake.Id
+	}
+	node.Input <- HandshakePacket(protocol.HandshakeResponse, protocol.Response{Status: protocol.StatusOK})
 	if !node.IsClient {
-		log.Println("Incoming: Connected to Server", node.Id)
+		joining := !IsBranch(node.Id)
+		liveness.SetIfAbsent(node.Id, &Liveness{Id: node.Id, LastHeard: time.Now()})
+		GetLiveness(node.Id).Negotiated(node.Features)
+		GetLiveness(node.Id).Connected()
+		logging.Network.Info("Connected", logging.Peer(node.Id), "direction", "incoming")
 		go HandleServer(node)
-		nodes.Set(node.Id, node)
+		if !RegisterBranch(node) {
+			return
+		}
+		if joining {
+			JoinBranch(packet.Handshake)
+		}
+		node.Input <- roster.Packet(roster.View())
 	} else {
-		log.Println("Incoming: Connected to Client", node.Id)
-		transactionId := NewTransaction(node.Id)
-		nodes.Set(node.Id, node)
-		go HandleClient(node, transactionId)
-		node.Input <- Packet{false, host.Id, transactionId, CoordinatorResponse, "OK"}
+		logging.Network.Info("Client connected", "client", node.ClientId, "session", node.Id)
+		clients.Set(node.Id, node)
+		go HandleClient(node)
 	}
 }
 
-func HandleCommandFromCoordinator(node *Node, packet Packet) {
-	command := ParseCommand(packet.Command)
+func HandleCommandFromCoordinator(node *Node, packet protocol.Packet) {
+	command := packet.Request
+	span := StartSpan("execute", spanKindServer, packet.Trace, "bank.txn", packet.TransactionId, "bank.operation", command.Operation.String(), "bank.account", command.Branch+"."+command.Account)
+	defer span.Finish()
 	if !transactions.Contains(packet.TransactionId) {
 		transaction := Transaction{}
 		transaction.Init(packet.TransactionId, "")
 		transactions.Set(packet.TransactionId, &transaction)
 	}
 	transaction := transactions.Get(packet.TransactionId).(*Transaction)
-	switch command.Action {
-	case "DEPOSIT":
-		if !accounts.Contains(command.Account) {
-			transaction.AddCreatedAccount(command.Account)
-			account := Account{}
-			account.Init(command.Account)
-			account.Write(0, packet.TransactionId)
-			accounts.Set(command.Account, &account)
+	if transaction.GetState() == protocol.Aborted {
+		node.Input <- coordinatorLostPacket(packet.TransactionId)
+		return
+	}
+	switch command.Operation {
+	case protocol.OpDeposit:
+		account := LookupAccount(command.Account)
+		value := 0
+		var err error = &NotFoundError{}
+		if account != nil {
+			transaction.AddAccount(command.Account)
+			value, err = account.Read(packet.TransactionId)
 		}
-		transaction.AddAccount(command.Account)
-		account := accounts.Get(command.Account).(*Account)
-		value, err := account.Read(packet.TransactionId)
 		if _, ok := err.(*NotFoundError); ok {
-			account.Write(0, packet.TransactionId)
+			// A deposit opens an account that never existed, but a closed
+			// one stays closed until it is opened again.
+			if account != nil && account.IsClosed() {
+				node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNotFound)
+				return
+			}
+			err = CreateAccount(command.Account, transaction)
+			if err != nil {
+				node.Input <- AbortPacket(packet.TransactionId, err)
+				return
+			}
+			transaction.AddAccount(command.Account)
+			account = LookupAccount(command.Account)
+			value = 0
 		} else if err != nil {
-			node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantAbort, "ABORTED"}
+			node.Input <- AbortPacket(packet.TransactionId, err)
 			return
 		}
-		err = account.Write(value+command.Value, packet.TransactionId)
+		err = account.Write(value+command.Amount, packet.TransactionId)
 		if err != nil {
-			node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantAbort, "ABORTED"}
+			node.Input <- AbortPacket(packet.TransactionId, err)
+			return
+		}
+		logging.Commit.Debug("Updated", logging.Txn(packet.TransactionId), logging.Account(command.Account), "value", value+command.Amount)
+		node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantResponse, protocol.StatusOK)
+	case protocol.OpBalance:
+		if command.AsOf != "" {
+			HandleBalanceAsOf(node, packet, command)
+			return
+		}
+		if command.Account == "*" {
+			HandleBalanceScan(node, packet, command, transaction)
+			return
+		}
+		account := LookupAccount(command.Account)
+		if account == nil {
+			node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNotFound)
 			return
 		}
-		log.Println("Final Value:", value)
-		accounts.Set(command.Account, account)
-		node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantResponse, "OK"}
-	case "BALANCE":
-		if !accounts.Contains(command.Account) {
-			node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantAbort, "NOT FOUND, ABORTED"}
+		transaction.AddAccount(command.Account)
+		value, err := account.Read(packet.TransactionId)
+		if _, ok := err.(*NotFoundError); ok {
+			node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNotFound)
+			return
+		} else if err != nil {
+			node.Input <- AbortPacket(packet.TransactionId, err)
+			return
+		}
+		balances := []protocol.Balance{{Branch: command.Branch, Account: command.Account, Value: value}}
+		node.Input <- ResponsePacket(packet.TransactionId, protocol.ParticipantResponse, protocol.Response{Status: protocol.StatusOK, Balances: balances})
+	case protocol.OpWithdraw:
+		account := LookupAccount(command.Account)
+		if account == nil {
+			node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNotFound)
 			return
 		}
 		transaction.AddAccount(command.Account)
-		account := accounts.Get(command.Account).(*Account)
 		value, err := account.Read(packet.TransactionId)
 		if _, ok := err.(*NotFoundError); ok {
-			node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantAbort, "NOT FOUND, ABORTED"}
+			node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNotFound)
 			return
 		} else if err != nil {
-			node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantAbort, "ABORTED"}
+			node.Input <- AbortPacket(packet.TransactionId, err)
 			return
 		}
-		node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantResponse, fmt.Sprintf("%s.%s = %d", command.Branch, command.Account, value)}
-	case "WITHDRAW":
-		if !accounts.Contains(command.Account) {
-			node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantAbort, "NOT FOUND, ABORTED"}
+		err = account.Write(value-command.Amount, packet.TransactionId)
+		if err != nil {
+			node.Input <- AbortPacket(packet.TransactionId, err)
+			return
+		}
+		node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantResponse, protocol.StatusOK)
+	case protocol.OpOpen:
+		if account := LookupAccount(command.Account); account != nil {
+			transaction.AddAccount(command.Account)
+			_, err := account.Read(packet.TransactionId)
+			if err == nil {
+				node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusAccountExists)
+				return
+			} else if _, ok := err.(*NotFoundError); !ok {
+				node.Input <- AbortPacket(packet.TransactionId, err)
+				return
+			}
+		}
+		err := CreateAccount(command.Account, transaction)
+		if err != nil {
+			node.Input <- AbortPacket(packet.TransactionId, err)
+			return
+		}
+		transaction.AddAccount(command.Account)
+		node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantResponse, protocol.StatusOK)
+	case protocol.OpClose:
+		account := LookupAccount(command.Account)
+		if account == nil {
+			node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNotFound)
 			return
 		}
 		transaction.AddAccount(command.Account)
-		account := accounts.Get(command.Account).(*Account)
 		value, err := account.Read(packet.TransactionId)
 		if _, ok := err.(*NotFoundError); ok {
-			node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantAbort, "NOT FOUND, ABORTED"}
+			node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNotFound)
 			return
 		} else if err != nil {
-			node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantAbort, "ABORTED"}
+			node.Input <- AbortPacket(packet.TransactionId, err)
+			return
+		}
+		if value != 0 {
+			node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNonzeroBalance)
 			return
 		}
-		err = account.Write(value-command.Value, packet.TransactionId)
+		err = account.Close(value, packet.TransactionId)
 		if err != nil {
-			node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantAbort, "ABORTED"}
+			node.Input <- AbortPacket(packet.TransactionId, err)
+			return
+		}
+		node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantResponse, protocol.StatusOK)
+	case protocol.OpHistory:
+		account := LookupAccount(command.Account)
+		if account == nil {
+			node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNotFound)
 			return
 		}
-		node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantResponse, "OK"}
+		history := account.GetHistory(command.Limit)
+		node.Input <- ResponsePacket(packet.TransactionId, protocol.ParticipantResponse, protocol.Response{Status: protocol.StatusOK, History: history})
+	}
+}
+
+func HandleBalanceScan(node *Node, packet protocol.Packet, command protocol.Request, transaction *Transaction) {
+	balances := make([]protocol.Balance, 0)
+	for _, accountId := range ScanAccounts(packet.TransactionId) {
+		account := LookupAccount(accountId)
+		if account == nil {
+			continue
+		}
+		transaction.AddAccount(accountId)
+		value, err := account.Read(packet.TransactionId)
+		if _, ok := err.(*NotFoundError); ok {
+			continue
+		} else if err != nil {
+			node.Input <- AbortPacket(packet.TransactionId, err)
+			return
+		}
+		balances = append(balances, protocol.Balance{Branch: command.Branch, Account: accountId, Value: value})
+	}
+	node.Input <- ResponsePacket(packet.TransactionId, protocol.ParticipantResponse, protocol.Response{Status: protocol.StatusOK, Balances: balances})
+}
+
+// HandleBalanceAsOf reads a committed version without taking part in timestamp
+// ordering. Only the past of the reading transaction can be asked for.
+func HandleBalanceAsOf(node *Node, packet protocol.Packet, command protocol.Request) {
+	if !ValidTimestamp(command.AsOf) || TimestampGreater(command.AsOf, packet.TransactionId) {
+		node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantResponse, protocol.StatusInvalid)
+		return
+	}
+	account := LookupAccount(command.Account)
+	if account == nil {
+		node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNotFound)
+		return
+	}
+	value, err := account.ReadAsOf(command.AsOf)
+	if _, ok := err.(*NotFoundError); ok {
+		node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNotFound)
+		return
+	} else if _, ok := err.(*NotRetainedError); ok {
+		node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNotRetained)
+		return
+	} else if _, ok := err.(*NotStableError); ok {
+		node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantAbort, protocol.StatusNotStable)
+		return
 	}
+	balances := []protocol.Balance{{Branch: command.Branch, Account: command.Account, Value: value}}
+	node.Input <- ResponsePacket(packet.TransactionId, protocol.ParticipantResponse, protocol.Response{Status: protocol.StatusOK, Balances: balances})
 }
 
-func HandleResponseFromParticipant(node *Node, packet Packet) {
-	clientId := transactions.Get(packet.TransactionId).(*Transaction).ClientId
-	clientNode := nodes.Get(clientId).(*Node)
-	log.Println(clientNode.Id, packet.Command, host.Id)
-	clientNode.Input <- Packet{false, host.Id, packet.TransactionId, CoordinatorResponse, packet.Command}
+func HandleResponseFromParticipant(node *Node, packet protocol.Packet) {
+	transaction := transactions.Get(packet.TransactionId).(*Transaction)
+	sessionId := transaction.GetSessionId()
+	logging.Commit.Debug("Participant answered", logging.Txn(packet.TransactionId), logging.Peer(node.Id), "status", packet.Response.Status.String(), "session", sessionId)
+	if scanning, balances := transaction.AddScanResult(packet.Response.Balances); scanning {
+		if balances != nil {
+			sort.Slice(balances, func(i, j int) bool {
+				if balances[i].Branch != balances[j].Branch {
+					return balances[i].Branch < balances[j].Branch
+				}
+				return balances[i].Account < balances[j].Account
+			})
+			SendPacketToClient(sessionId, ResponsePacket(packet.TransactionId, protocol.CoordinatorResponse, protocol.Response{Status: protocol.StatusOK, Balances: balances}))
+		}
+		return
+	}
+	SendPacketToClient(sessionId, ResponsePacket(packet.TransactionId, protocol.CoordinatorResponse, packet.Response))
 }
 
-func HandlePrepareFromCoordinator(node *Node, packet Packet) {
+func HandlePrepareFromCoordinator(node *Node, packet protocol.Packet) {
+	span := StartSpan("vote", spanKindServer, packet.Trace, "bank.txn", packet.TransactionId, "bank.vote", "yes")
+	defer span.Finish()
 	if !transactions.Contains(packet.TransactionId) {
-		node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantYes, "YES"}
+		node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantYes, protocol.StatusOK)
 		return
 	}
 	transaction := transactions.Get(packet.TransactionId).(*Transaction)
-	if transaction.NumAccounts() == 0 {
-		node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantYes, "YES"}
+	// The transaction was aborted here when its coordinator seemed dead.
+	if transaction.GetState() == protocol.Aborted {
+		span.Set("bank.vote", "no")
+		node.Input <- coordinatorLostPacket(packet.TransactionId)
+		return
 	}
-	for _, accountId := range transaction.GetAccounts() {
-		account := accounts.Get(accountId).(*Account)
-		if account.CanCommit(packet.TransactionId) {
-			node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantYes, "YES"}
-		} else {
-			account.Abort(packet.TransactionId)
-			node.Input <- Packet{false, host.Id, packet.TransactionId, ParticipantAbort, "ABORTED"}
+	transaction.SetState(protocol.Prepare)
+	// Every account is checked before voting, so the coordinator hears one
+	// vote from this branch, which names the first account by id that
+	// refused.
+	accountIds := transaction.GetAccounts()
+	sort.Strings(accountIds)
+	vote := protocol.Response{Status: protocol.StatusOK}
+	for _, accountId := range accountIds {
+		account := LookupAccount(accountId)
+		canCommit := account.CanCommit(packet.TransactionId)
+		canClose := account.CanClose(packet.TransactionId)
+		if canCommit && canClose {
+			continue
 		}
+		account.Abort(packet.TransactionId)
+		if vote.Status != protocol.StatusOK {
+			continue
+		}
+		span.Set("bank.vote", "no", "bank.account", accountId)
+		vote.Status = protocol.StatusAborted
+		vote.Abort = protocol.AbortReason{Code: protocol.AbortCloseNonzeroBalance, Account: host.Id + "." + accountId}
+		if !canCommit {
+			vote.Abort.Code = protocol.AbortNegativeBalance
+		}
+	}
+	if vote.Status != protocol.StatusOK {
+		node.Input <- ResponsePacket(packet.TransactionId, protocol.ParticipantAbort, vote)
+		return
 	}
+	node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantYes, protocol.StatusOK)
 }
 
-func HandleCommitFromCoordinator(node *Node, packet Packet) {
+func HandleCommitFromCoordinator(node *Node, packet protocol.Packet) {
+	span := StartSpan("apply", spanKindServer, packet.Trace, "bank.txn", packet.TransactionId)
+	defer span.Finish()
 	if !transactions.Contains(packet.TransactionId) {
 		return
 	}
 	transaction := transactions.Get(packet.TransactionId).(*Transaction)
-	transaction.SetState(Committed)
+	transaction.SetState(protocol.Committed)
 	for _, accountId := range transaction.GetAccounts() {
-		account := accounts.Get(accountId).(*Account)
+		account := LookupAccount(accountId)
 		account.Commit(packet.TransactionId)
+		FileAccount(account)
 	}
 	PrintBalances()
 }
 
-func HandleYesFromParticipant(node *Node, packet Packet) {
+func HandleYesFromParticipant(node *Node, packet protocol.Packet) {
 	transaction := transactions.Get(packet.TransactionId).(*Transaction)
-	if transaction.GetState() != Prepare {
+	if transaction.GetState() != protocol.Prepare {
 		return
 	}
 	transaction.AddResponse(node.Id)
-	if transaction.NumResponses() == numServers {
-		for _, id := range serverIds {
-			node := nodes.Get(id).(*Node)
-			node.Input <- Packet{false, host.Id, packet.TransactionId, CoordinatorCommit, "Commit"}
+	members := transaction.GetMembers()
+	if transaction.NumResponses() == len(members) && transaction.Finish() {
+		_, prepared := transaction.GetTimes()
+		decided := time.Now()
+		phaseLatency["prepare"].Observe(decided.Sub(prepared))
+		commits.Add(1)
+		transaction.StartPhase("commit")
+		for _, id := range members {
+			if !SendPacketToParticipant(id, StatusPacket(packet.TransactionId, protocol.CoordinatorCommit, protocol.StatusOK)) {
+				logging.Commit.Warn("Unable to send commit", logging.Txn(packet.TransactionId), logging.Peer(id))
+			}
 		}
-		clientNode := nodes.Get(transaction.GetClientId()).(*Node)
-		clientNode.Input <- Packet{false, host.Id, packet.TransactionId, CoordinatorResponse, "COMMIT OK"}
+		phaseLatency["commit"].Observe(time.Since(decided))
+		SendPacketToClient(transaction.GetSessionId(), StatusPacket(packet.TransactionId, protocol.CoordinatorResponse, protocol.StatusCommitOK))
+		transaction.EndTrace("committed")
 	}
 }
 
-func HandleAbortFromParticipant(node *Node, packet Packet) {
-	transaction := transactions.Get(packet.TransactionId).(*Transaction)
-	clientNode := nodes.Get(transaction.GetClientId()).(*Node)
-	clientNode.Input <- Packet{false, host.Id, packet.TransactionId, CoordinatorResponse, packet.Command}
-	SendAbortToParticipants(packet.TransactionId)
+func HandleAbortFromParticipant(node *Node, packet protocol.Packet) {
+	AbortTransaction(transactions.Get(packet.TransactionId).(*Transaction), packet.Response)
 }
 
-func HandleAbortFromCoordinator(node *Node, packet Packet) {
-	log.Println("ABORTED:", packet.TransactionId, transactions.Contains(packet.TransactionId))
-	if !transactions.Contains(packet.TransactionId) {
+// AbortTransaction aborts a transaction this branch coordinates, unless it
+// already finished, and gives its client response.
+func AbortTransaction(transaction *Transaction, response protocol.Response) {
+	if !transaction.Finish() {
 		return
 	}
-	transaction := transactions.Get(packet.TransactionId).(*Transaction)
-	if transaction.GetState() == Aborted {
+	state := transaction.GetState()
+	reason := AbortReason(response)
+	aborts.Inc(reason)
+	if _, prepared := transaction.GetTimes(); state == protocol.Prepare {
+		phaseLatency["prepare"].Observe(time.Since(prepared))
+	}
+	SendPacketToClient(transaction.GetSessionId(), ResponsePacket(transaction.Id, protocol.CoordinatorResponse, response))
+	SendAbortToParticipants(transaction.Id)
+	transaction.EndTrace(reason)
+}
+
+func HandleAbortFromCoordinator(node *Node, packet protocol.Packet) {
+	span := StartSpan("abort", spanKindServer, packet.Trace, "bank.txn", packet.TransactionId)
+	defer span.Finish()
+	AbortParticipant(packet.TransactionId)
+}
+
+// AbortParticipant drops this branch's part of a transaction.
+func AbortParticipant(transactionId string) {
+	logging.Commit.Debug("Aborting", logging.Txn(transactionId))
+	if !transactions.Contains(transactionId) {
+		return
+	}
+	transaction := transactions.Get(transactionId).(*Transaction)
+	if transaction.GetState() == protocol.Aborted {
 		return
 	}
 	for _, accountId := range transaction.GetAccounts() {
-		log.Println("Aborting:", accountId)
-		account := accounts.Get(accountId).(*Account)
-		account.Abort(packet.TransactionId)
+		logging.Commit.Debug("Aborting account", logging.Txn(transactionId), logging.Account(accountId))
+		account := LookupAccount(accountId)
+		account.Abort(transactionId)
 	}
-	transaction.State = Aborted
+	transaction.SetState(protocol.Aborted)
 }
 
 func SendPrepareToParticipants(transactionId string) {
 	transaction := transactions.Get(transactionId).(*Transaction)
-	transaction.SetState(Prepare)
-	for _, id := range serverIds {
-		node := nodes.Get(id).(*Node)
-		node.Input <- Packet{false, host.Id, transactionId, CoordinatorPrepare, "Prepare"}
+	transaction.SetState(protocol.Prepare)
+	began, prepared := transaction.GetTimes()
+	phaseLatency["execute"].Observe(prepared.Sub(began))
+	transaction.StartPhase("prepare")
+	for _, id := range transaction.GetMembers() {
+		if !SendPacketToParticipant(id, StatusPacket(transactionId, protocol.CoordinatorPrepare, protocol.StatusOK)) {
+			AbortTransaction(transaction, UnavailableResponse(id, protocol.AbortPeerFailure))
+			return
+		}
 	}
 }
 
 func SendAbortToParticipants(transactionId string) {
-	for _, id := range serverIds {
-		node := nodes.Get(id).(*Node)
-		node.Input <- Packet{false, host.Id, transactionId, CoordinatorAbort, "ABORTED"}
+	for _, id := range transactions.Get(transactionId).(*Transaction).GetMembers() {
+		SendPacketToParticipant(id, StatusPacket(transactionId, protocol.CoordinatorAbort, protocol.StatusAborted))
+	}
+}
+
+func StartSnapshot(sessionId string, transactionId string) {
+	snapshotId := fmt.Sprintf("%d:%s", time.Now().UnixNano(), host.Id)
+	members := Members()
+	snapshot := Snapshot{}
+	snapshot.Init(snapshotId, sessionId, transactionId, len(members))
+	snapshots.Set(snapshotId, &snapshot)
+	for _, id := range members {
+		if !SendPacketToParticipant(id, StatusPacket(snapshotId, protocol.CoordinatorSnapshot, protocol.StatusOK)) {
+			HandleSnapshotFromParticipant(&Node{Id: id}, StatusPacket(snapshotId, protocol.ParticipantSnapshot, protocol.StatusSnapshotFailed))
+		}
+	}
+}
+
+func HandleSnapshotFromCoordinator(node *Node, packet protocol.Packet) {
+	response := protocol.Response{Status: protocol.StatusOK, Balances: make([]protocol.Balance, 0), InFlight: make([]protocol.TransactionStatus, 0)}
+	transactions.RWMutex.RLock()
+	for id, value := range transactions.Data {
+		state := value.(*Transaction).GetState()
+		if state == protocol.Open || state == protocol.Prepare {
+			response.InFlight = append(response.InFlight, protocol.TransactionStatus{Id: id, State: state})
+		}
+	}
+	transactions.RWMutex.RUnlock()
+	for _, accountId := range ScanAccounts(packet.TransactionId) {
+		account := LookupAccount(accountId)
+		if account == nil {
+			continue
+		}
+		value, err := account.SnapshotRead(packet.TransactionId)
+		if _, ok := err.(*NotFoundError); ok {
+			continue
+		} else if err != nil {
+			node.Input <- StatusPacket(packet.TransactionId, protocol.ParticipantSnapshot, protocol.StatusSnapshotFailed)
+			return
+		}
+		response.Balances = append(response.Balances, protocol.Balance{Branch: host.Id, Account: accountId, Value: value})
+	}
+	node.Input <- ResponsePacket(packet.TransactionId, protocol.ParticipantSnapshot, response)
+}
+
+func HandleSnapshotFromParticipant(node *Node, packet protocol.Packet) {
+	snapshot, ok := snapshots.Get(packet.TransactionId).(*Snapshot)
+	if !ok {
+		return
+	}
+	results := snapshot.AddResult(node.Id, packet.Response)
+	if results == nil {
+		return
+	}
+	snapshots.Delete(snapshot.Id)
+	response := WriteSnapshot(snapshot.Id, results)
+	SendPacketToClient(snapshot.SessionId, ResponsePacket(snapshot.TransactionId, protocol.CoordinatorResponse, response))
+}
+
+func WriteSnapshot(snapshotId string, results map[string]protocol.Response) protocol.Response {
+	branches := make([]string, 0, len(results))
+	for branch := range results {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+	balances := make([]string, 0)
+	inflight := make([]string, 0)
+	total := 0
+	for _, branch := range branches {
+		result := results[branch]
+		if result.Status != protocol.StatusOK {
+			return protocol.Response{Status: protocol.StatusSnapshotFailed}
+		}
+		for _, balance := range result.Balances {
+			total += balance.Value
+			balances = append(balances, fmt.Sprintf("%s.%s %d", balance.Branch, balance.Account, balance.Value))
+		}
+		for _, transaction := range result.InFlight {
+			inflight = append(inflight, fmt.Sprintf("INFLIGHT %s %s %s", branch, transaction.Id, transaction.State))
+		}
+	}
+	content := fmt.Sprintf("SNAPSHOT %s\n", snapshotId)
+	for _, line := range balances {
+		content += line + "\n"
+	}
+	for _, line := range inflight {
+		content += line + "\n"
+	}
+	content += fmt.Sprintf("TOTAL %d\n", total)
+	filename := filepath.Join(dataDir, fmt.Sprintf("snapshot-%s.txt", strings.Replace(snapshotId, ":", "-", 1)))
+	err := ioutil.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		logging.Commit.Error("Unable to write snapshot", "file", filename, "error", err)
+		return protocol.Response{Status: protocol.StatusSnapshotFailed}
 	}
+	return protocol.Response{Status: protocol.StatusOK, Snapshot: filename, Total: total}
 }
 
 func PrintBalances() {
@@ -289,93 +860,353 @@ func PrintBalances() {
 
 func HandleServer(node *Node) {
 	for {
-		packet := <-node.Output
-		log.Println(packet.Command)
+		packet, ok := <-node.Output
+		if !ok {
+			LoseBranch(node, protocol.AbortPeerFailure)
+			return
+		}
+		if !node.IsHost {
+			GetLiveness(node.Id).Heard()
+		}
+		if packet.CommandType == protocol.Heartbeat {
+			continue
+		}
+		logging.Network.Debug("Received", logging.Peer(node.Id), logging.Command(packet.CommandType), logging.Txn(packet.TransactionId), "operation", packet.Request.Operation.String(), "status", packet.Response.Status.String())
 		switch packet.CommandType {
-		case CoordinatorRequest:
+		case protocol.CoordinatorRequest:
 			go HandleCommandFromCoordinator(node, packet)
-		case CoordinatorPrepare:
+		case protocol.CoordinatorPrepare:
 			go HandlePrepareFromCoordinator(node, packet)
-		case CoordinatorCommit:
+		case protocol.CoordinatorCommit:
 			go HandleCommitFromCoordinator(node, packet)
-		case CoordinatorAbort:
+		case protocol.CoordinatorAbort:
 			go HandleAbortFromCoordinator(node, packet)
-		case ParticipantResponse:
+		case protocol.ParticipantResponse:
 			go HandleResponseFromParticipant(node, packet)
-		case ParticipantYes:
+		case protocol.ParticipantYes:
 			go HandleYesFromParticipant(node, packet)
-		case ParticipantAbort:
+		case protocol.ParticipantAbort:
 			go HandleAbortFromParticipant(node, packet)
+		case protocol.CoordinatorSnapshot:
+			go HandleSnapshotFromCoordinator(node, packet)
+		case protocol.ParticipantSnapshot:
+			go HandleSnapshotFromParticipant(node, packet)
+		case protocol.HandshakeResponse:
+			go HandleHandshakeResponse(node, packet)
+		case protocol.MembershipUpdate:
+			go HandleMembershipUpdate(node, packet)
+		case protocol.PingRequest:
+			go HandlePingRequest(node, packet)
+		case protocol.PingAck:
+			go HandlePingAck(node, packet)
 		}
 	}
 }
 
-func HandleClient(node *Node, transactionId string) {
+func HandleClient(node *Node) {
+	transactionId := ""
+	issued := false
 	for {
-		packet := <-node.Output
-		if packet.TransactionId != transactionId {
-			log.Println("Transaction Id doesn't match")
+		packet, ok := <-node.Output
+		if !ok {
+			// The client is gone, so a transaction it left open can only abort.
+			if transaction, ok := transactions.Get(transactionId).(*Transaction); ok && transaction.Finish() {
+				aborts.Inc(AbortClientDisconnected)
+				SendAbortToParticipants(transactionId)
+				transaction.EndTrace(AbortClientDisconnected)
+			}
+			clients.Delete(node.Id)
+			return
+		}
+		if packet.Request.Operation == protocol.OpJoin || packet.Request.Operation == protocol.OpLeave {
+			if !Permitted(node.ClientId, packet.Request) {
+				node.Input <- StatusPacket(transactionId, protocol.CoordinatorResponse, protocol.StatusPermissionDenied)
+			} else {
+				node.Input <- ResponsePacket(transactionId, protocol.CoordinatorResponse, ChangeMembership(packet.Request))
+			}
+			continue
+		}
+		// A branch that was removed takes no more transactions, since they
+		// would not include its own accounts.
+		if packet.Request.Operation == protocol.OpBegin && !IsBranch(host.Id) {
+			node.Input <- ResponsePacket(transactionId, protocol.CoordinatorResponse, protocol.Response{Status: protocol.StatusRefused, Message: "branch is no longer a member"})
+			continue
+		}
+		if packet.Request.Operation == protocol.OpBegin {
+			if transaction, ok := transactions.Get(transactionId).(*Transaction); ok && transaction.Finish() {
+				aborts.Inc(AbortClientAbort)
+				SendAbortToParticipants(transactionId)
+				transaction.EndTrace(AbortClientAbort)
+			}
+			transactionId = NewTransaction(node.Id, packet.Trace)
+			issued = false
+			node.Input <- StatusPacket(transactionId, protocol.CoordinatorResponse, protocol.StatusOK)
+			continue
+		}
+		if transactionId == "" || !transactions.Get(transactionId).(*Transaction).IsActive() {
+			node.Input <- StatusPacket(transactionId, protocol.CoordinatorResponse, protocol.StatusInvalid)
+			continue
+		}
+		// Text sessions do not echo the transaction id back.
+		if packet.TransactionId != "" && packet.TransactionId != transactionId {
+			logging.Commit.Warn("Transaction id does not match the session", logging.Txn(transactionId), "received", packet.TransactionId)
 			return
 		}
-		command := ParseCommand(packet.Command)
-		log.Println(command.Action)
-		switch command.Action {
-		case "BEGIN":
-			NewTransaction(node.Id)
-			node.Input <- Packet{false, host.Id, transactionId, CoordinatorResponse, "OK"}
-		case "DEPOSIT":
-			SendPacketToParticipant(command.Branch, Packet{false, host.Id, transactionId, CoordinatorRequest, packet.Command})
-		case "BALANCE":
-			SendPacketToParticipant(command.Branch, Packet{false, host.Id, transactionId, CoordinatorRequest, packet.Command})
-		case "WITHDRAW":
-			SendPacketToParticipant(command.Branch, Packet{false, host.Id, transactionId, CoordinatorRequest, packet.Command})
-		case "COMMIT":
+		request := packet.Request
+		logging.Commit.Debug("Client command", logging.Txn(transactionId), "operation", request.Operation.String(), "session", node.Id)
+		if (request.Branch == "*" || request.Account == "*") && request.Operation != protocol.OpBalance {
+			node.Input <- StatusPacket(transactionId, protocol.CoordinatorResponse, protocol.StatusInvalid)
+			continue
+		}
+		// Sessions over gob, gRPC and the gateway do not go through
+		// ParseRequest, so the amount is checked here too.
+		if (request.Operation == protocol.OpDeposit || request.Operation == protocol.OpWithdraw) && request.Amount <= 0 {
+			node.Input <- StatusPacket(transactionId, protocol.CoordinatorResponse, protocol.StatusInvalid)
+			continue
+		}
+		// A denied command is answered like an invalid one and leaves the
+		// transaction open.
+		if !Permitted(node.ClientId, request) {
+			logging.Commit.Info("Permission denied", "client", node.ClientId, "operation", request.Operation.String(), logging.Account(request.Branch+"."+request.Account))
+			node.Input <- StatusPacket(transactionId, protocol.CoordinatorResponse, protocol.StatusPermissionDenied)
+			continue
+		}
+		transaction := transactions.Get(transactionId).(*Transaction)
+		switch request.Operation {
+		case protocol.OpBalance, protocol.OpDeposit, protocol.OpWithdraw, protocol.OpOpen, protocol.OpClose, protocol.OpHistory, protocol.OpSnapshot, protocol.OpCommit:
+			transaction.StartCommand(request)
+		}
+		switch request.Operation {
+		case protocol.OpBalance:
+			issued = true
+			if request.Branch == "*" {
+				members := transaction.GetMembers()
+				transaction.StartScan(len(members))
+				for _, id := range members {
+					scan := request
+					scan.Branch = id
+					if !SendRequestToParticipant(transactionId, id, scan) {
+						break
+					}
+				}
+			} else if request.Account == "*" {
+				transaction.StartScan(1)
+				SendRequestToParticipant(transactionId, request.Branch, request)
+			} else {
+				SendRequestToParticipant(transactionId, request.Branch, request)
+			}
+		case protocol.OpDeposit, protocol.OpWithdraw, protocol.OpOpen, protocol.OpClose, protocol.OpHistory:
+			issued = true
+			SendRequestToParticipant(transactionId, request.Branch, request)
+		case protocol.OpSnapshot:
+			// The snapshot waits for every earlier tentative write, so it would
+			// wait forever on this transaction's own writes.
+			if issued {
+				node.Input <- StatusPacket(transactionId, protocol.CoordinatorResponse, protocol.StatusInvalid)
+				continue
+			}
+			StartSnapshot(node.Id, transactionId)
+		case protocol.OpCommit:
 			SendPrepareToParticipants(transactionId)
-		case "ABORT":
+		case protocol.OpAbort:
+			if transaction.Finish() {
+				aborts.Inc(AbortClientAbort)
+				transaction.EndTrace(AbortClientAbort)
+			}
 			SendAbortToParticipants(transactionId)
-			node.Input <- Packet{false, host.Id, transactionId, CoordinatorResponse, "ABORTED"}
+			aborted := protocol.Response{Status: protocol.StatusAborted, Abort: protocol.AbortReason{Code: protocol.AbortClientRequested}}
+			node.Input <- ResponsePacket(transactionId, protocol.CoordinatorResponse, aborted)
 		default:
-			node.Input <- Packet{false, host.Id, transactionId, CoordinatorResponse, "INVALID COMMAND"}
+			node.Input <- StatusPacket(transactionId, protocol.CoordinatorResponse, protocol.StatusInvalid)
 		}
 	}
 }
 
-func SendPacketToParticipant(server string, packet Packet) {
-	node := nodes.Get(server).(*Node)
-	node.Input <- packet
+func LookupAccount(accountId string) *Account {
+	if account, ok := accounts.Get(accountId).(*Account); ok {
+		return account
+	}
+	if account, ok := tombstones.Get(accountId).(*Account); ok {
+		return account
+	}
+	return nil
 }
 
-func ParseCommand(command string) Command {
-	commandInfo := strings.Fields(command)
-	if len(commandInfo) == 1 {
-		return Command{commandInfo[0], "", "", 0}
-	} else if len(commandInfo) == 2 {
-		accountInfo := strings.Split(commandInfo[1], ".")
-		return Command{commandInfo[0], accountInfo[0], accountInfo[1], 0}
-	} else if len(commandInfo) == 3 {
-		accountInfo := strings.Split(commandInfo[1], ".")
-		value, err := strconv.Atoi(commandInfo[2])
-		if err != nil {
-			log.Println(err)
-		}
-		return Command{commandInfo[0], accountInfo[0], accountInfo[1], value}
+// CreateAccount opens accountId in transaction. An account that was closed
+// keeps its object, so that transactions already holding it see the reopening
+// like any other write.
+func CreateAccount(accountId string, transaction *Transaction) error {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	if TimestampGreater(catalogReadTimestamp, transaction.Id) {
+		return &AbortError{protocol.AbortReason{Code: protocol.AbortWriteTooLate, Account: accountId, Conflict: catalogReadTimestamp}}
+	}
+	account := LookupAccount(accountId)
+	if account == nil {
+		account = &Account{}
+		account.Init(accountId)
+		accounts.Set(accountId, account)
+	}
+	err := account.Write(0, transaction.Id)
+	if err != nil {
+		return err
+	}
+	transaction.AddCreatedAccount(accountId)
+	return nil
+}
+
+// FileAccount keeps account among the tombstones while its committed state is
+// closed and among the live accounts otherwise. Transactions may commit a
+// close and a reopening in either order here, so the state decides rather
+// than the transaction.
+func FileAccount(account *Account) {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	if account.IsClosed() {
+		accounts.Delete(account.Id)
+		tombstones.Set(account.Id, account)
 	} else {
-		log.Panic(command)
-		return Command{}
+		tombstones.Delete(account.Id)
+		accounts.Set(account.Id, account)
+	}
+}
+
+func ScanAccounts(timestamp string) []string {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	if TimestampGreater(timestamp, catalogReadTimestamp) {
+		catalogReadTimestamp = timestamp
+	}
+	accounts.RWMutex.RLock()
+	keys := make([]string, 0, len(accounts.Data))
+	for k := range accounts.Data {
+		keys = append(keys, k)
+	}
+	accounts.RWMutex.RUnlock()
+	// A closed account being reopened stays a tombstone until the reopening
+	// commits, so it is listed too, for the read to wait for it.
+	tombstones.RWMutex.RLock()
+	for k, value := range tombstones.Data {
+		if value.(*Account).HasPendingWrites() {
+			keys = append(keys, k)
+		}
+	}
+	tombstones.RWMutex.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// SendPacketToClient answers the client on session sessionId. Answers for a
+// client that has since disconnected are dropped, without waiting for a
+// session that is closing.
+func SendPacketToClient(sessionId string, packet protocol.Packet) {
+	node, ok := clients.Get(sessionId).(*Node)
+	if !ok || !node.Send(packet) {
+		logging.Commit.Info("Dropping answer for closed session", "session", sessionId, logging.Txn(packet.TransactionId))
+	}
+	if transaction, ok := transactions.Get(packet.TransactionId).(*Transaction); ok {
+		transaction.EndCommand(packet.Response.Status)
 	}
 }
 
+// NewSessionId names a client session of kind, numbered by a counter shared
+// by every kind.
+func NewSessionId(kind string) string {
+	return fmt.Sprintf("%s:%d", kind, atomic.AddInt64(&sessionCount, 1))
+}
+
+// SendPacketToParticipant reports false if server is not connected.
+func SendPacketToParticipant(server string, packet protocol.Packet) bool {
+	node, ok := nodes.Get(server).(*Node)
+	if !ok {
+		return false
+	}
+	if transaction, ok := transactions.Get(packet.TransactionId).(*Transaction); ok {
+		if packet.CommandType == protocol.CoordinatorRequest {
+			transaction.AddParticipant(server)
+		}
+		if packet.Trace.TraceId == "" {
+			packet.Trace = transaction.TraceContext()
+		}
+	}
+	return node.Send(packet)
+}
+
+// SendRequestToParticipant forwards a client's command, aborting the
+// transaction if the participant is unavailable.
+func SendRequestToParticipant(transactionId string, server string, request protocol.Request) bool {
+	transaction := transactions.Get(transactionId).(*Transaction)
+	if !transaction.IsMember(server) {
+		AbortTransaction(transaction, protocol.Response{Status: protocol.StatusAborted, Message: fmt.Sprintf("branch %s was not a member when the transaction began", server), Abort: protocol.AbortReason{Code: protocol.AbortPeerFailure}})
+		return false
+	}
+	if !SendPacketToParticipant(server, RequestPacket(transactionId, protocol.CoordinatorRequest, request)) {
+		AbortTransaction(transaction, UnavailableResponse(server, protocol.AbortPeerFailure))
+		return false
+	}
+	return true
+}
+
+func StatusPacket(transactionId string, commandType protocol.CommandType, status protocol.Status) protocol.Packet {
+	return ResponsePacket(transactionId, commandType, protocol.Response{Status: status})
+}
+
+func ResponsePacket(transactionId string, commandType protocol.CommandType, response protocol.Response) protocol.Packet {
+	return protocol.Packet{Version: protocol.ProtocolVersion, Id: host.Id, TransactionId: transactionId, CommandType: commandType, Response: response}
+}
+
+// AbortPacket is a participant's abort for err, with the reason an
+// AbortError gives and its account qualified by this branch.
+func AbortPacket(transactionId string, err error) protocol.Packet {
+	response := protocol.Response{Status: protocol.StatusAborted}
+	if abort, ok := err.(*AbortError); ok {
+		response.Abort = abort.Reason
+		if response.Abort.Account != "" {
+			response.Abort.Account = host.Id + "." + response.Abort.Account
+		}
+	}
+	return ResponsePacket(transactionId, protocol.ParticipantAbort, response)
+}
+
+// coordinatorLostPacket is a participant's abort of a transaction it already
+// aborted when the coordinator seemed dead.
+func coordinatorLostPacket(transactionId string) protocol.Packet {
+	response := protocol.Response{Status: protocol.StatusAborted, Abort: protocol.AbortReason{Code: protocol.AbortPeerFailure}}
+	return ResponsePacket(transactionId, protocol.ParticipantAbort, response)
+}
+
+func HandshakePacket(commandType protocol.CommandType, response protocol.Response) protocol.Packet {
+	return protocol.Packet{Version: protocol.ProtocolVersion, Id: host.Id, CommandType: commandType, Response: response, Handshake: LocalHandshake()}
+}
+
+func RequestPacket(transactionId string, commandType protocol.CommandType, request protocol.Request) protocol.Packet {
+	return protocol.Packet{Version: protocol.ProtocolVersion, Id: host.Id, TransactionId: transactionId, CommandType: commandType, Request: request}
+}
+
 func Write(node *Node) {
-	encoder := gob.NewEncoder(node.Connection)
+	defer close(node.Stopped)
+	encoder := node.Codec.NewEncoder(node.Connection)
 	for {
-		packet := <-node.Input
-		log.Printf("Send:%s %s->%s\n", packet.Command, host.Id, node.Id)
+		var packet protocol.Packet
+		select {
+		case packet = <-node.Input:
+		case <-node.Done:
+			return
+		}
+		logging.Network.Debug("Send", logging.Peer(node.Id), logging.Command(packet.CommandType), logging.Txn(packet.TransactionId))
 		if node.IsHost {
 			node.Output <- packet
 		} else {
 			err := encoder.Encode(packet)
 			if err != nil {
-				log.Println(err)
+				// Closing the connection ends Read, which reports the loss.
+				logging.Network.Info("Unable to send", logging.Peer(node.Id), logging.Command(packet.CommandType), "error", err)
+				node.unsent = append(node.unsent, packet)
+				node.Connection.Close()
+				return
+			}
+			if packet.CommandType == protocol.HandshakeResponse && packet.Response.Status != protocol.StatusOK {
+				node.Connection.Close()
 				return
 			}
 		}
@@ -383,12 +1214,13 @@ func Write(node *Node) {
 }
 
 func Read(node *Node) {
-	decoder := gob.NewDecoder(node.Connection)
+	decoder := node.Codec.NewDecoder(node.Connection)
 	for {
-		var packet Packet
+		var packet protocol.Packet
 		err := decoder.Decode(&packet)
 		if err != nil {
-			log.Println(err)
+			logging.Network.Info("Connection lost", logging.Peer(node.Id), "error", err)
+			close(node.Output)
 			return
 		}
 		node.Output <- packet
@@ -396,46 +1228,121 @@ func Read(node *Node) {
 }
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.SetOutput(ioutil.Discard)
-	if len(os.Args) != 3 {
-		log.Fatal("Format should be ./server branch configuration")
+	configFile := config.String(flag.CommandLine, "config", "BANK_CONFIG", "", "cluster configuration `file`")
+	id := config.String(flag.CommandLine, "id", "BANK_ID", "", "`branch` to run")
+	var logOptions logging.Options
+	config.StringVar(flag.CommandLine, &logOptions.Level, "log-level", "BANK_LOG_LEVEL", "warn", "least severe `level` logged, debug, info, warn or error, then any for subsystems, as in warn,commit=debug")
+	config.StringVar(flag.CommandLine, &logOptions.Format, "log-format", "BANK_LOG_FORMAT", "text", "`format` of logs: text, which is logfmt, or json")
+	config.StringVar(flag.CommandLine, &logOptions.Destination, "log", "BANK_LOG", "stderr", "stderr, stdout, off, or a `file` to append logs to")
+	var overrides config.Overrides
+	config.StringVar(flag.CommandLine, &overrides.Listen, "listen", "BANK_LISTEN", "", "`address` to listen on instead of the configured one")
+	config.StringVar(flag.CommandLine, &overrides.Metrics, "metrics", "BANK_METRICS", "", "`address` to serve /metrics on")
+	config.StringVar(flag.CommandLine, &overrides.Admin, "admin", "BANK_ADMIN", "", "`address` to serve the /admin views on")
+	config.StringVar(flag.CommandLine, &overrides.Trace, "trace", "BANK_TRACE", "", "`file` in the data directory to append trace spans to")
+	config.StringVar(flag.CommandLine, &overrides.DataDir, "data-dir", "BANK_DATA_DIR", "", "`directory` for snapshots")
+	config.StringVar(flag.CommandLine, &overrides.Heartbeat, "heartbeat", "BANK_HEARTBEAT", "", "`interval` between heartbeats")
+	config.StringVar(flag.CommandLine, &overrides.Suspect, "suspect", "BANK_SUSPECT", "", "`time` without a heartbeat before a branch is suspected")
+	config.StringVar(flag.CommandLine, &overrides.Dead, "dead", "BANK_DEAD", "", "`time` without a heartbeat before a branch is declared dead")
+	config.StringVar(flag.CommandLine, &overrides.Concurrency, "concurrency", "BANK_CONCURRENCY", "", "`mode` for conflicting reads: wait or no-wait")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: server [flags] [branch configuration]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	// The branch and configuration may still be given as arguments.
+	switch flag.NArg() {
+	case 0:
+	case 2:
+		*id, *configFile = flag.Arg(0), flag.Arg(1)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *id == "" || *configFile == "" {
+		fmt.Fprintln(os.Stderr, "A branch and a configuration are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := logging.Setup(logOptions, "branch", *id); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 	nodes.Init()
 	accounts.Init()
+	tombstones.Init()
 	transactions.Init()
+	clients.Init()
+	liveness.Init()
+	dialing.Init()
+	retired.Init()
+	snapshots.Init()
+	gatewaySessions.Init()
 
 	host = Node{
-		Id:       os.Args[1],
+		Id:       *id,
+		Codec:    protocol.GobCodec{},
 		IsHost:   true,
 		IsClient: false,
-		Input:    make(chan Packet, 100),
-		Output:   make(chan Packet, 100),
+		Input:    make(chan protocol.Packet, 100),
+		Output:   make(chan protocol.Packet, 100),
 	}
 	go Write(&host)
 	go HandleServer(&host)
 	nodes.Set(host.Id, &host)
 
-	InitializeServer(os.Args[1], os.Args[2])
+	InitializeServer(*id, *configFile, overrides)
+	go MonitorBranches()
+	go GossipMembership()
 
-	listen, err := net.Listen("tcp", ":"+host.Port)
+	for name, address := range listeners {
+		go Listen(address, codecs[name])
+	}
+	if gatewayAddress != "" {
+		go ServeGateway(gatewayAddress)
+	}
+	if metricsAddress != "" {
+		go ServeMetrics(metricsAddress)
+	}
+	if adminAddress != "" {
+		go ServeAdmin(adminAddress)
+	}
+	if transport == "grpc" {
+		ServeGRPC(listenAddress)
+	}
+	Listen(listenAddress, codecs["gob"])
+}
+
+func Listen(address string, newCodec func() protocol.Codec) {
+	listen, err := net.Listen("tcp", address)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatalf("Unable to listen on %s: %v", address, err)
+	}
+	if tlsConfig != nil {
+		listen = tls.NewListener(listen, tlsConfig)
 	}
 	for {
 		connection, err := listen.Accept()
 		if err != nil {
-			log.Println(err)
+			logging.Network.Warn("Unable to accept", "address", address, "error", err)
 			continue
 		}
-		node := Node{
-			Connection: connection,
-			IsHost:     false,
-			Input:      make(chan Packet, 100),
-			Output:     make(chan Packet, 100),
-		}
-		go Read(&node)
-		go Write(&node)
-		go HandleIncomingConnection(&node)
+		Accept(connection, newCodec())
+	}
+}
+
+// Accept serves a connection that was made to this branch. It begins with a
+// handshake saying whether a client or a branch is on the other end.
+func Accept(connection net.Conn, codec protocol.Codec) {
+	node := Node{
+		Connection: connection,
+		Codec:      codec,
+		IsHost:     false,
+		Input:      make(chan protocol.Packet, 100),
+		Output:     make(chan protocol.Packet, 100),
+		Done:       make(chan struct{}),
+		Stopped:    make(chan struct{}),
 	}
+	go Read(&node)
+	go Write(&node)
+	go HandleIncomingConnection(&node)
 }
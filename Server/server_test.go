@@ -0,0 +1,379 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"bank/protocol"
+)
+
+// participantNode is a connection whose queued responses the test reads.
+func participantNode() *Node {
+	return &Node{Id: "A", Input: make(chan protocol.Packet, 100)}
+}
+
+// startBranch sets up branch A with no accounts. It talks to itself through
+// its own node, as in main, but not through the global one other tests
+// reassign.
+func startBranch(t *testing.T) {
+	host = Node{Id: "A"}
+	nodes.Init()
+	accounts.Init()
+	tombstones.Init()
+	transactions.Init()
+	clients.Init()
+	gatewaySessions.Init()
+	roster.Init(protocol.Member{Id: "A"})
+	self := &Node{
+		Id:      "A",
+		Codec:   protocol.GobCodec{},
+		IsHost:  true,
+		Input:   make(chan protocol.Packet, 100),
+		Output:  make(chan protocol.Packet, 100),
+		Done:    make(chan struct{}),
+		Stopped: make(chan struct{}),
+	}
+	t.Cleanup(func() { close(self.Done) })
+	go Write(self)
+	go HandleServer(self)
+	nodes.Set(self.Id, self)
+}
+
+func TestOpenAndClose(t *testing.T) {
+	host = Node{Id: "A"}
+	accounts.Init()
+	tombstones.Init()
+	transactions.Init()
+	node := participantNode()
+	run := func(transactionId string, command string) string {
+		request, err := protocol.ParseRequest(command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		HandleCommandFromCoordinator(node, protocol.Packet{TransactionId: transactionId, Request: request})
+		return protocol.FormatResponse(request, (<-node.Input).Response)
+	}
+	commit := func(transactionId string) {
+		HandlePrepareFromCoordinator(node, protocol.Packet{TransactionId: transactionId})
+		if vote := (<-node.Input).CommandType; vote != protocol.ParticipantYes {
+			t.Fatalf("%s voted %v", transactionId, vote)
+		}
+		HandleCommitFromCoordinator(node, protocol.Packet{TransactionId: transactionId})
+	}
+
+	tests := []struct {
+		transactionId string
+		commands      []string
+		answer        string
+		committed     bool
+	}{
+		{"10:A", []string{"OPEN A.x", "DEPOSIT A.x 5"}, "OK", true},
+		{"20:A", []string{"OPEN A.x"}, "ACCOUNT EXISTS, ABORTED", false},
+		{"30:A", []string{"CLOSE A.x"}, "NONZERO BALANCE, ABORTED", false},
+		{"40:A", []string{"WITHDRAW A.x 5", "CLOSE A.x"}, "OK", true},
+		{"50:A", []string{"DEPOSIT A.x 1"}, "NOT FOUND, ABORTED", false},
+		{"60:A", []string{"OPEN A.x", "DEPOSIT A.x 2"}, "OK", true},
+		// Opening the account again in the transaction that closes it
+		// undoes the close, so the deposit after it can commit.
+		{"70:A", []string{"WITHDRAW A.x 2", "CLOSE A.x", "OPEN A.x", "DEPOSIT A.x 5"}, "OK", true},
+	}
+	for _, test := range tests {
+		answer := "OK"
+		for _, command := range test.commands {
+			if answer = run(test.transactionId, command); answer != "OK" {
+				break
+			}
+		}
+		if answer != test.answer {
+			t.Fatalf("%s: answer = %q, want %q", test.transactionId, answer, test.answer)
+		}
+		if test.committed {
+			commit(test.transactionId)
+		} else {
+			HandleAbortFromCoordinator(node, protocol.Packet{TransactionId: test.transactionId})
+		}
+	}
+
+	account := LookupAccount("x")
+	if value, err := account.Read("80:A"); err != nil || value != 5 {
+		t.Errorf("balance after reopening = %d, %v, want 5", value, err)
+	}
+	if account.IsClosed() || tombstones.Contains("x") {
+		t.Error("reopened account is still closed")
+	}
+}
+
+// waitForWaiters returns once n transactions are blocked on account, and
+// fails the test if they are not within a second.
+func waitForWaiters(t *testing.T, account *Account, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); len(account.View().Waiters) < n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("waiters = %+v, want %d", account.View().Waiters, n)
+		}
+	}
+}
+
+func TestScanWaitsForReopen(t *testing.T) {
+	host = Node{Id: "A"}
+	accounts.Init()
+	tombstones.Init()
+	transactions.Init()
+	concurrency = "wait"
+	catalogReadTimestamp = "0:A"
+	defer func() { catalogReadTimestamp = "0:A" }()
+
+	opener := &Transaction{}
+	opener.Init("10:A", "")
+	if err := CreateAccount("x", opener); err != nil {
+		t.Fatal(err)
+	}
+	account := LookupAccount("x")
+	account.Commit("10:A")
+	if err := account.Close(0, "20:A"); err != nil {
+		t.Fatal(err)
+	}
+	account.Commit("20:A")
+	FileAccount(account)
+
+	// An earlier transaction reopens x, so later scans must wait for it.
+	reopener := &Transaction{}
+	reopener.Init("30:A", "")
+	if err := CreateAccount("x", reopener); err != nil {
+		t.Fatal(err)
+	}
+	if err := account.Write(7, "30:A"); err != nil {
+		t.Fatal(err)
+	}
+	scanner := &Transaction{}
+	scanner.Init("40:A", "")
+	scan := participantNode()
+	go HandleBalanceScan(scan, protocol.Packet{TransactionId: "40:A"}, protocol.Request{Operation: protocol.OpBalance, Branch: "A", Account: "*"}, scanner)
+	snapshot := participantNode()
+	go HandleSnapshotFromCoordinator(snapshot, protocol.Packet{TransactionId: "45:A"})
+
+	waitForWaiters(t, account, 2)
+	if len(scan.Input) > 0 || len(snapshot.Input) > 0 {
+		t.Fatal("scan or snapshot did not wait for the reopening")
+	}
+	account.Commit("30:A")
+	FileAccount(account)
+
+	for name, node := range map[string]*Node{"scan": scan, "snapshot": snapshot} {
+		select {
+		case packet := <-node.Input:
+			balances := packet.Response.Balances
+			if len(balances) != 1 || balances[0].Account != "x" || balances[0].Value != 7 {
+				t.Errorf("%s balances = %+v, want x = 7", name, balances)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s never finished", name)
+		}
+	}
+	if _, err := account.ReadAsOf("25:A"); errorText(err) != "Not Found" {
+		t.Errorf("ReadAsOf while closed = %v, want Not Found", err)
+	}
+}
+
+func TestCoordinatorFinishesOnce(t *testing.T) {
+	transactions.Init()
+	clients.Init()
+	nodes.Init()
+	client := participantNode()
+	clients.Set("s", client)
+	b := stoppedNode("B", true)
+	c := stoppedNode("C", true)
+	nodes.Set("B", b)
+	nodes.Set("C", c)
+	prepared := func(id string) *Transaction {
+		transaction := &Transaction{}
+		transaction.Init(id, "s")
+		transaction.Members = []string{"B", "C"}
+		transaction.SetState(protocol.Prepare)
+		transactions.Set(id, transaction)
+		return transaction
+	}
+
+	// A repeated vote neither counts twice nor commits twice.
+	committed := prepared("1:A")
+	yes := protocol.Packet{TransactionId: "1:A", CommandType: protocol.ParticipantYes}
+	HandleYesFromParticipant(b, yes)
+	HandleYesFromParticipant(b, yes)
+	if len(client.Input) != 0 {
+		t.Fatal("committed before every participant voted")
+	}
+	HandleYesFromParticipant(c, yes)
+	HandleYesFromParticipant(c, yes)
+	if len(client.Input) != 1 || (<-client.Input).Response.Status != protocol.StatusCommitOK {
+		t.Error("client was not told of the commit exactly once")
+	}
+	if committed.IsActive() || committed.Finish() {
+		t.Error("committed transaction is still unfinished")
+	}
+	for _, node := range []*Node{b, c} {
+		if got := queuedTypes(node); len(got) != 1 || got[0] != protocol.CoordinatorCommit {
+			t.Errorf("%s was sent %v, want one commit", node.Id, got)
+		}
+	}
+
+	// Once one participant votes no, later votes change nothing.
+	prepared("2:A")
+	aborted := protocol.Packet{TransactionId: "2:A", CommandType: protocol.ParticipantAbort, Response: protocol.Response{Status: protocol.StatusAborted}}
+	HandleAbortFromParticipant(b, aborted)
+	HandleAbortFromParticipant(c, aborted)
+	HandleYesFromParticipant(b, protocol.Packet{TransactionId: "2:A", CommandType: protocol.ParticipantYes})
+	HandleYesFromParticipant(c, protocol.Packet{TransactionId: "2:A", CommandType: protocol.ParticipantYes})
+	if len(client.Input) != 1 || (<-client.Input).Response.Status != protocol.StatusAborted {
+		t.Error("client was not told of the abort exactly once")
+	}
+	for _, node := range []*Node{b, c} {
+		if got := queuedTypes(node); len(got) != 1 || got[0] != protocol.CoordinatorAbort {
+			t.Errorf("%s was sent %v, want one abort", node.Id, got)
+		}
+	}
+}
+
+func TestClientBeginAndAbort(t *testing.T) {
+	host = Node{Id: "A"}
+	transactions.Init()
+	clients.Init()
+	nodes.Init()
+	roster.Init(protocol.Member{Id: "A"})
+	session := &Node{Id: "s", Input: make(chan protocol.Packet, 100), Output: make(chan protocol.Packet, 100)}
+	clients.Set("s", session)
+	go HandleClient(session)
+	defer close(session.Output)
+	send := func(operation protocol.Operation, amount int) protocol.Packet {
+		session.Output <- protocol.Packet{CommandType: protocol.ClientRequest, Request: protocol.Request{Operation: operation, Branch: "A", Account: "x", Amount: amount}}
+		select {
+		case packet := <-session.Input:
+			return packet
+		case <-time.After(time.Second):
+			t.Fatalf("no answer to %s", operation)
+			return protocol.Packet{}
+		}
+	}
+
+	first := send(protocol.OpBegin, 0).TransactionId
+	second := send(protocol.OpBegin, 0).TransactionId
+	if first == second {
+		t.Fatal("BEGIN did not start a new transaction")
+	}
+	if transactions.Get(first).(*Transaction).IsActive() {
+		t.Error("BEGIN left the previous transaction open")
+	}
+	// A session that skips ParseRequest still cannot withdraw a negative
+	// amount.
+	if answer := send(protocol.OpWithdraw, -5); answer.Response.Status != protocol.StatusInvalid {
+		t.Errorf("WITHDRAW -5 = %v, want invalid", answer.Response.Status)
+	}
+	if answer := send(protocol.OpAbort, 0); answer.Response.Abort.Code != protocol.AbortClientRequested {
+		t.Errorf("ABORT = %+v, want a client abort", answer.Response)
+	}
+	if transactions.Get(second).(*Transaction).Finish() {
+		t.Error("ABORT did not finish the transaction")
+	}
+	if answer := send(protocol.OpDeposit, 1); answer.Response.Status != protocol.StatusInvalid {
+		t.Errorf("DEPOSIT after ABORT = %v, want invalid", answer.Response.Status)
+	}
+}
+
+func TestPrepareRefusesNonzeroClose(t *testing.T) {
+	host = Node{Id: "A"}
+	accounts.Init()
+	tombstones.Init()
+	transactions.Init()
+	clients.Init()
+	session := &Node{Id: "tcp:1", Input: make(chan protocol.Packet, 10)}
+	clients.Set("tcp:1", session)
+	account := &Account{}
+	account.Init("x")
+	accounts.Set("x", account)
+	transaction := &Transaction{}
+	transaction.Init("10:A", "tcp:1")
+	transaction.AddAccount("x")
+	transactions.Set("10:A", transaction)
+	if err := account.Close(5, "10:A"); err != nil {
+		t.Fatal(err)
+	}
+
+	node := participantNode()
+	HandlePrepareFromCoordinator(node, protocol.Packet{TransactionId: "10:A"})
+	vote := <-node.Input
+	want := protocol.AbortReason{Code: protocol.AbortCloseNonzeroBalance, Account: "A.x"}
+	if vote.CommandType != protocol.ParticipantAbort || vote.Response.Abort != want {
+		t.Errorf("vote = %v %+v, want a no with %+v", vote.CommandType, vote.Response.Abort, want)
+	}
+	if got := AbortReason(vote.Response); got != AbortNonzeroBalance {
+		t.Errorf("AbortReason = %s, want %s", got, AbortNonzeroBalance)
+	}
+
+	// The coordinator passes the reason in the vote on to the client.
+	HandleAbortFromParticipant(node, vote)
+	if answer := <-session.Input; protocol.FormatResponse(protocol.Request{Operation: protocol.OpCommit}, answer.Response) != "ABORTED CLOSE_NONZERO_BALANCE account=A.x" {
+		t.Errorf("client was told %+v, want the close refused for A.x", answer.Response)
+	}
+}
+
+func TestPrepareVotesOnce(t *testing.T) {
+	host = Node{Id: "A"}
+	tests := []struct {
+		name   string
+		writes map[string]int
+		closes string
+		vote   protocol.CommandType
+		abort  protocol.AbortReason
+	}{
+		{"all commit", map[string]int{"x": 1, "y": 2, "z": 3}, "", protocol.ParticipantYes, protocol.AbortReason{}},
+		{"one negative", map[string]int{"x": 1, "y": -2, "z": 3}, "", protocol.ParticipantAbort, protocol.AbortReason{Code: protocol.AbortNegativeBalance, Account: "A.y"}},
+		{"negative and nonzero close", map[string]int{"x": 1, "y": -2, "z": 3}, "x", protocol.ParticipantAbort, protocol.AbortReason{Code: protocol.AbortCloseNonzeroBalance, Account: "A.x"}},
+	}
+	for _, test := range tests {
+		accounts.Init()
+		transactions.Init()
+		transaction := &Transaction{}
+		transaction.Init("10:A", "")
+		transactions.Set("10:A", transaction)
+		for accountId, value := range test.writes {
+			account := &Account{}
+			account.Init(accountId)
+			accounts.Set(accountId, account)
+			transaction.AddAccount(accountId)
+			write := account.Write
+			if accountId == test.closes {
+				write = account.Close
+			}
+			if err := write(value, "10:A"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		node := participantNode()
+		HandlePrepareFromCoordinator(node, protocol.Packet{TransactionId: "10:A"})
+		if len(node.Input) != 1 {
+			t.Fatalf("%s: sent %d votes, want one", test.name, len(node.Input))
+		}
+		vote := <-node.Input
+		if vote.CommandType != test.vote || vote.Response.Abort != test.abort {
+			t.Errorf("%s: vote = %v %+v, want %v %+v", test.name, vote.CommandType, vote.Response.Abort, test.vote, test.abort)
+		}
+	}
+}
+
+func TestSendPacketToClientClosedSession(t *testing.T) {
+	clients.Init()
+	session := &Node{Id: "tcp:1", Input: make(chan protocol.Packet), Done: make(chan struct{})}
+	clients.Set("tcp:1", session)
+	close(session.Done)
+
+	sent := make(chan struct{})
+	go func() {
+		SendPacketToClient("tcp:1", StatusPacket("10:A", protocol.CoordinatorResponse, protocol.StatusOK))
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("answer to a closed session blocked")
+	}
+}
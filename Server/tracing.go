@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bank/logging"
+	"bank/protocol"
+)
+
+// With tracing on, each transaction is a trace. The coordinator records a
+// span for the transaction, one for each client command, and the prepare and
+// commit phases; participants record executing a command, voting and
+// applying the commit as children of the span whose packet asked them to,
+// which travels in Packet.Trace. Ended spans are appended to traceFile as
+// OTLP JSON, one export request per line, as an OpenTelemetry collector's
+// file exporter writes them.
+var traceFile string
+
+// finishedSpans is nil while tracing is off, which makes StartSpan return
+// nil spans that record nothing.
+var finishedSpans chan *Span
+
+// droppedSpans counts spans ended while the exporter was behind.
+var droppedSpans atomic.Int64
+
+const maxSpansPerLine = 100
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	statusOK         = 1
+	statusError      = 2
+)
+
+type Span struct {
+	TraceId    string
+	SpanId     string
+	ParentId   string
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Failed     bool
+	Attributes map[string]string
+	Mutex      sync.Mutex
+}
+
+func randomId(bytes int) string {
+	id := ""
+	for len(id) < 2*bytes {
+		id += fmt.Sprintf("%016x", rand.Uint64())
+	}
+	return id[:2*bytes]
+}
+
+// StartSpan starts a span named name as a child of parent, or of a new trace
+// if parent is empty. Attributes are given as key and value pairs.
+func StartSpan(name string, kind int, parent protocol.TraceContext, attributes ...string) *Span {
+	if finishedSpans == nil {
+		return nil
+	}
+	span := &Span{TraceId: parent.TraceId, ParentId: parent.SpanId, SpanId: randomId(8), Name: name, Kind: kind, Start: time.Now(), Attributes: map[string]string{"bank.branch": host.Id}}
+	if span.TraceId == "" {
+		span.TraceId = randomId(16)
+		span.ParentId = ""
+	}
+	span.Set(attributes...)
+	return span
+}
+
+// Context returns what a packet sent from within the span carries.
+func (s *Span) Context() protocol.TraceContext {
+	if s == nil {
+		return protocol.TraceContext{}
+	}
+	return protocol.TraceContext{TraceId: s.TraceId, SpanId: s.SpanId}
+}
+
+// Set adds attributes given as key and value pairs.
+func (s *Span) Set(attributes ...string) {
+	if s == nil {
+		return
+	}
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	for i := 0; i+1 < len(attributes); i += 2 {
+		s.Attributes[attributes[i]] = attributes[i+1]
+	}
+}
+
+// Fail marks the span as having ended in error, such as an abort.
+func (s *Span) Fail() {
+	if s == nil {
+		return
+	}
+	s.Mutex.Lock()
+	s.Failed = true
+	s.Mutex.Unlock()
+}
+
+// Finish ends the span and queues it for export, unless it already ended.
+// Spans are dropped rather than slow the branch down when the exporter
+// falls behind.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.Mutex.Lock()
+	if !s.End.IsZero() {
+		s.Mutex.Unlock()
+		return
+	}
+	s.End = time.Now()
+	s.Mutex.Unlock()
+	select {
+	case finishedSpans <- s:
+	default:
+		droppedSpans.Add(1)
+	}
+}
+
+// StartTracing turns tracing on, appending spans to filename.
+func StartTracing(filename string) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	finishedSpans = make(chan *Span, 4096)
+	go ExportSpans(file, finishedSpans)
+	return nil
+}
+
+// ExportSpans writes spans as they finish, batching those that finish
+// together onto one line.
+func ExportSpans(w io.Writer, spans chan *Span) {
+	writer := bufio.NewWriter(w)
+	for span := range spans {
+		batch := []*Span{span}
+		for len(batch) < maxSpansPerLine && len(spans) > 0 {
+			batch = append(batch, <-spans)
+		}
+		line, err := json.Marshal(ExportRequest(batch))
+		if err == nil {
+			writer.Write(line)
+			writer.WriteByte('\n')
+			err = writer.Flush()
+		}
+		if err != nil {
+			logging.Commit.Warn("Unable to export spans", "file", traceFile, "error", err)
+		}
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// ExportRequest converts spans into an OTLP trace export request.
+func ExportRequest(spans []*Span) otlpExportRequest {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "bank"
+	for _, span := range spans {
+		span.Mutex.Lock()
+		converted := otlpSpan{
+			TraceId:           span.TraceId,
+			SpanId:            span.SpanId,
+			ParentSpanId:      span.ParentId,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        attributes(span.Attributes),
+			Status:            otlpStatus{Code: statusOK},
+		}
+		if span.Failed {
+			converted.Status.Code = statusError
+		}
+		span.Mutex.Unlock()
+		scope.Spans = append(scope.Spans, converted)
+	}
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = attributes(map[string]string{"service.name": "bank", "service.instance.id": host.Id})
+	return otlpExportRequest{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+func attributes(values map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	converted := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		converted = append(converted, otlpAttribute{Key: key, Value: otlpValue{StringValue: values[key]}})
+	}
+	return converted
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"bank/protocol"
+)
+
+func TestTransactionTrace(t *testing.T) {
+	host = Node{Id: "A"}
+	finishedSpans = make(chan *Span, 100)
+	defer func() { finishedSpans = nil }()
+
+	transaction := &Transaction{}
+	transaction.Init("1:A", "tcp:1")
+	transaction.Span = StartSpan("transaction", spanKindServer, protocol.TraceContext{}, "bank.txn", "1:A")
+	transaction.StartCommand(protocol.Request{Operation: protocol.OpCommit})
+	transaction.StartPhase("prepare")
+
+	// A participant votes under the prepare span its packet carries.
+	vote := StartSpan("vote", spanKindServer, transaction.TraceContext())
+	vote.Finish()
+	transaction.EndCommand(protocol.StatusAborted)
+	transaction.EndTrace(AbortNegativeBalance)
+
+	spans := make(map[string]*Span)
+	for len(finishedSpans) > 0 {
+		span := <-finishedSpans
+		spans[span.Name] = span
+	}
+	if len(spans) != 4 {
+		t.Fatalf("finished spans = %v", spans)
+	}
+	parents := map[string]string{"transaction": "", "command": "transaction", "prepare": "command", "vote": "prepare"}
+	for name, parent := range parents {
+		span := spans[name]
+		if span.TraceId != spans["transaction"].TraceId || len(span.TraceId) != 32 || len(span.SpanId) != 16 {
+			t.Errorf("%s span has trace %q and id %q", name, span.TraceId, span.SpanId)
+		}
+		if parent != "" && span.ParentId != spans[parent].SpanId {
+			t.Errorf("parent of %s is %q, want the %s span", name, span.ParentId, parent)
+		}
+	}
+	if !spans["transaction"].Failed || spans["transaction"].Attributes["bank.outcome"] != AbortNegativeBalance {
+		t.Errorf("transaction span = %+v", spans["transaction"])
+	}
+
+	line, err := json.Marshal(ExportRequest([]*Span{spans["command"]}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{
+		`"resourceSpans":[{"resource":{"attributes":[{"key":"service.instance.id","value":{"stringValue":"A"}}`,
+		`"name":"command","kind":2`,
+		`{"key":"bank.status","value":{"stringValue":"ABORTED"}}`,
+		`"status":{"code":2}`,
+	} {
+		if !strings.Contains(string(line), field) {
+			t.Errorf("export request %s does not contain %s", line, field)
+		}
+	}
+}
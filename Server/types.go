@@ -1,45 +1,100 @@
 package main
 
 import (
-	"log"
 	"net"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
-)
+	"time"
 
-type CommandType int
-
-const (
-	ClientRequest CommandType = iota
-	CoordinatorResponse
-	CoordinatorRequest
-	CoordinatorPrepare
-	CoordinatorCommit
-	CoordinatorAbort
-	ParticipantResponse
-	ParticipantYes
-	ParticipantAbort
+	"bank/logging"
+	"bank/protocol"
 )
 
-type Packet struct {
-	IsClient      bool
-	Id            string
-	TransactionId string
-	CommandType   CommandType
-	Command       string
-}
-
 type Node struct {
 	Id         string
 	Address    string
 	Port       string
 	Connection net.Conn
-	Input      chan Packet
-	Output     chan Packet
+	Codec      protocol.Codec
+	Input      chan protocol.Packet
+	Output     chan protocol.Packet
 	IsHost     bool
 	IsClient   bool
+	Features   []string
+	// A client's Id is the session id this branch assigned it. ClientId is
+	// who it authenticated as, which the ACL is checked against and which
+	// several sessions may share.
+	ClientId string
+	// Done is closed once a branch's connection has been given up on, so
+	// that senders stop waiting for room in Input.
+	Done     chan struct{}
+	doneOnce sync.Once
+	// Outgoing is set on connections this branch dialed.
+	Outgoing bool
+	// Stopped is closed when Write returns, after which unsent holds the
+	// packet it failed to write, if any.
+	Stopped chan struct{}
+	unsent  []protocol.Packet
+}
+
+// Send queues packet for the node and reports false if the node was closed
+// instead.
+func (n *Node) Send(packet protocol.Packet) bool {
+	select {
+	case n.Input <- packet:
+		return true
+	case <-n.Done:
+		return false
+	}
+}
+
+// TrySend queues packet unless Input is full.
+func (n *Node) TrySend(packet protocol.Packet) bool {
+	select {
+	case n.Input <- packet:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close releases the node's senders and drops its connection.
+func (n *Node) Close() {
+	n.doneOnce.Do(func() {
+		close(n.Done)
+		n.Connection.Close()
+	})
+}
+
+// IsOpen reports whether the node has not been closed.
+func (n *Node) IsOpen() bool {
+	select {
+	case <-n.Done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Leftovers waits for the node's writer to stop and returns the packets
+// queued for the branch that it never wrote, in order. Handshakes belong to
+// their connection and are dropped.
+func (n *Node) Leftovers() []protocol.Packet {
+	<-n.Stopped
+	packets := append([]protocol.Packet{}, n.unsent...)
+	for {
+		select {
+		case packet := <-n.Input:
+			packets = append(packets, packet)
+		default:
+			return slices.DeleteFunc(packets, func(packet protocol.Packet) bool {
+				return packet.CommandType == protocol.HandshakeRequest || packet.CommandType == protocol.HandshakeResponse
+			})
+		}
+	}
 }
 
 type Map struct {
@@ -48,7 +103,9 @@ type Map struct {
 }
 
 func (m *Map) Init() {
+	m.RWMutex.Lock()
 	m.Data = make(map[string]interface{})
+	m.RWMutex.Unlock()
 }
 
 func (m *Map) Delete(id string) {
@@ -77,6 +134,30 @@ func (m *Map) Length() int {
 	return length
 }
 
+// SetIfAbsent stores value under id unless id is taken, and reports whether
+// it did.
+func (m *Map) SetIfAbsent(id string, value interface{}) bool {
+	m.RWMutex.Lock()
+	defer m.RWMutex.Unlock()
+	if _, ok := m.Data[id]; ok {
+		return false
+	}
+	m.Data[id] = value
+	return true
+}
+
+// CompareAndDelete deletes id if it still holds value, and reports whether
+// it did.
+func (m *Map) CompareAndDelete(id string, value interface{}) bool {
+	m.RWMutex.Lock()
+	defer m.RWMutex.Unlock()
+	if m.Data[id] != value {
+		return false
+	}
+	delete(m.Data, id)
+	return true
+}
+
 func (m *Map) Contains(id string) bool {
 	m.RWMutex.RLock()
 	_, ok := m.Data[id]
@@ -91,60 +172,115 @@ func (e *NotFoundError) Error() string {
 	return "Not Found"
 }
 
+type NotRetainedError struct {
+}
+
+func (e *NotRetainedError) Error() string {
+	return "Not Retained"
+}
+
+type NotStableError struct {
+}
+
+func (e *NotStableError) Error() string {
+	return "Not Stable"
+}
+
+// AbortError is why an operation on an account aborts its transaction. The
+// reason's account is the account's id on this branch.
 type AbortError struct {
+	Reason protocol.AbortReason
 }
 
 func (e *AbortError) Error() string {
-	return "Abort"
+	return "Abort: " + e.Reason.String()
 }
 
+// TenativeWrite is a transaction's pending value for an account. Closes
+// marks the write of a CLOSE, which takes the account away when it commits.
 type TenativeWrite struct {
 	Timestamp string
 	Value     int
 	Committed bool
+	Closes    bool
 }
 
+const maxRetainedVersions = 1000
+
 type Account struct {
-	Id              string
-	Value           int
-	CommitTimestamp string
-	Reads           []string
-	Writes          []*TenativeWrite
-	Mutex           sync.Mutex
-	Cond            *sync.Cond
+	Id                string
+	Value             int
+	CommitTimestamp   string
+	SnapshotTimestamp string
+	Reads             []string
+	Writes            []*TenativeWrite
+	History           []protocol.HistoryEntry
+	HistoryTrimmed    bool
+	// Closed is set while the committed state is a CLOSE. Reads then find no
+	// account, as they do before the first commit.
+	Closed bool
+	// ClosedVersions are the versions in History that were a CLOSE, as of
+	// which the account did not exist.
+	ClosedVersions map[string]bool
+	// Waiters are the transactions blocked on Cond.
+	Waiters []*Waiter
+	Mutex   sync.Mutex
+	Cond    *sync.Cond
+}
+
+// Waiter is a transaction waiting on an account for an earlier one to
+// commit or abort.
+type Waiter struct {
+	Transaction string    `json:"transaction"`
+	Operation   string    `json:"operation"`
+	Since       time.Time `json:"since"`
 }
 
 func (a *Account) Init(id string) {
 	a.Id = id
 	a.CommitTimestamp = "0:A"
-	a.Writes = append(a.Writes, &TenativeWrite{"0:A", 0, false})
+	a.SnapshotTimestamp = "0:A"
+	a.Writes = append(a.Writes, &TenativeWrite{"0:A", 0, false, false})
+	a.ClosedVersions = make(map[string]bool)
 	a.Cond = sync.NewCond(&a.Mutex)
 }
 
 func (a *Account) Write(value int, timestamp string) error {
+	return a.write(value, timestamp, false)
+}
+
+// Close writes the deletion marker of a CLOSE, keeping the balance.
+func (a *Account) Close(value int, timestamp string) error {
+	return a.write(value, timestamp, true)
+}
+
+func (a *Account) write(value int, timestamp string, closes bool) error {
 	a.Mutex.Lock()
 	defer a.Mutex.Unlock()
-	if len(a.Reads) > 0 {
-		log.Println(timestamp, a.Reads[len(a.Reads)-1], TimestampGreaterEqual(timestamp, a.Reads[len(a.Reads)-1]))
-	}
-	if (len(a.Reads) == 0 || TimestampGreaterEqual(timestamp, a.Reads[len(a.Reads)-1])) && TimestampGreater(timestamp, a.CommitTimestamp) {
+	if (len(a.Reads) == 0 || TimestampGreaterEqual(timestamp, a.Reads[len(a.Reads)-1])) && TimestampGreater(timestamp, a.CommitTimestamp) && TimestampGreater(timestamp, a.SnapshotTimestamp) {
 
 		for _, write := range a.Writes {
 			if write.Timestamp == timestamp {
 				write.Value = value
+				write.Closes = closes
 				return nil
 			}
 		}
-		a.Writes = append(a.Writes, &TenativeWrite{timestamp, value, false})
+		a.Writes = append(a.Writes, &TenativeWrite{timestamp, value, false, closes})
 		sort.Slice(a.Writes, func(i, j int) bool {
 			return !TimestampGreater(a.Writes[i].Timestamp, a.Writes[j].Timestamp)
 		})
-		for _, write := range a.Writes {
-			log.Println(write.Timestamp)
-		}
+		logging.Concurrency.Debug("Tentative write", logging.Account(a.Id), logging.Txn(timestamp), "value", value, "writes", len(a.Writes))
 		return nil
 	} else {
-		return &AbortError{}
+		logging.Concurrency.Debug("Write too late", logging.Account(a.Id), logging.Txn(timestamp), "reads", a.Reads, "committed", a.CommitTimestamp)
+		conflict := a.SnapshotTimestamp
+		if len(a.Reads) > 0 && TimestampGreater(a.Reads[len(a.Reads)-1], timestamp) {
+			conflict = a.Reads[len(a.Reads)-1]
+		} else if !TimestampGreater(timestamp, a.CommitTimestamp) {
+			conflict = a.CommitTimestamp
+		}
+		return &AbortError{protocol.AbortReason{Code: protocol.AbortWriteTooLate, Account: a.Id, Conflict: conflict}}
 	}
 }
 
@@ -161,32 +297,43 @@ func (a *Account) Read(timestamp string) (int, error) {
 				break
 			}
 		}
-		log.Println(tenativeWrite)
-		if committed {
+		if committed && a.Closed {
+			a.Mutex.Unlock()
+			return 0, &NotFoundError{}
+		} else if committed {
 			a.Reads = append(a.Reads, timestamp)
 			sort.Slice(a.Reads, func(i, j int) bool {
 				return !TimestampGreater(a.Reads[i], a.Reads[j])
 			})
-			log.Println(a.Reads)
+			logging.Concurrency.Debug("Read", logging.Account(a.Id), logging.Txn(timestamp), "committed", a.CommitTimestamp)
 			a.Mutex.Unlock()
 			return a.Value, nil
 		} else {
-			if tenativeWrite.Timestamp == timestamp {
+			if tenativeWrite.Timestamp == timestamp && tenativeWrite.Closes {
+				a.Mutex.Unlock()
+				return 0, &NotFoundError{}
+			} else if tenativeWrite.Timestamp == timestamp {
 				a.Mutex.Unlock()
 				return tenativeWrite.Value, nil
 			} else if tenativeWrite.Timestamp == "0:A" {
 				a.Mutex.Unlock()
 				return 0, &NotFoundError{}
+			} else if concurrency == "no-wait" {
+				logging.Concurrency.Debug("Read would wait, aborting", logging.Account(a.Id), logging.Txn(timestamp), "writer", tenativeWrite.Timestamp)
+				a.Mutex.Unlock()
+				return 0, &AbortError{protocol.AbortReason{Code: protocol.AbortReadBlocked, Account: a.Id, Conflict: tenativeWrite.Timestamp}}
 			} else {
-				a.Cond.Wait()
+				logging.Concurrency.Debug("Read waiting", logging.Account(a.Id), logging.Txn(timestamp), "writer", tenativeWrite.Timestamp)
+				a.wait(timestamp, "read")
 				a.Mutex.Unlock()
-				log.Println("READ UNLOCK")
 				return a.Read(timestamp)
 			}
 		}
 	} else {
+		logging.Concurrency.Debug("Read too late", logging.Account(a.Id), logging.Txn(timestamp), "committed", a.CommitTimestamp)
+		conflict := a.CommitTimestamp
 		a.Mutex.Unlock()
-		return 0, &AbortError{}
+		return 0, &AbortError{protocol.AbortReason{Code: protocol.AbortReadTooLate, Account: a.Id, Conflict: conflict}}
 	}
 }
 
@@ -201,32 +348,57 @@ func (a *Account) CanCommit(timestamp string) bool {
 	return true
 }
 
+// CanClose reports whether the transaction's write, if it still closes the
+// account, leaves nothing in it. A later write by the same transaction, as
+// when it opens the account again, no longer closes it.
+func (a *Account) CanClose(timestamp string) bool {
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+	for _, write := range a.Writes {
+		if write.Timestamp == timestamp {
+			return !write.Closes || write.Value == 0
+		}
+	}
+	return true
+}
+
 func (a *Account) Commit(timestamp string) error {
 	a.Mutex.Lock()
 	index := -1
 	for i, write := range a.Writes {
 		if write.Timestamp == timestamp {
 			if i != 1 {
-				a.Cond.Wait()
+				a.wait(timestamp, "commit")
 				a.Mutex.Unlock()
 				return a.Commit(timestamp)
 			} else {
 				if write.Value < 0 {
 					a.Mutex.Unlock()
-					return &AbortError{}
+					return &AbortError{protocol.AbortReason{Code: protocol.AbortNegativeBalance, Account: a.Id}}
 				}
 				a.Cond.Broadcast()
+				a.History = append(a.History, protocol.HistoryEntry{TransactionId: timestamp, Delta: write.Value - a.Value, Balance: write.Value})
+				if write.Closes {
+					a.ClosedVersions[timestamp] = true
+				}
+				if len(a.History) > maxRetainedVersions {
+					for _, entry := range a.History[:len(a.History)-maxRetainedVersions] {
+						delete(a.ClosedVersions, entry.TransactionId)
+					}
+					a.History = a.History[len(a.History)-maxRetainedVersions:]
+					a.HistoryTrimmed = true
+				}
 				a.Value = write.Value
+				a.Closed = write.Closes
 				write.Committed = true
 				index = 1
 			}
 		}
 	}
-	log.Println(len(a.Writes))
 	if index == 1 {
 		a.Writes = a.Writes[1:]
+		logging.Concurrency.Debug("Committed", logging.Account(a.Id), logging.Txn(timestamp), "value", a.Value)
 	}
-	log.Println(len(a.Writes))
 	index = -1
 	for i, read := range a.Reads {
 		if read == timestamp {
@@ -244,6 +416,89 @@ func (a *Account) Commit(timestamp string) error {
 	return nil
 }
 
+func (a *Account) IsClosed() bool {
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+	return a.Closed
+}
+
+func (a *Account) GetHistory(limit int) []protocol.HistoryEntry {
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+	start := 0
+	if limit > 0 && limit < len(a.History) {
+		start = len(a.History) - limit
+	}
+	output := make([]protocol.HistoryEntry, len(a.History)-start)
+	copy(output, a.History[start:])
+	return output
+}
+
+// ReadAsOf returns the committed value as of timestamp. While a write at or
+// before timestamp is pending that value may still change, so it is not
+// returned.
+func (a *Account) ReadAsOf(timestamp string) (int, error) {
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+	if a.hasPendingWrite(timestamp) {
+		return 0, &NotStableError{}
+	}
+	for i := len(a.History) - 1; i >= 0; i-- {
+		if TimestampGreaterEqual(timestamp, a.History[i].TransactionId) {
+			if a.ClosedVersions[a.History[i].TransactionId] {
+				return 0, &NotFoundError{}
+			}
+			return a.History[i].Balance, nil
+		}
+	}
+	if a.HistoryTrimmed {
+		return 0, &NotRetainedError{}
+	}
+	return 0, &NotFoundError{}
+}
+
+// SnapshotRead returns the committed value as of timestamp once every earlier
+// tentative write has resolved, and stops older transactions from writing
+// behind it.
+func (a *Account) SnapshotRead(timestamp string) (int, error) {
+	a.Mutex.Lock()
+	for a.hasPendingWrite(timestamp) {
+		a.wait(timestamp, "snapshot")
+	}
+	if TimestampGreater(timestamp, a.SnapshotTimestamp) {
+		a.SnapshotTimestamp = timestamp
+	}
+	a.Mutex.Unlock()
+	return a.ReadAsOf(timestamp)
+}
+
+// wait blocks transaction timestamp on Cond, whose lock the caller holds,
+// recording it among the waiters and timing the wait.
+func (a *Account) wait(timestamp string, operation string) {
+	waiter := &Waiter{Transaction: timestamp, Operation: operation, Since: time.Now()}
+	a.Waiters = append(a.Waiters, waiter)
+	a.Cond.Wait()
+	a.Waiters = slices.DeleteFunc(a.Waiters, func(w *Waiter) bool { return w == waiter })
+	accountWait.Observe(time.Since(waiter.Since))
+}
+
+// HasPendingWrites reports whether any transaction has a tentative write on
+// the account.
+func (a *Account) HasPendingWrites() bool {
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+	return len(a.Writes) > 1
+}
+
+func (a *Account) hasPendingWrite(timestamp string) bool {
+	for _, write := range a.Writes[1:] {
+		if !write.Committed && TimestampGreaterEqual(timestamp, write.Timestamp) {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *Account) Abort(timestamp string) {
 	a.Mutex.Lock()
 	defer a.Mutex.Unlock()
@@ -274,6 +529,15 @@ func (a *Account) Abort(timestamp string) {
 	}
 }
 
+func ValidTimestamp(timestamp string) bool {
+	timestampInfo := strings.Split(timestamp, ":")
+	if len(timestampInfo) != 2 {
+		return false
+	}
+	_, err := strconv.Atoi(timestampInfo[0])
+	return err == nil
+}
+
 func TimestampGreaterEqual(timestamp1 string, timestamp2 string) bool {
 	return timestamp1 == timestamp2 || TimestampGreater(timestamp1, timestamp2)
 }
@@ -292,47 +556,65 @@ func TimestampGreater(timestamp1 string, timestamp2 string) bool {
 	}
 }
 
-type Command struct {
-	Action  string
-	Branch  string
-	Account string
-	Value   int
-}
-
-type TransactionState int
-
-const (
-	Open TransactionState = iota
-	Prepare
-	Committed
-	Aborted
-)
-
 type Transaction struct {
 	Id              string
-	ClientId        string
+	SessionId       string
 	Accounts        map[string]bool
 	CreatedAccounts []string
-	State           TransactionState
-	Responses       map[string]bool
-	RWMutex         sync.RWMutex
+	State           protocol.TransactionState
+	Participants    map[string]bool
+	// Members are the branches when the coordinator began the transaction,
+	// which prepare and commit it whatever the membership is by then.
+	Members     []string
+	Responses   map[string]bool
+	ScanPending int
+	ScanResults []protocol.Balance
+	Finished    bool
+	// Began and Prepared are when the transaction began and started to
+	// prepare, to time its phases.
+	Began    time.Time
+	Prepared time.Time
+	// Span is the coordinator's span for the whole transaction, Command the
+	// one for the client command being answered, and Phase the one for
+	// preparing or committing. They are nil while tracing is off.
+	Span    *Span
+	Command *Span
+	Phase   *Span
+	RWMutex sync.RWMutex
 }
 
-func (t *Transaction) Init(id string, clientId string) {
+func (t *Transaction) Init(id string, sessionId string) {
 	t.RWMutex.Lock()
 	t.Id = id
-	t.ClientId = clientId
+	t.SessionId = sessionId
 	t.Accounts = make(map[string]bool)
 	t.CreatedAccounts = make([]string, 0)
-	t.State = Open
+	t.State = protocol.Open
+	t.Participants = make(map[string]bool)
 	t.Responses = make(map[string]bool)
+	t.Began = time.Now()
 	t.RWMutex.Unlock()
 }
 
-func (t *Transaction) GetClientId() string {
+func (t *Transaction) GetMembers() []string {
 	t.RWMutex.RLock()
 	defer t.RWMutex.RUnlock()
-	return t.ClientId
+	return t.Members
+}
+
+func (t *Transaction) IsMember(branch string) bool {
+	for _, id := range t.GetMembers() {
+		if id == branch {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Transaction) GetSessionId() string {
+	t.RWMutex.RLock()
+	defer t.RWMutex.RUnlock()
+	return t.SessionId
 }
 
 func (t *Transaction) AddAccount(accountId string) {
@@ -347,12 +629,6 @@ func (t *Transaction) AddCreatedAccount(accountId string) {
 	t.RWMutex.Unlock()
 }
 
-func (t *Transaction) NumAccounts() int {
-	t.RWMutex.RLock()
-	defer t.RWMutex.RUnlock()
-	return len(t.Accounts)
-}
-
 func (t *Transaction) GetAccounts() []string {
 	t.RWMutex.RLock()
 	defer t.RWMutex.RUnlock()
@@ -363,18 +639,150 @@ func (t *Transaction) GetAccounts() []string {
 	return output
 }
 
-func (t *Transaction) GetState() TransactionState {
+func (t *Transaction) GetState() protocol.TransactionState {
 	t.RWMutex.RLock()
 	defer t.RWMutex.RUnlock()
 	return t.State
 }
 
-func (t *Transaction) SetState(state TransactionState) {
+func (t *Transaction) SetState(state protocol.TransactionState) {
 	t.RWMutex.Lock()
 	t.State = state
+	if state == protocol.Prepare && t.Prepared.IsZero() {
+		t.Prepared = time.Now()
+	}
 	t.RWMutex.Unlock()
 }
 
+// GetTimes returns when the transaction began and started to prepare, which
+// is zero if it has not.
+func (t *Transaction) GetTimes() (time.Time, time.Time) {
+	t.RWMutex.RLock()
+	defer t.RWMutex.RUnlock()
+	return t.Began, t.Prepared
+}
+
+// Finish marks that the coordinator has told the client how the transaction
+// ended, so it is no longer in flight. It returns false if that already
+// happened.
+func (t *Transaction) Finish() bool {
+	t.RWMutex.Lock()
+	defer t.RWMutex.Unlock()
+	if t.Finished {
+		return false
+	}
+	t.Finished = true
+	inFlight.Add(-1)
+	return true
+}
+
+// StartCommand starts the span of a client command, which ends when the
+// client is answered.
+func (t *Transaction) StartCommand(request protocol.Request) {
+	t.RWMutex.Lock()
+	defer t.RWMutex.Unlock()
+	t.Command.Finish()
+	t.Command = StartSpan("command", spanKindServer, t.Span.Context(), "bank.txn", t.Id, "bank.operation", request.Operation.String(), "bank.account", request.Branch+"."+request.Account)
+}
+
+// EndCommand ends the span of the command being answered with status.
+func (t *Transaction) EndCommand(status protocol.Status) {
+	t.RWMutex.Lock()
+	defer t.RWMutex.Unlock()
+	if t.Command == nil {
+		return
+	}
+	t.Command.Set("bank.status", status.String())
+	if status != protocol.StatusOK && status != protocol.StatusCommitOK {
+		t.Command.Fail()
+	}
+	t.Command.Finish()
+}
+
+// StartPhase ends the current phase's span and starts one for phase, under
+// the COMMIT that began it.
+func (t *Transaction) StartPhase(phase string) {
+	t.RWMutex.Lock()
+	defer t.RWMutex.Unlock()
+	parent := t.Span.Context()
+	if t.Command != nil {
+		parent = t.Command.Context()
+	}
+	t.Phase.Finish()
+	t.Phase = StartSpan(phase, spanKindInternal, parent, "bank.txn", t.Id)
+}
+
+// TraceContext is what packets sent for the transaction carry: the
+// innermost of its phase, command and own span.
+func (t *Transaction) TraceContext() protocol.TraceContext {
+	t.RWMutex.RLock()
+	defer t.RWMutex.RUnlock()
+	for _, span := range []*Span{t.Phase, t.Command, t.Span} {
+		if span != nil {
+			return span.Context()
+		}
+	}
+	return protocol.TraceContext{}
+}
+
+// EndTrace ends the transaction's spans with outcome, which is "committed"
+// or why it aborted.
+func (t *Transaction) EndTrace(outcome string) {
+	t.RWMutex.Lock()
+	defer t.RWMutex.Unlock()
+	t.Span.Set("bank.outcome", outcome)
+	for _, span := range []*Span{t.Phase, t.Command, t.Span} {
+		if outcome != "committed" {
+			span.Fail()
+		}
+		span.Finish()
+	}
+}
+
+// IsActive reports whether the client may still issue operations.
+func (t *Transaction) IsActive() bool {
+	t.RWMutex.RLock()
+	defer t.RWMutex.RUnlock()
+	return !t.Finished && t.State == protocol.Open
+}
+
+func (t *Transaction) StartScan(participants int) {
+	t.RWMutex.Lock()
+	t.ScanPending = participants
+	t.ScanResults = make([]protocol.Balance, 0)
+	t.RWMutex.Unlock()
+}
+
+// AddScanResult records one participant's reply to a wildcard BALANCE. It
+// reports whether a scan was in progress and, once every participant has
+// replied, returns the collected results.
+func (t *Transaction) AddScanResult(balances []protocol.Balance) (bool, []protocol.Balance) {
+	t.RWMutex.Lock()
+	defer t.RWMutex.Unlock()
+	if t.ScanPending == 0 {
+		return false, nil
+	}
+	t.ScanResults = append(t.ScanResults, balances...)
+	t.ScanPending--
+	if t.ScanPending > 0 {
+		return true, nil
+	}
+	return true, t.ScanResults
+}
+
+// AddParticipant records that the coordinator sent a command to branch.
+func (t *Transaction) AddParticipant(branch string) {
+	t.RWMutex.Lock()
+	t.Participants[branch] = true
+	t.RWMutex.Unlock()
+}
+
+func (t *Transaction) HasParticipant(branch string) bool {
+	t.RWMutex.RLock()
+	defer t.RWMutex.RUnlock()
+	return t.Participants[branch]
+}
+
 func (t *Transaction) AddResponse(id string) {
 	t.RWMutex.Lock()
 	t.Responses[id] = true
@@ -386,3 +794,38 @@ func (t *Transaction) NumResponses() int {
 	defer t.RWMutex.RUnlock()
 	return len(t.Responses)
 }
+
+type Snapshot struct {
+	Id            string
+	SessionId     string
+	TransactionId string
+	Pending       int
+	Results       map[string]protocol.Response
+	Mutex         sync.Mutex
+}
+
+func (s *Snapshot) Init(id string, sessionId string, transactionId string, participants int) {
+	s.Mutex.Lock()
+	s.Id = id
+	s.SessionId = sessionId
+	s.TransactionId = transactionId
+	s.Pending = participants
+	s.Results = make(map[string]protocol.Response)
+	s.Mutex.Unlock()
+}
+
+// AddResult records a branch's part of the snapshot and returns every part
+// once all participants have replied.
+func (s *Snapshot) AddResult(branch string, result protocol.Response) map[string]protocol.Response {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	if _, ok := s.Results[branch]; ok {
+		return nil
+	}
+	s.Results[branch] = result
+	s.Pending--
+	if s.Pending > 0 {
+		return nil
+	}
+	return s.Results
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"bank/protocol"
+)
+
+// committedAccount returns an account to which each of writes was written and
+// committed in turn.
+func committedAccount(t *testing.T, writes ...TenativeWrite) *Account {
+	account := &Account{}
+	account.Init("x")
+	for _, write := range writes {
+		if err := account.Write(write.Value, write.Timestamp); err != nil {
+			t.Fatalf("Write at %s: %v", write.Timestamp, err)
+		}
+		if err := account.Commit(write.Timestamp); err != nil {
+			t.Fatalf("Commit at %s: %v", write.Timestamp, err)
+		}
+	}
+	return account
+}
+
+// errorText is err's message, or an empty string for no error.
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestReadAsOf(t *testing.T) {
+	account := committedAccount(t, TenativeWrite{Timestamp: "10:A", Value: 10}, TenativeWrite{Timestamp: "20:B", Value: 25})
+	if err := account.Write(7, "30:A"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		timestamp string
+		value     int
+		err       string
+	}{
+		{"5:A", 0, "Not Found"},
+		{"10:A", 10, ""},
+		{"15:C", 10, ""},
+		{"20:A", 10, ""},
+		{"20:B", 25, ""},
+		{"29:Z", 25, ""},
+		{"30:A", 0, "Not Stable"},
+		{"40:A", 0, "Not Stable"},
+	}
+	for _, test := range tests {
+		value, err := account.ReadAsOf(test.timestamp)
+		if value != test.value || errorText(err) != test.err {
+			t.Errorf("ReadAsOf(%s) = %d, %v; want %d, %q", test.timestamp, value, err, test.value, test.err)
+		}
+	}
+
+	account.Abort("30:A")
+	if value, err := account.ReadAsOf("40:A"); value != 25 || err != nil {
+		t.Errorf("ReadAsOf(40:A) after the abort = %d, %v; want 25", value, err)
+	}
+}
+
+func TestReadAsOfTrimmed(t *testing.T) {
+	writes := make([]TenativeWrite, 0, maxRetainedVersions+1)
+	for i := 1; i <= maxRetainedVersions+1; i++ {
+		writes = append(writes, TenativeWrite{Timestamp: fmt.Sprintf("%d:A", 10*i), Value: i})
+	}
+	account := committedAccount(t, writes...)
+	if value, err := account.ReadAsOf("15:A"); errorText(err) != "Not Retained" {
+		t.Errorf("ReadAsOf(15:A) = %d, %v; want Not Retained", value, err)
+	}
+	if value, err := account.ReadAsOf("25:A"); value != 2 || err != nil {
+		t.Errorf("ReadAsOf(25:A) = %d, %v; want 2", value, err)
+	}
+}
+
+func TestReadNoWait(t *testing.T) {
+	concurrency = "no-wait"
+	defer func() { concurrency = "wait" }()
+	account := committedAccount(t, TenativeWrite{Timestamp: "10:A", Value: 10})
+	if err := account.Write(15, "20:B"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := account.Read("30:A"); errorText(err) != "Abort: READ_BLOCKED account=x conflict=20:B" {
+		t.Errorf("Read(30:A) past a tentative write = %d, %v; want READ_BLOCKED", value, err)
+	}
+	if value, err := account.Read("20:B"); value != 15 || err != nil {
+		t.Errorf("Read(20:B) of its own write = %d, %v; want 15", value, err)
+	}
+}
+
+func TestAbortReasons(t *testing.T) {
+	account := committedAccount(t, TenativeWrite{Timestamp: "10:A", Value: 10})
+	if _, err := account.Read("30:A"); err != nil {
+		t.Fatal(err)
+	}
+	if err := account.Write(-5, "40:B"); err != nil {
+		t.Fatal(err)
+	}
+	reason := func(err error) protocol.AbortReason {
+		if abort, ok := err.(*AbortError); ok {
+			return abort.Reason
+		}
+		t.Errorf("%v is not an abort", err)
+		return protocol.AbortReason{}
+	}
+	if got, want := reason(account.Write(3, "20:C")), (protocol.AbortReason{Code: protocol.AbortWriteTooLate, Account: "x", Conflict: "30:A"}); got != want {
+		t.Errorf("write behind a later read aborted for %v, want %v", got, want)
+	}
+	if got, want := reason(account.Write(3, "5:C")), (protocol.AbortReason{Code: protocol.AbortWriteTooLate, Account: "x", Conflict: "30:A"}); got != want {
+		t.Errorf("write behind a later commit and read aborted for %v, want %v", got, want)
+	}
+	account.Commit("30:A")
+	if got, want := reason(account.Write(3, "25:C")), (protocol.AbortReason{Code: protocol.AbortWriteTooLate, Account: "x", Conflict: "30:A"}); got != want {
+		t.Errorf("write behind a later commit aborted for %v, want %v", got, want)
+	}
+	_, err := account.Read("25:C")
+	if got, want := reason(err), (protocol.AbortReason{Code: protocol.AbortReadTooLate, Account: "x", Conflict: "30:A"}); got != want {
+		t.Errorf("read behind a later commit aborted for %v, want %v", got, want)
+	}
+	if got, want := reason(account.Commit("40:B")), (protocol.AbortReason{Code: protocol.AbortNegativeBalance, Account: "x"}); got != want {
+		t.Errorf("negative commit aborted for %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,425 @@
+// Package config reads the description of a cluster that branches and
+// clients start from. It is a JSON file, or the older format of one line per
+// branch, "id host port option=value...", and "* option=value..." lines for
+// the cluster, which is read into the same Config.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Codecs are the codecs a branch can serve on extra listeners, besides gob
+// on its advertised port.
+var Codecs = []string{"json", "text"}
+
+type Config struct {
+	Cluster   string `json:"cluster,omitempty"`
+	Transport string `json:"transport,omitempty"`
+	Discovery string `json:"discovery,omitempty"`
+	// Concurrency is "wait", where a read waits for an earlier transaction's
+	// tentative write to commit or abort, or "no-wait", where it aborts.
+	Concurrency string `json:"concurrency,omitempty"`
+	DataDir     string `json:"dataDir,omitempty"`
+	// Trace is the file, in each branch's data directory unless absolute,
+	// that spans are appended to. Tracing is off without one.
+	Trace    string   `json:"trace,omitempty"`
+	Timeouts Timeouts `json:"timeouts,omitempty"`
+	TLS      TLS      `json:"tls,omitempty"`
+	Tokens   string   `json:"tokens,omitempty"`
+	ACL      string   `json:"acl,omitempty"`
+	Branches []Branch `json:"branches"`
+}
+
+// Timeouts are durations such as "500ms". Those left empty keep the
+// branch's defaults.
+type Timeouts struct {
+	Heartbeat string `json:"heartbeat,omitempty"`
+	Suspect   string `json:"suspect,omitempty"`
+	Dead      string `json:"dead,omitempty"`
+}
+
+// TLS turns on mutual TLS when CA is set. Each node presents
+// Certs/<id>.crt and Certs/<id>.key unless its branch names a cert and key.
+type TLS struct {
+	CA    string `json:"ca,omitempty"`
+	Certs string `json:"certs,omitempty"`
+}
+
+type Branch struct {
+	Id string `json:"id"`
+	// Advertise is the host:port other branches and clients dial.
+	Advertise string `json:"advertise"`
+	// Listen is the address the branch listens on, by default every
+	// interface at the advertised port.
+	Listen string `json:"listen,omitempty"`
+	// Listeners maps a codec to the address of an extra listener for it.
+	Listeners map[string]string `json:"listeners,omitempty"`
+	// HTTP is the address of the HTTP gateway, if the branch runs one.
+	HTTP string `json:"http,omitempty"`
+	// Metrics is the address serving /metrics, if the branch exports them.
+	Metrics string `json:"metrics,omitempty"`
+	// Admin is the address serving the read-only /admin views, if the
+	// branch offers them. They show balances and client ids, so callers
+	// authenticate as for the HTTP gateway.
+	Admin   string `json:"admin,omitempty"`
+	DataDir string `json:"dataDir,omitempty"`
+	Cert    string `json:"cert,omitempty"`
+	Key     string `json:"key,omitempty"`
+}
+
+// Host and Port split the advertised address.
+func (b Branch) Host() string {
+	host, _, _ := net.SplitHostPort(b.Advertise)
+	return host
+}
+
+func (b Branch) Port() string {
+	_, port, _ := net.SplitHostPort(b.Advertise)
+	return port
+}
+
+func (b Branch) ListenAddress() string {
+	if b.Listen != "" {
+		return b.Listen
+	}
+	return ":" + b.Port()
+}
+
+// ListenerAddress returns where clients reach the branch's listener for
+// codec: the advertised host at the listener's port.
+func (b Branch) ListenerAddress(codec string) (string, bool) {
+	if codec == "gob" {
+		return b.Advertise, true
+	}
+	address, ok := b.Listeners[codec]
+	if !ok {
+		return "", false
+	}
+	_, port, _ := net.SplitHostPort(address)
+	return net.JoinHostPort(b.Host(), port), true
+}
+
+func (c *Config) Branch(id string) (Branch, bool) {
+	for _, branch := range c.Branches {
+		if branch.Id == id {
+			return branch, true
+		}
+	}
+	return Branch{}, false
+}
+
+// BranchDataDir is where branch id keeps its files.
+func (c *Config) BranchDataDir(id string) string {
+	if branch, ok := c.Branch(id); ok && branch.DataDir != "" {
+		return branch.DataDir
+	}
+	return c.DataDir
+}
+
+// FieldError is a problem with one field of the file, named by its path in
+// the JSON form, or with one line of the older format.
+type FieldError struct {
+	File    string
+	Line    int
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	location := e.File
+	if e.Line > 0 {
+		location += ":" + strconv.Itoa(e.Line)
+	}
+	if e.Field != "" {
+		location += ": " + e.Field
+	}
+	return location + ": " + e.Message
+}
+
+// Load reads and validates the configuration in filename.
+func Load(filename string) (*Config, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config *Config
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		config, err = parseJSON(filename, content)
+	} else {
+		config, err = parseLines(filename, string(content))
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.SetDefaults()
+	if err := config.Validate(filename); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func parseJSON(filename string, content []byte) (*Config, error) {
+	config := &Config{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxError):
+		line := 1 + bytes.Count(content[:syntaxError.Offset], []byte("\n"))
+		return nil, &FieldError{File: filename, Line: line, Message: syntaxError.Error()}
+	case errors.As(err, &typeError):
+		return nil, &FieldError{File: filename, Field: fieldPath(typeError.Field), Message: fmt.Sprintf("expected %s, not %s", typeError.Type, typeError.Value)}
+	case err != nil:
+		return nil, &FieldError{File: filename, Message: strings.TrimPrefix(err.Error(), "json: ")}
+	}
+	return config, nil
+}
+
+// fieldPath writes the decoder's path to a field, such as branches.0.id, as
+// Validate does: branches[0].id.
+func fieldPath(path string) string {
+	parts := strings.Split(path, ".")
+	field := ""
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil {
+			field += "[" + part + "]"
+		} else if field == "" {
+			field = part
+		} else {
+			field += "." + part
+		}
+	}
+	return field
+}
+
+// parseLines reads the older format. Blank lines and anything after # are
+// ignored.
+func parseLines(filename string, content string) (*Config, error) {
+	config := &Config{}
+	for number, line := range strings.Split(content, "\n") {
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		fail := func(format string, args ...interface{}) error {
+			return &FieldError{File: filename, Line: number + 1, Message: fmt.Sprintf(format, args...)}
+		}
+		if fields[0] == "*" {
+			for _, option := range fields[1:] {
+				key, value, ok := strings.Cut(option, "=")
+				if !ok {
+					return nil, fail("option %q should be key=value", option)
+				}
+				target, ok := config.clusterOption(key)
+				if !ok {
+					return nil, fail("unknown option %q", key)
+				}
+				*target = value
+			}
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fail("expected id, host and port")
+		}
+		branch := Branch{Id: fields[0], Advertise: net.JoinHostPort(fields[1], fields[2])}
+		for _, option := range fields[3:] {
+			key, value, ok := strings.Cut(option, "=")
+			if !ok {
+				return nil, fail("option %q should be key=value", option)
+			}
+			switch key {
+			case "http":
+				branch.HTTP = ":" + value
+			case "metrics":
+				branch.Metrics = ":" + value
+			case "admin":
+				branch.Admin = ":" + value
+			case "cert":
+				branch.Cert = value
+			case "key":
+				branch.Key = value
+			default:
+				if branch.Listeners == nil {
+					branch.Listeners = make(map[string]string)
+				}
+				branch.Listeners[key] = ":" + value
+			}
+		}
+		config.Branches = append(config.Branches, branch)
+	}
+	return config, nil
+}
+
+func (c *Config) clusterOption(key string) (*string, bool) {
+	targets := map[string]*string{
+		"cluster":     &c.Cluster,
+		"transport":   &c.Transport,
+		"discovery":   &c.Discovery,
+		"concurrency": &c.Concurrency,
+		"data":        &c.DataDir,
+		"trace":       &c.Trace,
+		"heartbeat":   &c.Timeouts.Heartbeat,
+		"suspect":     &c.Timeouts.Suspect,
+		"dead":        &c.Timeouts.Dead,
+		"ca":          &c.TLS.CA,
+		"certs":       &c.TLS.Certs,
+		"tokens":      &c.Tokens,
+		"acl":         &c.ACL,
+	}
+	target, ok := targets[key]
+	return target, ok
+}
+
+// SetDefaults fills in the settings that were left out.
+func (c *Config) SetDefaults() {
+	defaults := []struct {
+		field *string
+		value string
+	}{
+		{&c.Cluster, "default"},
+		{&c.Transport, "socket"},
+		{&c.Discovery, "static"},
+		{&c.Concurrency, "wait"},
+		{&c.DataDir, "."},
+		{&c.TLS.Certs, "certs"},
+	}
+	for _, d := range defaults {
+		if *d.field == "" {
+			*d.field = d.value
+		}
+	}
+}
+
+// Validate returns every problem with the configuration, each naming the
+// field it is in.
+func (c *Config) Validate(filename string) error {
+	problems := make([]error, 0)
+	fail := func(field string, format string, args ...interface{}) {
+		problems = append(problems, &FieldError{File: filename, Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	oneOf := func(field string, value string, allowed ...string) {
+		if !slices.Contains(allowed, value) {
+			fail(field, "%q should be one of %s", value, strings.Join(allowed, ", "))
+		}
+	}
+	oneOf("transport", c.Transport, "socket", "grpc")
+	oneOf("discovery", c.Discovery, "static", "gossip")
+	oneOf("concurrency", c.Concurrency, "wait", "no-wait")
+
+	durations := make(map[string]time.Duration)
+	for _, timeout := range []struct {
+		field string
+		value string
+	}{{"timeouts.heartbeat", c.Timeouts.Heartbeat}, {"timeouts.suspect", c.Timeouts.Suspect}, {"timeouts.dead", c.Timeouts.Dead}} {
+		if timeout.value == "" {
+			continue
+		}
+		duration, err := ParseDuration(timeout.value)
+		if err != nil {
+			fail(timeout.field, "%v", err)
+			continue
+		}
+		durations[timeout.field] = duration
+	}
+	heartbeat, suspect, dead := durations["timeouts.heartbeat"], durations["timeouts.suspect"], durations["timeouts.dead"]
+	if heartbeat > 0 && suspect > 0 && suspect <= heartbeat {
+		fail("timeouts.suspect", "should be longer than timeouts.heartbeat")
+	}
+	if suspect > 0 && dead > 0 && dead < suspect {
+		fail("timeouts.dead", "should not be shorter than timeouts.suspect")
+	}
+
+	if len(c.Branches) == 0 {
+		fail("branches", "at least one branch is required")
+	}
+	seen := make(map[string]bool)
+	for i, branch := range c.Branches {
+		field := fmt.Sprintf("branches[%d]", i)
+		switch {
+		case branch.Id == "":
+			fail(field+".id", "is required")
+		case strings.ContainsAny(branch.Id, "*.: \t"):
+			fail(field+".id", "%q may not contain '*', '.', ':' or spaces", branch.Id)
+		case seen[branch.Id]:
+			fail(field+".id", "%q is used by another branch", branch.Id)
+		}
+		seen[branch.Id] = true
+		if err := checkAddress(branch.Advertise, true); err != nil {
+			fail(field+".advertise", "%v", err)
+		}
+		if err := checkAddress(branch.Listen, false); branch.Listen != "" && err != nil {
+			fail(field+".listen", "%v", err)
+		}
+		if err := checkAddress(branch.HTTP, false); branch.HTTP != "" && err != nil {
+			fail(field+".http", "%v", err)
+		}
+		if err := checkAddress(branch.Metrics, false); branch.Metrics != "" && err != nil {
+			fail(field+".metrics", "%v", err)
+		}
+		if err := checkAddress(branch.Admin, false); branch.Admin != "" && err != nil {
+			fail(field+".admin", "%v", err)
+		}
+		codecs := make([]string, 0, len(branch.Listeners))
+		for codec := range branch.Listeners {
+			codecs = append(codecs, codec)
+		}
+		sort.Strings(codecs)
+		for _, codec := range codecs {
+			if !slices.Contains(Codecs, codec) {
+				fail(field+".listeners."+codec, "unknown codec, expected one of %s", strings.Join(Codecs, ", "))
+			} else if err := checkAddress(branch.Listeners[codec], false); err != nil {
+				fail(field+".listeners."+codec, "%v", err)
+			}
+		}
+		if (branch.Cert != "") != (branch.Key != "") {
+			fail(field+".key", "cert and key must be given together")
+		}
+		if branch.Cert != "" && c.TLS.CA == "" {
+			fail(field+".cert", "has no effect without tls.ca")
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// ParseDuration reads a timeout, which must be positive.
+func ParseDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a duration such as 500ms or 3s", value)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("%q should be positive", value)
+	}
+	return duration, nil
+}
+
+// checkAddress returns why address is not host:port, or nil. The host may be
+// left out unless hostRequired.
+func checkAddress(address string, hostRequired bool) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%q should be host:port", address)
+	}
+	if hostRequired && host == "" {
+		return fmt.Errorf("%q has no host", address)
+	}
+	if number, err := strconv.Atoi(port); err != nil || number < 0 || number > 65535 {
+		return fmt.Errorf("%q has an invalid port", address)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name string, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadLines(t *testing.T) {
+	content := "# test cluster\n* cluster=test heartbeat=500ms\nA 127.0.0.1 1234 json=1244 http=8080 metrics=9100 admin=9101\nB 10.0.0.2 1234 cert=b.crt key=b.key\n\n"
+	config, err := Load(writeConfig(t, "configuration.txt", content))
+	if err == nil {
+		t.Fatal("cert without a CA was accepted")
+	}
+	if !strings.Contains(err.Error(), "branches[1].cert") {
+		t.Errorf("error %q does not name branches[1].cert", err)
+	}
+
+	content = strings.Replace(content, "heartbeat=500ms", "heartbeat=500ms ca=ca.crt", 1)
+	config, err = Load(writeConfig(t, "configuration.txt", content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{
+		Cluster:     "test",
+		Transport:   "socket",
+		Discovery:   "static",
+		Concurrency: "wait",
+		DataDir:     ".",
+		Timeouts:    Timeouts{Heartbeat: "500ms"},
+		TLS:         TLS{CA: "ca.crt", Certs: "certs"},
+		Branches: []Branch{
+			{Id: "A", Advertise: "127.0.0.1:1234", Listeners: map[string]string{"json": ":1244"}, HTTP: ":8080", Metrics: ":9100", Admin: ":9101"},
+			{Id: "B", Advertise: "10.0.0.2:1234", Cert: "b.crt", Key: "b.key"},
+		},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("Load = %+v, want %+v", config, want)
+	}
+	if address, _ := config.Branches[0].ListenerAddress("json"); address != "127.0.0.1:1244" {
+		t.Errorf("json listener address = %q", address)
+	}
+	if address := config.Branches[1].ListenAddress(); address != ":1234" {
+		t.Errorf("listen address = %q", address)
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	content := `{
+  "cluster": "test",
+  "concurrency": "no-wait",
+  "dataDir": "data",
+  "timeouts": {"suspect": "2s", "dead": "5s"},
+  "branches": [
+    {"id": "A", "advertise": "a.example:7401", "listen": "0.0.0.0:7401", "dataDir": "data/a"},
+    {"id": "B", "advertise": "b.example:7401", "listeners": {"text": ":7411"}}
+  ]
+}`
+	config, err := Load(writeConfig(t, "cluster.json", content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Concurrency != "no-wait" || config.Transport != "socket" {
+		t.Errorf("settings = %+v", config)
+	}
+	if dir := config.BranchDataDir("A"); dir != "data/a" {
+		t.Errorf("data directory of A = %q", dir)
+	}
+	if dir := config.BranchDataDir("B"); dir != "data" {
+		t.Errorf("data directory of B = %q", dir)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		errors  []string
+	}{
+		{"configuration.txt", "A 127.0.0.1\n", []string{"configuration.txt:1: expected id, host and port"}},
+		{"configuration.txt", "* color=blue\nA 127.0.0.1 1234", []string{`configuration.txt:1: unknown option "color"`}},
+		{"configuration.txt", "", []string{"branches: at least one branch is required"}},
+		{"configuration.txt", "A 127.0.0.1 1234 xml=1235\nA 127.0.0.1 1236", []string{
+			"branches[0].listeners.xml: unknown codec",
+			`branches[1].id: "A" is used by another branch`,
+		}},
+		{"cluster.json", "{\n  \"branches\": [\n    {\"id\": \"A\",}\n  ]\n}", []string{"cluster.json:3: "}},
+		{"cluster.json", `{"branches": [{"id": 1}]}`, []string{"branches[0].id: expected string"}},
+		{"cluster.json", `{"brunches": []}`, []string{`unknown field "brunches"`}},
+		{"cluster.json", `{"transport": "carrier-pigeon", "timeouts": {"heartbeat": "2s", "suspect": "1s", "dead": "soon"},
+			"branches": [{"id": "A.1", "advertise": ":7401"}, {"id": "B", "advertise": "b.example", "http": "8080"}]}`, []string{
+			`transport: "carrier-pigeon" should be one of socket, grpc`,
+			"timeouts.dead: \"soon\" is not a duration",
+			"timeouts.suspect: should be longer than timeouts.heartbeat",
+			"branches[0].id: \"A.1\" may not contain",
+			`branches[0].advertise: ":7401" has no host`,
+			`branches[1].advertise: "b.example" should be host:port`,
+			`branches[1].http: "8080" should be host:port`,
+		}},
+	}
+	for _, test := range tests {
+		_, err := Load(writeConfig(t, test.name, test.content))
+		if err == nil {
+			t.Errorf("%q loaded without error", test.content)
+			continue
+		}
+		for _, message := range test.errors {
+			if !strings.Contains(err.Error(), message) {
+				t.Errorf("error for %q is %q, want it to contain %q", test.content, err, message)
+			}
+		}
+	}
+}
+
+func TestOverride(t *testing.T) {
+	config, err := Load(writeConfig(t, "configuration.txt", "A 127.0.0.1 1234\nB 127.0.0.1 1235\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Override("B", Overrides{Listen: "0.0.0.0:7401", DataDir: "data/b", Concurrency: "no-wait"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address := config.Branches[1].ListenAddress(); address != "0.0.0.0:7401" {
+		t.Errorf("listen address of B = %q", address)
+	}
+	if address := config.Branches[0].ListenAddress(); address != ":1234" {
+		t.Errorf("listen address of A = %q", address)
+	}
+	if dir := config.BranchDataDir("B"); dir != "data/b" || config.Concurrency != "no-wait" {
+		t.Errorf("data directory = %q, concurrency = %q", dir, config.Concurrency)
+	}
+
+	err = config.Override("B", Overrides{Suspect: "soon"})
+	if err == nil || !strings.Contains(err.Error(), "flags and environment: timeouts.suspect") {
+		t.Errorf("error for a bad suspect timeout = %v", err)
+	}
+}
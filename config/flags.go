@@ -0,0 +1,62 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// String defines a string flag whose default comes from the environment
+// variable env when that is set, so a process supervisor can configure a
+// binary without a wrapper script. A flag on the command line still wins.
+func String(set *flag.FlagSet, name string, env string, value string, usage string) *string {
+	p := new(string)
+	StringVar(set, p, name, env, value, usage)
+	return p
+}
+
+// StringVar is String storing the value in p.
+func StringVar(set *flag.FlagSet, p *string, name string, env string, value string, usage string) {
+	if fromEnv, ok := os.LookupEnv(env); ok {
+		value = fromEnv
+	}
+	set.StringVar(p, name, value, fmt.Sprintf("%s (or $%s)", usage, env))
+}
+
+// Overrides replace settings from the file with those given by flags or the
+// environment. Empty ones leave the file's alone.
+type Overrides struct {
+	Listen      string
+	Metrics     string
+	Admin       string
+	DataDir     string
+	Concurrency string
+	Trace       string
+	Heartbeat   string
+	Suspect     string
+	Dead        string
+}
+
+// Override applies overrides for branch id, which must be in the
+// configuration, and validates the result.
+func (c *Config) Override(id string, overrides Overrides) error {
+	replace := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	replace(&c.Concurrency, overrides.Concurrency)
+	replace(&c.Trace, overrides.Trace)
+	replace(&c.Timeouts.Heartbeat, overrides.Heartbeat)
+	replace(&c.Timeouts.Suspect, overrides.Suspect)
+	replace(&c.Timeouts.Dead, overrides.Dead)
+	for i := range c.Branches {
+		if c.Branches[i].Id == id {
+			replace(&c.Branches[i].Listen, overrides.Listen)
+			replace(&c.Branches[i].Metrics, overrides.Metrics)
+			replace(&c.Branches[i].Admin, overrides.Admin)
+			replace(&c.Branches[i].DataDir, overrides.DataDir)
+		}
+	}
+	return c.Validate("flags and environment")
+}
@@ -0,0 +1,157 @@
+// Package logging sets up where branches and clients log, in what format and
+// how much. Each subsystem has its own logger and level, so that debugging
+// the commit protocol does not bring every account access with it. Output
+// from the standard log package is logged at the info level.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Network logs connections, handshakes, packets, failure detection and
+// membership; Concurrency logs timestamp ordering on accounts; Commit logs
+// transactions and two-phase commit. Setup replaces them, so they are looked
+// up when logging rather than kept.
+var (
+	Network     = slog.Default().With("subsystem", "network")
+	Concurrency = slog.Default().With("subsystem", "concurrency")
+	Commit      = slog.Default().With("subsystem", "commit")
+)
+
+var subsystems = map[string]**slog.Logger{
+	"network":     &Network,
+	"concurrency": &Concurrency,
+	"commit":      &Commit,
+}
+
+// output is where logs go, so Fatalf knows whether they reach stderr.
+var output io.Writer = os.Stderr
+
+var levels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// Options say how much to log, how and where.
+type Options struct {
+	// Level is the least severe level logged, optionally followed by
+	// levels for subsystems, as in "warn,commit=debug".
+	Level string
+	// Format is "text", which is logfmt, or "json".
+	Format string
+	// Destination is "stderr", "stdout", "off", or a file to append to.
+	Destination string
+}
+
+// Levels parses a level such as "warn,commit=debug" into the level for
+// everything and the levels for subsystems that differ from it.
+func Levels(level string) (slog.Level, map[string]slog.Level, error) {
+	overall := slog.LevelWarn
+	bySubsystem := make(map[string]slog.Level)
+	for _, part := range strings.Split(level, ",") {
+		name, value, isSubsystem := strings.Cut(strings.TrimSpace(part), "=")
+		if !isSubsystem {
+			name, value = "", name
+		}
+		parsed, ok := levels[strings.ToLower(value)]
+		if !ok {
+			return 0, nil, fmt.Errorf("log level %q should be debug, info, warn or error", value)
+		}
+		if !isSubsystem {
+			overall = parsed
+		} else if _, ok := subsystems[name]; ok {
+			bySubsystem[name] = parsed
+		} else {
+			return 0, nil, fmt.Errorf("unknown log subsystem %q, expected network, concurrency or commit", name)
+		}
+	}
+	return overall, bySubsystem, nil
+}
+
+// Setup logs as options say, adding attrs, such as the branch, to every
+// record.
+func Setup(options Options, attrs ...any) error {
+	var destination io.Writer
+	switch options.Destination {
+	case "stderr", "":
+		destination = os.Stderr
+	case "stdout":
+		destination = os.Stdout
+	case "off":
+		destination = io.Discard
+	default:
+		file, err := os.OpenFile(options.Destination, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		destination = file
+	}
+	if err := setup(destination, options, attrs...); err != nil {
+		return err
+	}
+	output = destination
+	return nil
+}
+
+func setup(destination io.Writer, options Options, attrs ...any) error {
+	overall, bySubsystem, err := Levels(options.Level)
+	if err != nil {
+		return err
+	}
+	switch options.Format {
+	case "text", "", "json":
+	default:
+		return fmt.Errorf("log format %q should be text or json", options.Format)
+	}
+	newHandler := func(level slog.Level) slog.Handler {
+		handlerOptions := &slog.HandlerOptions{Level: level}
+		if options.Format == "json" {
+			return slog.NewJSONHandler(destination, handlerOptions)
+		}
+		return slog.NewTextHandler(destination, handlerOptions)
+	}
+	slog.SetDefault(slog.New(newHandler(overall)).With(attrs...))
+	for name, logger := range subsystems {
+		level, ok := bySubsystem[name]
+		if !ok {
+			level = overall
+		}
+		*logger = slog.New(newHandler(level)).With(attrs...).With("subsystem", name)
+	}
+	return nil
+}
+
+// Txn, Account, Command and Peer are the fields records share, so that logs
+// can be searched by them.
+func Txn(id string) slog.Attr {
+	return slog.String("txn", id)
+}
+
+func Account(id string) slog.Attr {
+	return slog.String("account", id)
+}
+
+func Command(command fmt.Stringer) slog.Attr {
+	return slog.String("command", command.String())
+}
+
+func Peer(id string) slog.Attr {
+	return slog.String("peer", id)
+}
+
+// Fatalf logs a message at the error level, and to stderr if logs go
+// elsewhere, then exits.
+func Fatalf(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	slog.Error(message)
+	if output != os.Stderr {
+		fmt.Fprintln(os.Stderr, message)
+	}
+	os.Exit(1)
+}
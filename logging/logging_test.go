@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	overall, bySubsystem, err := Levels("info, commit=debug,network=ERROR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overall != slog.LevelInfo || len(bySubsystem) != 2 || bySubsystem["commit"] != slog.LevelDebug || bySubsystem["network"] != slog.LevelError {
+		t.Errorf("Levels = %v, %v", overall, bySubsystem)
+	}
+	for _, level := range []string{"loud", "storage=debug", "commit=chatty"} {
+		if _, _, err := Levels(level); err == nil {
+			t.Errorf("level %q was accepted", level)
+		}
+	}
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := setup(&buffer, Options{Level: "warn,commit=debug", Format: "json"}, "branch", "A"); err != nil {
+		t.Fatal(err)
+	}
+	Concurrency.Debug("Read waiting", Account("A.x"))
+	Commit.Debug("Aborting", Txn("1:A"), Account("A.x"))
+	Network.Warn("Branch suspected", Peer("B"))
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %q, want the commit and network records", lines)
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"level": "DEBUG", "msg": "Aborting", "branch": "A", "subsystem": "commit", "txn": "1:A", "account": "A.x"}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%s = %v, want %v", key, record[key], value)
+		}
+	}
+
+	if err := setup(&buffer, Options{Level: "info", Format: "xml"}); err == nil {
+		t.Error("format xml was accepted")
+	}
+}
@@ -0,0 +1,1711 @@
+// Service definition for the bank's client and inter-branch protocols. The
+// messages mirror the Packet, Request and Response structs in package protocol
+// field for field; enum values must stay in the same order as the Go
+// constants so packets can be converted without lookup tables.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: proto/bank.proto
+
+package bankpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type CommandType int32
+
+const (
+	CommandType_CLIENT_REQUEST       CommandType = 0
+	CommandType_COORDINATOR_RESPONSE CommandType = 1
+	CommandType_COORDINATOR_REQUEST  CommandType = 2
+	CommandType_COORDINATOR_PREPARE  CommandType = 3
+	CommandType_COORDINATOR_COMMIT   CommandType = 4
+	CommandType_COORDINATOR_ABORT    CommandType = 5
+	CommandType_PARTICIPANT_RESPONSE CommandType = 6
+	CommandType_PARTICIPANT_YES      CommandType = 7
+	CommandType_PARTICIPANT_ABORT    CommandType = 8
+	CommandType_COORDINATOR_SNAPSHOT CommandType = 9
+	CommandType_PARTICIPANT_SNAPSHOT CommandType = 10
+	CommandType_HANDSHAKE_REQUEST    CommandType = 11
+	CommandType_HANDSHAKE_RESPONSE   CommandType = 12
+	CommandType_HEARTBEAT            CommandType = 13
+	CommandType_MEMBERSHIP_UPDATE    CommandType = 14
+	CommandType_PING_REQUEST         CommandType = 15
+	CommandType_PING_ACK             CommandType = 16
+)
+
+// Enum value maps for CommandType.
+var (
+	CommandType_name = map[int32]string{
+		0:  "CLIENT_REQUEST",
+		1:  "COORDINATOR_RESPONSE",
+		2:  "COORDINATOR_REQUEST",
+		3:  "COORDINATOR_PREPARE",
+		4:  "COORDINATOR_COMMIT",
+		5:  "COORDINATOR_ABORT",
+		6:  "PARTICIPANT_RESPONSE",
+		7:  "PARTICIPANT_YES",
+		8:  "PARTICIPANT_ABORT",
+		9:  "COORDINATOR_SNAPSHOT",
+		10: "PARTICIPANT_SNAPSHOT",
+		11: "HANDSHAKE_REQUEST",
+		12: "HANDSHAKE_RESPONSE",
+		13: "HEARTBEAT",
+		14: "MEMBERSHIP_UPDATE",
+		15: "PING_REQUEST",
+		16: "PING_ACK",
+	}
+	CommandType_value = map[string]int32{
+		"CLIENT_REQUEST":       0,
+		"COORDINATOR_RESPONSE": 1,
+		"COORDINATOR_REQUEST":  2,
+		"COORDINATOR_PREPARE":  3,
+		"COORDINATOR_COMMIT":   4,
+		"COORDINATOR_ABORT":    5,
+		"PARTICIPANT_RESPONSE": 6,
+		"PARTICIPANT_YES":      7,
+		"PARTICIPANT_ABORT":    8,
+		"COORDINATOR_SNAPSHOT": 9,
+		"PARTICIPANT_SNAPSHOT": 10,
+		"HANDSHAKE_REQUEST":    11,
+		"HANDSHAKE_RESPONSE":   12,
+		"HEARTBEAT":            13,
+		"MEMBERSHIP_UPDATE":    14,
+		"PING_REQUEST":         15,
+		"PING_ACK":             16,
+	}
+)
+
+func (x CommandType) Enum() *CommandType {
+	p := new(CommandType)
+	*p = x
+	return p
+}
+
+func (x CommandType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (CommandType) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_bank_proto_enumTypes[0].Descriptor()
+}
+
+func (CommandType) Type() protoreflect.EnumType {
+	return &file_proto_bank_proto_enumTypes[0]
+}
+
+func (x CommandType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use CommandType.Descriptor instead.
+func (CommandType) EnumDescriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{0}
+}
+
+type Operation int32
+
+const (
+	Operation_NO_OPERATION Operation = 0
+	Operation_BEGIN        Operation = 1
+	Operation_DEPOSIT      Operation = 2
+	Operation_WITHDRAW     Operation = 3
+	Operation_BALANCE      Operation = 4
+	Operation_OPEN         Operation = 5
+	Operation_CLOSE        Operation = 6
+	Operation_HISTORY      Operation = 7
+	Operation_SNAPSHOT     Operation = 8
+	Operation_COMMIT       Operation = 9
+	Operation_ABORT        Operation = 10
+	Operation_JOIN         Operation = 11
+	Operation_LEAVE        Operation = 12
+)
+
+// Enum value maps for Operation.
+var (
+	Operation_name = map[int32]string{
+		0:  "NO_OPERATION",
+		1:  "BEGIN",
+		2:  "DEPOSIT",
+		3:  "WITHDRAW",
+		4:  "BALANCE",
+		5:  "OPEN",
+		6:  "CLOSE",
+		7:  "HISTORY",
+		8:  "SNAPSHOT",
+		9:  "COMMIT",
+		10: "ABORT",
+		11: "JOIN",
+		12: "LEAVE",
+	}
+	Operation_value = map[string]int32{
+		"NO_OPERATION": 0,
+		"BEGIN":        1,
+		"DEPOSIT":      2,
+		"WITHDRAW":     3,
+		"BALANCE":      4,
+		"OPEN":         5,
+		"CLOSE":        6,
+		"HISTORY":      7,
+		"SNAPSHOT":     8,
+		"COMMIT":       9,
+		"ABORT":        10,
+		"JOIN":         11,
+		"LEAVE":        12,
+	}
+)
+
+func (x Operation) Enum() *Operation {
+	p := new(Operation)
+	*p = x
+	return p
+}
+
+func (x Operation) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Operation) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_bank_proto_enumTypes[1].Descriptor()
+}
+
+func (Operation) Type() protoreflect.EnumType {
+	return &file_proto_bank_proto_enumTypes[1]
+}
+
+func (x Operation) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Operation.Descriptor instead.
+func (Operation) EnumDescriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{1}
+}
+
+type Status int32
+
+const (
+	Status_OK                Status = 0
+	Status_COMMIT_OK         Status = 1
+	Status_ABORTED           Status = 2
+	Status_NOT_FOUND         Status = 3
+	Status_ACCOUNT_EXISTS    Status = 4
+	Status_NONZERO_BALANCE   Status = 5
+	Status_NOT_RETAINED      Status = 6
+	Status_NOT_STABLE        Status = 7
+	Status_INVALID           Status = 8
+	Status_SNAPSHOT_FAILED   Status = 9
+	Status_VERSION_MISMATCH  Status = 10
+	Status_REFUSED           Status = 11
+	Status_PERMISSION_DENIED Status = 12
+)
+
+// Enum value maps for Status.
+var (
+	Status_name = map[int32]string{
+		0:  "OK",
+		1:  "COMMIT_OK",
+		2:  "ABORTED",
+		3:  "NOT_FOUND",
+		4:  "ACCOUNT_EXISTS",
+		5:  "NONZERO_BALANCE",
+		6:  "NOT_RETAINED",
+		7:  "NOT_STABLE",
+		8:  "INVALID",
+		9:  "SNAPSHOT_FAILED",
+		10: "VERSION_MISMATCH",
+		11: "REFUSED",
+		12: "PERMISSION_DENIED",
+	}
+	Status_value = map[string]int32{
+		"OK":                0,
+		"COMMIT_OK":         1,
+		"ABORTED":           2,
+		"NOT_FOUND":         3,
+		"ACCOUNT_EXISTS":    4,
+		"NONZERO_BALANCE":   5,
+		"NOT_RETAINED":      6,
+		"NOT_STABLE":        7,
+		"INVALID":           8,
+		"SNAPSHOT_FAILED":   9,
+		"VERSION_MISMATCH":  10,
+		"REFUSED":           11,
+		"PERMISSION_DENIED": 12,
+	}
+)
+
+func (x Status) Enum() *Status {
+	p := new(Status)
+	*p = x
+	return p
+}
+
+func (x Status) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Status) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_bank_proto_enumTypes[2].Descriptor()
+}
+
+func (Status) Type() protoreflect.EnumType {
+	return &file_proto_bank_proto_enumTypes[2]
+}
+
+func (x Status) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Status.Descriptor instead.
+func (Status) EnumDescriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{2}
+}
+
+type AbortCode int32
+
+const (
+	AbortCode_NO_ABORT_CODE         AbortCode = 0
+	AbortCode_READ_TOO_LATE         AbortCode = 1
+	AbortCode_WRITE_TOO_LATE        AbortCode = 2
+	AbortCode_READ_BLOCKED          AbortCode = 3
+	AbortCode_NEGATIVE_BALANCE      AbortCode = 4
+	AbortCode_PARTICIPANT_TIMEOUT   AbortCode = 5
+	AbortCode_CLIENT_ABORT          AbortCode = 6
+	AbortCode_PEER_FAILURE          AbortCode = 7
+	AbortCode_CLOSE_NONZERO_BALANCE AbortCode = 8
+)
+
+// Enum value maps for AbortCode.
+var (
+	AbortCode_name = map[int32]string{
+		0: "NO_ABORT_CODE",
+		1: "READ_TOO_LATE",
+		2: "WRITE_TOO_LATE",
+		3: "READ_BLOCKED",
+		4: "NEGATIVE_BALANCE",
+		5: "PARTICIPANT_TIMEOUT",
+		6: "CLIENT_ABORT",
+		7: "PEER_FAILURE",
+		8: "CLOSE_NONZERO_BALANCE",
+	}
+	AbortCode_value = map[string]int32{
+		"NO_ABORT_CODE":         0,
+		"READ_TOO_LATE":         1,
+		"WRITE_TOO_LATE":        2,
+		"READ_BLOCKED":          3,
+		"NEGATIVE_BALANCE":      4,
+		"PARTICIPANT_TIMEOUT":   5,
+		"CLIENT_ABORT":          6,
+		"PEER_FAILURE":          7,
+		"CLOSE_NONZERO_BALANCE": 8,
+	}
+)
+
+func (x AbortCode) Enum() *AbortCode {
+	p := new(AbortCode)
+	*p = x
+	return p
+}
+
+func (x AbortCode) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (AbortCode) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_bank_proto_enumTypes[3].Descriptor()
+}
+
+func (AbortCode) Type() protoreflect.EnumType {
+	return &file_proto_bank_proto_enumTypes[3]
+}
+
+func (x AbortCode) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use AbortCode.Descriptor instead.
+func (AbortCode) EnumDescriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{3}
+}
+
+type Role int32
+
+const (
+	Role_CLIENT Role = 0
+	Role_BRANCH Role = 1
+)
+
+// Enum value maps for Role.
+var (
+	Role_name = map[int32]string{
+		0: "CLIENT",
+		1: "BRANCH",
+	}
+	Role_value = map[string]int32{
+		"CLIENT": 0,
+		"BRANCH": 1,
+	}
+)
+
+func (x Role) Enum() *Role {
+	p := new(Role)
+	*p = x
+	return p
+}
+
+func (x Role) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Role) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_bank_proto_enumTypes[4].Descriptor()
+}
+
+func (Role) Type() protoreflect.EnumType {
+	return &file_proto_bank_proto_enumTypes[4]
+}
+
+func (x Role) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Role.Descriptor instead.
+func (Role) EnumDescriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{4}
+}
+
+type MemberState int32
+
+const (
+	MemberState_MEMBER_ALIVE   MemberState = 0
+	MemberState_MEMBER_SUSPECT MemberState = 1
+	MemberState_MEMBER_DEAD    MemberState = 2
+	MemberState_MEMBER_LEFT    MemberState = 3
+)
+
+// Enum value maps for MemberState.
+var (
+	MemberState_name = map[int32]string{
+		0: "MEMBER_ALIVE",
+		1: "MEMBER_SUSPECT",
+		2: "MEMBER_DEAD",
+		3: "MEMBER_LEFT",
+	}
+	MemberState_value = map[string]int32{
+		"MEMBER_ALIVE":   0,
+		"MEMBER_SUSPECT": 1,
+		"MEMBER_DEAD":    2,
+		"MEMBER_LEFT":    3,
+	}
+)
+
+func (x MemberState) Enum() *MemberState {
+	p := new(MemberState)
+	*p = x
+	return p
+}
+
+func (x MemberState) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (MemberState) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_bank_proto_enumTypes[5].Descriptor()
+}
+
+func (MemberState) Type() protoreflect.EnumType {
+	return &file_proto_bank_proto_enumTypes[5]
+}
+
+func (x MemberState) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use MemberState.Descriptor instead.
+func (MemberState) EnumDescriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{5}
+}
+
+type TransactionState int32
+
+const (
+	TransactionState_STATE_OPEN      TransactionState = 0
+	TransactionState_STATE_PREPARE   TransactionState = 1
+	TransactionState_STATE_COMMITTED TransactionState = 2
+	TransactionState_STATE_ABORTED   TransactionState = 3
+)
+
+// Enum value maps for TransactionState.
+var (
+	TransactionState_name = map[int32]string{
+		0: "STATE_OPEN",
+		1: "STATE_PREPARE",
+		2: "STATE_COMMITTED",
+		3: "STATE_ABORTED",
+	}
+	TransactionState_value = map[string]int32{
+		"STATE_OPEN":      0,
+		"STATE_PREPARE":   1,
+		"STATE_COMMITTED": 2,
+		"STATE_ABORTED":   3,
+	}
+)
+
+func (x TransactionState) Enum() *TransactionState {
+	p := new(TransactionState)
+	*p = x
+	return p
+}
+
+func (x TransactionState) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (TransactionState) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_bank_proto_enumTypes[6].Descriptor()
+}
+
+func (TransactionState) Type() protoreflect.EnumType {
+	return &file_proto_bank_proto_enumTypes[6]
+}
+
+func (x TransactionState) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use TransactionState.Descriptor instead.
+func (TransactionState) EnumDescriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{6}
+}
+
+type Handshake struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Version       int32                  `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Role          Role                   `protobuf:"varint,2,opt,name=role,proto3,enum=bank.Role" json:"role,omitempty"`
+	Id            string                 `protobuf:"bytes,3,opt,name=id,proto3" json:"id,omitempty"`
+	ClusterId     string                 `protobuf:"bytes,4,opt,name=cluster_id,json=clusterId,proto3" json:"cluster_id,omitempty"`
+	Features      []string               `protobuf:"bytes,5,rep,name=features,proto3" json:"features,omitempty"`
+	Token         string                 `protobuf:"bytes,6,opt,name=token,proto3" json:"token,omitempty"`
+	Address       string                 `protobuf:"bytes,7,opt,name=address,proto3" json:"address,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Handshake) Reset() {
+	*x = Handshake{}
+	mi := &file_proto_bank_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Handshake) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Handshake) ProtoMessage() {}
+
+func (x *Handshake) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Handshake.ProtoReflect.Descriptor instead.
+func (*Handshake) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Handshake) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Handshake) GetRole() Role {
+	if x != nil {
+		return x.Role
+	}
+	return Role_CLIENT
+}
+
+func (x *Handshake) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Handshake) GetClusterId() string {
+	if x != nil {
+		return x.ClusterId
+	}
+	return ""
+}
+
+func (x *Handshake) GetFeatures() []string {
+	if x != nil {
+		return x.Features
+	}
+	return nil
+}
+
+func (x *Handshake) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *Handshake) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+type Request struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Operation     Operation              `protobuf:"varint,1,opt,name=operation,proto3,enum=bank.Operation" json:"operation,omitempty"`
+	Branch        string                 `protobuf:"bytes,2,opt,name=branch,proto3" json:"branch,omitempty"`
+	Account       string                 `protobuf:"bytes,3,opt,name=account,proto3" json:"account,omitempty"`
+	Amount        int64                  `protobuf:"varint,4,opt,name=amount,proto3" json:"amount,omitempty"`
+	Limit         int32                  `protobuf:"varint,5,opt,name=limit,proto3" json:"limit,omitempty"`
+	AsOf          string                 `protobuf:"bytes,6,opt,name=as_of,json=asOf,proto3" json:"as_of,omitempty"`
+	Address       string                 `protobuf:"bytes,7,opt,name=address,proto3" json:"address,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Request) Reset() {
+	*x = Request{}
+	mi := &file_proto_bank_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Request) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Request) ProtoMessage() {}
+
+func (x *Request) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Request.ProtoReflect.Descriptor instead.
+func (*Request) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Request) GetOperation() Operation {
+	if x != nil {
+		return x.Operation
+	}
+	return Operation_NO_OPERATION
+}
+
+func (x *Request) GetBranch() string {
+	if x != nil {
+		return x.Branch
+	}
+	return ""
+}
+
+func (x *Request) GetAccount() string {
+	if x != nil {
+		return x.Account
+	}
+	return ""
+}
+
+func (x *Request) GetAmount() int64 {
+	if x != nil {
+		return x.Amount
+	}
+	return 0
+}
+
+func (x *Request) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *Request) GetAsOf() string {
+	if x != nil {
+		return x.AsOf
+	}
+	return ""
+}
+
+func (x *Request) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+type Balance struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Branch        string                 `protobuf:"bytes,1,opt,name=branch,proto3" json:"branch,omitempty"`
+	Account       string                 `protobuf:"bytes,2,opt,name=account,proto3" json:"account,omitempty"`
+	Value         int64                  `protobuf:"varint,3,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Balance) Reset() {
+	*x = Balance{}
+	mi := &file_proto_bank_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Balance) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Balance) ProtoMessage() {}
+
+func (x *Balance) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Balance.ProtoReflect.Descriptor instead.
+func (*Balance) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Balance) GetBranch() string {
+	if x != nil {
+		return x.Branch
+	}
+	return ""
+}
+
+func (x *Balance) GetAccount() string {
+	if x != nil {
+		return x.Account
+	}
+	return ""
+}
+
+func (x *Balance) GetValue() int64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+type HistoryEntry struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TransactionId string                 `protobuf:"bytes,1,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
+	Delta         int64                  `protobuf:"varint,2,opt,name=delta,proto3" json:"delta,omitempty"`
+	Balance       int64                  `protobuf:"varint,3,opt,name=balance,proto3" json:"balance,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HistoryEntry) Reset() {
+	*x = HistoryEntry{}
+	mi := &file_proto_bank_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HistoryEntry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HistoryEntry) ProtoMessage() {}
+
+func (x *HistoryEntry) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HistoryEntry.ProtoReflect.Descriptor instead.
+func (*HistoryEntry) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *HistoryEntry) GetTransactionId() string {
+	if x != nil {
+		return x.TransactionId
+	}
+	return ""
+}
+
+func (x *HistoryEntry) GetDelta() int64 {
+	if x != nil {
+		return x.Delta
+	}
+	return 0
+}
+
+func (x *HistoryEntry) GetBalance() int64 {
+	if x != nil {
+		return x.Balance
+	}
+	return 0
+}
+
+type TransactionStatus struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	State         TransactionState       `protobuf:"varint,2,opt,name=state,proto3,enum=bank.TransactionState" json:"state,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TransactionStatus) Reset() {
+	*x = TransactionStatus{}
+	mi := &file_proto_bank_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TransactionStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TransactionStatus) ProtoMessage() {}
+
+func (x *TransactionStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TransactionStatus.ProtoReflect.Descriptor instead.
+func (*TransactionStatus) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *TransactionStatus) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *TransactionStatus) GetState() TransactionState {
+	if x != nil {
+		return x.State
+	}
+	return TransactionState_STATE_OPEN
+}
+
+type Response struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        Status                 `protobuf:"varint,1,opt,name=status,proto3,enum=bank.Status" json:"status,omitempty"`
+	Balances      []*Balance             `protobuf:"bytes,2,rep,name=balances,proto3" json:"balances,omitempty"`
+	History       []*HistoryEntry        `protobuf:"bytes,3,rep,name=history,proto3" json:"history,omitempty"`
+	InFlight      []*TransactionStatus   `protobuf:"bytes,4,rep,name=in_flight,json=inFlight,proto3" json:"in_flight,omitempty"`
+	Snapshot      string                 `protobuf:"bytes,5,opt,name=snapshot,proto3" json:"snapshot,omitempty"`
+	Total         int64                  `protobuf:"varint,6,opt,name=total,proto3" json:"total,omitempty"`
+	Message       string                 `protobuf:"bytes,7,opt,name=message,proto3" json:"message,omitempty"`
+	Abort         *AbortReason           `protobuf:"bytes,8,opt,name=abort,proto3" json:"abort,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Response) Reset() {
+	*x = Response{}
+	mi := &file_proto_bank_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Response) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Response) ProtoMessage() {}
+
+func (x *Response) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Response.ProtoReflect.Descriptor instead.
+func (*Response) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Response) GetStatus() Status {
+	if x != nil {
+		return x.Status
+	}
+	return Status_OK
+}
+
+func (x *Response) GetBalances() []*Balance {
+	if x != nil {
+		return x.Balances
+	}
+	return nil
+}
+
+func (x *Response) GetHistory() []*HistoryEntry {
+	if x != nil {
+		return x.History
+	}
+	return nil
+}
+
+func (x *Response) GetInFlight() []*TransactionStatus {
+	if x != nil {
+		return x.InFlight
+	}
+	return nil
+}
+
+func (x *Response) GetSnapshot() string {
+	if x != nil {
+		return x.Snapshot
+	}
+	return ""
+}
+
+func (x *Response) GetTotal() int64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *Response) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *Response) GetAbort() *AbortReason {
+	if x != nil {
+		return x.Abort
+	}
+	return nil
+}
+
+type AbortReason struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Code          AbortCode              `protobuf:"varint,1,opt,name=code,proto3,enum=bank.AbortCode" json:"code,omitempty"`
+	Account       string                 `protobuf:"bytes,2,opt,name=account,proto3" json:"account,omitempty"`
+	Conflict      string                 `protobuf:"bytes,3,opt,name=conflict,proto3" json:"conflict,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AbortReason) Reset() {
+	*x = AbortReason{}
+	mi := &file_proto_bank_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AbortReason) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AbortReason) ProtoMessage() {}
+
+func (x *AbortReason) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AbortReason.ProtoReflect.Descriptor instead.
+func (*AbortReason) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *AbortReason) GetCode() AbortCode {
+	if x != nil {
+		return x.Code
+	}
+	return AbortCode_NO_ABORT_CODE
+}
+
+func (x *AbortReason) GetAccount() string {
+	if x != nil {
+		return x.Account
+	}
+	return ""
+}
+
+func (x *AbortReason) GetConflict() string {
+	if x != nil {
+		return x.Conflict
+	}
+	return ""
+}
+
+type Packet struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Version       int32                  `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	IsClient      bool                   `protobuf:"varint,2,opt,name=is_client,json=isClient,proto3" json:"is_client,omitempty"`
+	Id            string                 `protobuf:"bytes,3,opt,name=id,proto3" json:"id,omitempty"`
+	TransactionId string                 `protobuf:"bytes,4,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
+	CommandType   CommandType            `protobuf:"varint,5,opt,name=command_type,json=commandType,proto3,enum=bank.CommandType" json:"command_type,omitempty"`
+	Request       *Request               `protobuf:"bytes,6,opt,name=request,proto3" json:"request,omitempty"`
+	Response      *Response              `protobuf:"bytes,7,opt,name=response,proto3" json:"response,omitempty"`
+	Handshake     *Handshake             `protobuf:"bytes,8,opt,name=handshake,proto3" json:"handshake,omitempty"`
+	Membership    *Membership            `protobuf:"bytes,9,opt,name=membership,proto3" json:"membership,omitempty"`
+	Trace         *TraceContext          `protobuf:"bytes,10,opt,name=trace,proto3" json:"trace,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Packet) Reset() {
+	*x = Packet{}
+	mi := &file_proto_bank_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Packet) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Packet) ProtoMessage() {}
+
+func (x *Packet) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Packet.ProtoReflect.Descriptor instead.
+func (*Packet) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *Packet) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Packet) GetIsClient() bool {
+	if x != nil {
+		return x.IsClient
+	}
+	return false
+}
+
+func (x *Packet) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Packet) GetTransactionId() string {
+	if x != nil {
+		return x.TransactionId
+	}
+	return ""
+}
+
+func (x *Packet) GetCommandType() CommandType {
+	if x != nil {
+		return x.CommandType
+	}
+	return CommandType_CLIENT_REQUEST
+}
+
+func (x *Packet) GetRequest() *Request {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+func (x *Packet) GetResponse() *Response {
+	if x != nil {
+		return x.Response
+	}
+	return nil
+}
+
+func (x *Packet) GetHandshake() *Handshake {
+	if x != nil {
+		return x.Handshake
+	}
+	return nil
+}
+
+func (x *Packet) GetMembership() *Membership {
+	if x != nil {
+		return x.Membership
+	}
+	return nil
+}
+
+func (x *Packet) GetTrace() *TraceContext {
+	if x != nil {
+		return x.Trace
+	}
+	return nil
+}
+
+type TraceContext struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TraceId       string                 `protobuf:"bytes,1,opt,name=trace_id,json=traceId,proto3" json:"trace_id,omitempty"`
+	SpanId        string                 `protobuf:"bytes,2,opt,name=span_id,json=spanId,proto3" json:"span_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TraceContext) Reset() {
+	*x = TraceContext{}
+	mi := &file_proto_bank_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TraceContext) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TraceContext) ProtoMessage() {}
+
+func (x *TraceContext) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TraceContext.ProtoReflect.Descriptor instead.
+func (*TraceContext) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *TraceContext) GetTraceId() string {
+	if x != nil {
+		return x.TraceId
+	}
+	return ""
+}
+
+func (x *TraceContext) GetSpanId() string {
+	if x != nil {
+		return x.SpanId
+	}
+	return ""
+}
+
+type Member struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Address       string                 `protobuf:"bytes,2,opt,name=address,proto3" json:"address,omitempty"`
+	Port          string                 `protobuf:"bytes,3,opt,name=port,proto3" json:"port,omitempty"`
+	Incarnation   int32                  `protobuf:"varint,4,opt,name=incarnation,proto3" json:"incarnation,omitempty"`
+	State         MemberState            `protobuf:"varint,5,opt,name=state,proto3,enum=bank.MemberState" json:"state,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Member) Reset() {
+	*x = Member{}
+	mi := &file_proto_bank_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Member) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Member) ProtoMessage() {}
+
+func (x *Member) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Member.ProtoReflect.Descriptor instead.
+func (*Member) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *Member) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Member) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *Member) GetPort() string {
+	if x != nil {
+		return x.Port
+	}
+	return ""
+}
+
+func (x *Member) GetIncarnation() int32 {
+	if x != nil {
+		return x.Incarnation
+	}
+	return 0
+}
+
+func (x *Member) GetState() MemberState {
+	if x != nil {
+		return x.State
+	}
+	return MemberState_MEMBER_ALIVE
+}
+
+type Membership struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Branches      []*Member              `protobuf:"bytes,3,rep,name=branches,proto3" json:"branches,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Membership) Reset() {
+	*x = Membership{}
+	mi := &file_proto_bank_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Membership) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Membership) ProtoMessage() {}
+
+func (x *Membership) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Membership.ProtoReflect.Descriptor instead.
+func (*Membership) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *Membership) GetBranches() []*Member {
+	if x != nil {
+		return x.Branches
+	}
+	return nil
+}
+
+// Client calls carry the transaction id returned by Begin, and the client's
+// token when the branch requires one. A transaction is bound to the branch
+// that began it, which acts as its coordinator.
+type TransactionRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ClientId      string                 `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	TransactionId string                 `protobuf:"bytes,2,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
+	Request       *Request               `protobuf:"bytes,3,opt,name=request,proto3" json:"request,omitempty"`
+	Token         string                 `protobuf:"bytes,4,opt,name=token,proto3" json:"token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TransactionRequest) Reset() {
+	*x = TransactionRequest{}
+	mi := &file_proto_bank_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TransactionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TransactionRequest) ProtoMessage() {}
+
+func (x *TransactionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TransactionRequest.ProtoReflect.Descriptor instead.
+func (*TransactionRequest) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *TransactionRequest) GetClientId() string {
+	if x != nil {
+		return x.ClientId
+	}
+	return ""
+}
+
+func (x *TransactionRequest) GetTransactionId() string {
+	if x != nil {
+		return x.TransactionId
+	}
+	return ""
+}
+
+func (x *TransactionRequest) GetRequest() *Request {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+func (x *TransactionRequest) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+type TransactionResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TransactionId string                 `protobuf:"bytes,1,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
+	Response      *Response              `protobuf:"bytes,2,opt,name=response,proto3" json:"response,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TransactionResponse) Reset() {
+	*x = TransactionResponse{}
+	mi := &file_proto_bank_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TransactionResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TransactionResponse) ProtoMessage() {}
+
+func (x *TransactionResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bank_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TransactionResponse.ProtoReflect.Descriptor instead.
+func (*TransactionResponse) Descriptor() ([]byte, []int) {
+	return file_proto_bank_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *TransactionResponse) GetTransactionId() string {
+	if x != nil {
+		return x.TransactionId
+	}
+	return ""
+}
+
+func (x *TransactionResponse) GetResponse() *Response {
+	if x != nil {
+		return x.Response
+	}
+	return nil
+}
+
+var File_proto_bank_proto protoreflect.FileDescriptor
+
+const file_proto_bank_proto_rawDesc = "" +
+	"\n" +
+	"\x10proto/bank.proto\x12\x04bank\"\xc0\x01\n" +
+	"\tHandshake\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\x05R\aversion\x12\x1e\n" +
+	"\x04role\x18\x02 \x01(\x0e2\n" +
+	".bank.RoleR\x04role\x12\x0e\n" +
+	"\x02id\x18\x03 \x01(\tR\x02id\x12\x1d\n" +
+	"\n" +
+	"cluster_id\x18\x04 \x01(\tR\tclusterId\x12\x1a\n" +
+	"\bfeatures\x18\x05 \x03(\tR\bfeatures\x12\x14\n" +
+	"\x05token\x18\x06 \x01(\tR\x05token\x12\x18\n" +
+	"\aaddress\x18\a \x01(\tR\aaddress\"\xc7\x01\n" +
+	"\aRequest\x12-\n" +
+	"\toperation\x18\x01 \x01(\x0e2\x0f.bank.OperationR\toperation\x12\x16\n" +
+	"\x06branch\x18\x02 \x01(\tR\x06branch\x12\x18\n" +
+	"\aaccount\x18\x03 \x01(\tR\aaccount\x12\x16\n" +
+	"\x06amount\x18\x04 \x01(\x03R\x06amount\x12\x14\n" +
+	"\x05limit\x18\x05 \x01(\x05R\x05limit\x12\x13\n" +
+	"\x05as_of\x18\x06 \x01(\tR\x04asOf\x12\x18\n" +
+	"\aaddress\x18\a \x01(\tR\aaddress\"Q\n" +
+	"\aBalance\x12\x16\n" +
+	"\x06branch\x18\x01 \x01(\tR\x06branch\x12\x18\n" +
+	"\aaccount\x18\x02 \x01(\tR\aaccount\x12\x14\n" +
+	"\x05value\x18\x03 \x01(\x03R\x05value\"e\n" +
+	"\fHistoryEntry\x12%\n" +
+	"\x0etransaction_id\x18\x01 \x01(\tR\rtransactionId\x12\x14\n" +
+	"\x05delta\x18\x02 \x01(\x03R\x05delta\x12\x18\n" +
+	"\abalance\x18\x03 \x01(\x03R\abalance\"Q\n" +
+	"\x11TransactionStatus\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12,\n" +
+	"\x05state\x18\x02 \x01(\x0e2\x16.bank.TransactionStateR\x05state\"\xb4\x02\n" +
+	"\bResponse\x12$\n" +
+	"\x06status\x18\x01 \x01(\x0e2\f.bank.StatusR\x06status\x12)\n" +
+	"\bbalances\x18\x02 \x03(\v2\r.bank.BalanceR\bbalances\x12,\n" +
+	"\ahistory\x18\x03 \x03(\v2\x12.bank.HistoryEntryR\ahistory\x124\n" +
+	"\tin_flight\x18\x04 \x03(\v2\x17.bank.TransactionStatusR\binFlight\x12\x1a\n" +
+	"\bsnapshot\x18\x05 \x01(\tR\bsnapshot\x12\x14\n" +
+	"\x05total\x18\x06 \x01(\x03R\x05total\x12\x18\n" +
+	"\amessage\x18\a \x01(\tR\amessage\x12'\n" +
+	"\x05abort\x18\b \x01(\v2\x11.bank.AbortReasonR\x05abort\"h\n" +
+	"\vAbortReason\x12#\n" +
+	"\x04code\x18\x01 \x01(\x0e2\x0f.bank.AbortCodeR\x04code\x12\x18\n" +
+	"\aaccount\x18\x02 \x01(\tR\aaccount\x12\x1a\n" +
+	"\bconflict\x18\x03 \x01(\tR\bconflict\"\x8c\x03\n" +
+	"\x06Packet\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\x05R\aversion\x12\x1b\n" +
+	"\tis_client\x18\x02 \x01(\bR\bisClient\x12\x0e\n" +
+	"\x02id\x18\x03 \x01(\tR\x02id\x12%\n" +
+	"\x0etransaction_id\x18\x04 \x01(\tR\rtransactionId\x124\n" +
+	"\fcommand_type\x18\x05 \x01(\x0e2\x11.bank.CommandTypeR\vcommandType\x12'\n" +
+	"\arequest\x18\x06 \x01(\v2\r.bank.RequestR\arequest\x12*\n" +
+	"\bresponse\x18\a \x01(\v2\x0e.bank.ResponseR\bresponse\x12-\n" +
+	"\thandshake\x18\b \x01(\v2\x0f.bank.HandshakeR\thandshake\x120\n" +
+	"\n" +
+	"membership\x18\t \x01(\v2\x10.bank.MembershipR\n" +
+	"membership\x12(\n" +
+	"\x05trace\x18\n" +
+	" \x01(\v2\x12.bank.TraceContextR\x05trace\"B\n" +
+	"\fTraceContext\x12\x19\n" +
+	"\btrace_id\x18\x01 \x01(\tR\atraceId\x12\x17\n" +
+	"\aspan_id\x18\x02 \x01(\tR\x06spanId\"\x91\x01\n" +
+	"\x06Member\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x18\n" +
+	"\aaddress\x18\x02 \x01(\tR\aaddress\x12\x12\n" +
+	"\x04port\x18\x03 \x01(\tR\x04port\x12 \n" +
+	"\vincarnation\x18\x04 \x01(\x05R\vincarnation\x12'\n" +
+	"\x05state\x18\x05 \x01(\x0e2\x11.bank.MemberStateR\x05state\"B\n" +
+	"\n" +
+	"Membership\x12(\n" +
+	"\bbranches\x18\x03 \x03(\v2\f.bank.MemberR\bbranchesJ\x04\b\x01\x10\x02J\x04\b\x02\x10\x03\"\x97\x01\n" +
+	"\x12TransactionRequest\x12\x1b\n" +
+	"\tclient_id\x18\x01 \x01(\tR\bclientId\x12%\n" +
+	"\x0etransaction_id\x18\x02 \x01(\tR\rtransactionId\x12'\n" +
+	"\arequest\x18\x03 \x01(\v2\r.bank.RequestR\arequest\x12\x14\n" +
+	"\x05token\x18\x04 \x01(\tR\x05token\"h\n" +
+	"\x13TransactionResponse\x12%\n" +
+	"\x0etransaction_id\x18\x01 \x01(\tR\rtransactionId\x12*\n" +
+	"\bresponse\x18\x02 \x01(\v2\x0e.bank.ResponseR\bresponse*\x8b\x03\n" +
+	"\vCommandType\x12\x12\n" +
+	"\x0eCLIENT_REQUEST\x10\x00\x12\x18\n" +
+	"\x14COORDINATOR_RESPONSE\x10\x01\x12\x17\n" +
+	"\x13COORDINATOR_REQUEST\x10\x02\x12\x17\n" +
+	"\x13COORDINATOR_PREPARE\x10\x03\x12\x16\n" +
+	"\x12COORDINATOR_COMMIT\x10\x04\x12\x15\n" +
+	"\x11COORDINATOR_ABORT\x10\x05\x12\x18\n" +
+	"\x14PARTICIPANT_RESPONSE\x10\x06\x12\x13\n" +
+	"\x0fPARTICIPANT_YES\x10\a\x12\x15\n" +
+	"\x11PARTICIPANT_ABORT\x10\b\x12\x18\n" +
+	"\x14COORDINATOR_SNAPSHOT\x10\t\x12\x18\n" +
+	"\x14PARTICIPANT_SNAPSHOT\x10\n" +
+	"\x12\x15\n" +
+	"\x11HANDSHAKE_REQUEST\x10\v\x12\x16\n" +
+	"\x12HANDSHAKE_RESPONSE\x10\f\x12\r\n" +
+	"\tHEARTBEAT\x10\r\x12\x15\n" +
+	"\x11MEMBERSHIP_UPDATE\x10\x0e\x12\x10\n" +
+	"\fPING_REQUEST\x10\x0f\x12\f\n" +
+	"\bPING_ACK\x10\x10*\xac\x01\n" +
+	"\tOperation\x12\x10\n" +
+	"\fNO_OPERATION\x10\x00\x12\t\n" +
+	"\x05BEGIN\x10\x01\x12\v\n" +
+	"\aDEPOSIT\x10\x02\x12\f\n" +
+	"\bWITHDRAW\x10\x03\x12\v\n" +
+	"\aBALANCE\x10\x04\x12\b\n" +
+	"\x04OPEN\x10\x05\x12\t\n" +
+	"\x05CLOSE\x10\x06\x12\v\n" +
+	"\aHISTORY\x10\a\x12\f\n" +
+	"\bSNAPSHOT\x10\b\x12\n" +
+	"\n" +
+	"\x06COMMIT\x10\t\x12\t\n" +
+	"\x05ABORT\x10\n" +
+	"\x12\b\n" +
+	"\x04JOIN\x10\v\x12\t\n" +
+	"\x05LEAVE\x10\f*\xe2\x01\n" +
+	"\x06Status\x12\x06\n" +
+	"\x02OK\x10\x00\x12\r\n" +
+	"\tCOMMIT_OK\x10\x01\x12\v\n" +
+	"\aABORTED\x10\x02\x12\r\n" +
+	"\tNOT_FOUND\x10\x03\x12\x12\n" +
+	"\x0eACCOUNT_EXISTS\x10\x04\x12\x13\n" +
+	"\x0fNONZERO_BALANCE\x10\x05\x12\x10\n" +
+	"\fNOT_RETAINED\x10\x06\x12\x0e\n" +
+	"\n" +
+	"NOT_STABLE\x10\a\x12\v\n" +
+	"\aINVALID\x10\b\x12\x13\n" +
+	"\x0fSNAPSHOT_FAILED\x10\t\x12\x14\n" +
+	"\x10VERSION_MISMATCH\x10\n" +
+	"\x12\v\n" +
+	"\aREFUSED\x10\v\x12\x15\n" +
+	"\x11PERMISSION_DENIED\x10\f*\xc5\x01\n" +
+	"\tAbortCode\x12\x11\n" +
+	"\rNO_ABORT_CODE\x10\x00\x12\x11\n" +
+	"\rREAD_TOO_LATE\x10\x01\x12\x12\n" +
+	"\x0eWRITE_TOO_LATE\x10\x02\x12\x10\n" +
+	"\fREAD_BLOCKED\x10\x03\x12\x14\n" +
+	"\x10NEGATIVE_BALANCE\x10\x04\x12\x17\n" +
+	"\x13PARTICIPANT_TIMEOUT\x10\x05\x12\x10\n" +
+	"\fCLIENT_ABORT\x10\x06\x12\x10\n" +
+	"\fPEER_FAILURE\x10\a\x12\x19\n" +
+	"\x15CLOSE_NONZERO_BALANCE\x10\b*\x1e\n" +
+	"\x04Role\x12\n" +
+	"\n" +
+	"\x06CLIENT\x10\x00\x12\n" +
+	"\n" +
+	"\x06BRANCH\x10\x01*U\n" +
+	"\vMemberState\x12\x10\n" +
+	"\fMEMBER_ALIVE\x10\x00\x12\x12\n" +
+	"\x0eMEMBER_SUSPECT\x10\x01\x12\x0f\n" +
+	"\vMEMBER_DEAD\x10\x02\x12\x0f\n" +
+	"\vMEMBER_LEFT\x10\x03*]\n" +
+	"\x10TransactionState\x12\x0e\n" +
+	"\n" +
+	"STATE_OPEN\x10\x00\x12\x11\n" +
+	"\rSTATE_PREPARE\x10\x01\x12\x13\n" +
+	"\x0fSTATE_COMMITTED\x10\x02\x12\x11\n" +
+	"\rSTATE_ABORTED\x10\x032\xa8\x06\n" +
+	"\x04Bank\x12-\n" +
+	"\tHandshake\x12\x0f.bank.Handshake\x1a\x0f.bank.Handshake\x12<\n" +
+	"\x05Begin\x12\x18.bank.TransactionRequest\x1a\x19.bank.TransactionResponse\x12>\n" +
+	"\aDeposit\x12\x18.bank.TransactionRequest\x1a\x19.bank.TransactionResponse\x12?\n" +
+	"\bWithdraw\x12\x18.bank.TransactionRequest\x1a\x19.bank.TransactionResponse\x12>\n" +
+	"\aBalance\x12\x18.bank.TransactionRequest\x1a\x19.bank.TransactionResponse\x12;\n" +
+	"\x04Open\x12\x18.bank.TransactionRequest\x1a\x19.bank.TransactionResponse\x12<\n" +
+	"\x05Close\x12\x18.bank.TransactionRequest\x1a\x19.bank.TransactionResponse\x12>\n" +
+	"\aHistory\x12\x18.bank.TransactionRequest\x1a\x19.bank.TransactionResponse\x12?\n" +
+	"\bSnapshot\x12\x18.bank.TransactionRequest\x1a\x19.bank.TransactionResponse\x12=\n" +
+	"\x06Commit\x12\x18.bank.TransactionRequest\x1a\x19.bank.TransactionResponse\x12<\n" +
+	"\x05Abort\x12\x18.bank.TransactionRequest\x1a\x19.bank.TransactionResponse\x12;\n" +
+	"\x04Join\x12\x18.bank.TransactionRequest\x1a\x19.bank.TransactionResponse\x12<\n" +
+	"\x05Leave\x12\x18.bank.TransactionRequest\x1a\x19.bank.TransactionResponse24\n" +
+	"\x06Branch\x12*\n" +
+	"\bExchange\x12\f.bank.Packet\x1a\f.bank.Packet(\x010\x01B\x13Z\x11bank/proto;bankpbb\x06proto3"
+
+var (
+	file_proto_bank_proto_rawDescOnce sync.Once
+	file_proto_bank_proto_rawDescData []byte
+)
+
+func file_proto_bank_proto_rawDescGZIP() []byte {
+	file_proto_bank_proto_rawDescOnce.Do(func() {
+		file_proto_bank_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_proto_bank_proto_rawDesc), len(file_proto_bank_proto_rawDesc)))
+	})
+	return file_proto_bank_proto_rawDescData
+}
+
+var file_proto_bank_proto_enumTypes = make([]protoimpl.EnumInfo, 7)
+var file_proto_bank_proto_msgTypes = make([]protoimpl.MessageInfo, 13)
+var file_proto_bank_proto_goTypes = []any{
+	(CommandType)(0),            // 0: bank.CommandType
+	(Operation)(0),              // 1: bank.Operation
+	(Status)(0),                 // 2: bank.Status
+	(AbortCode)(0),              // 3: bank.AbortCode
+	(Role)(0),                   // 4: bank.Role
+	(MemberState)(0),            // 5: bank.MemberState
+	(TransactionState)(0),       // 6: bank.TransactionState
+	(*Handshake)(nil),           // 7: bank.Handshake
+	(*Request)(nil),             // 8: bank.Request
+	(*Balance)(nil),             // 9: bank.Balance
+	(*HistoryEntry)(nil),        // 10: bank.HistoryEntry
+	(*TransactionStatus)(nil),   // 11: bank.TransactionStatus
+	(*Response)(nil),            // 12: bank.Response
+	(*AbortReason)(nil),         // 13: bank.AbortReason
+	(*Packet)(nil),              // 14: bank.Packet
+	(*TraceContext)(nil),        // 15: bank.TraceContext
+	(*Member)(nil),              // 16: bank.Member
+	(*Membership)(nil),          // 17: bank.Membership
+	(*TransactionRequest)(nil),  // 18: bank.TransactionRequest
+	(*TransactionResponse)(nil), // 19: bank.TransactionResponse
+}
+var file_proto_bank_proto_depIdxs = []int32{
+	4,  // 0: bank.Handshake.role:type_name -> bank.Role
+	1,  // 1: bank.Request.operation:type_name -> bank.Operation
+	6,  // 2: bank.TransactionStatus.state:type_name -> bank.TransactionState
+	2,  // 3: bank.Response.status:type_name -> bank.Status
+	9,  // 4: bank.Response.balances:type_name -> bank.Balance
+	10, // 5: bank.Response.history:type_name -> bank.HistoryEntry
+	11, // 6: bank.Response.in_flight:type_name -> bank.TransactionStatus
+	13, // 7: bank.Response.abort:type_name -> bank.AbortReason
+	3,  // 8: bank.AbortReason.code:type_name -> bank.AbortCode
+	0,  // 9: bank.Packet.command_type:type_name -> bank.CommandType
+	8,  // 10: bank.Packet.request:type_name -> bank.Request
+	12, // 11: bank.Packet.response:type_name -> bank.Response
+	7,  // 12: bank.Packet.handshake:type_name -> bank.Handshake
+	17, // 13: bank.Packet.membership:type_name -> bank.Membership
+	15, // 14: bank.Packet.trace:type_name -> bank.TraceContext
+	5,  // 15: bank.Member.state:type_name -> bank.MemberState
+	16, // 16: bank.Membership.branches:type_name -> bank.Member
+	8,  // 17: bank.TransactionRequest.request:type_name -> bank.Request
+	12, // 18: bank.TransactionResponse.response:type_name -> bank.Response
+	7,  // 19: bank.Bank.Handshake:input_type -> bank.Handshake
+	18, // 20: bank.Bank.Begin:input_type -> bank.TransactionRequest
+	18, // 21: bank.Bank.Deposit:input_type -> bank.TransactionRequest
+	18, // 22: bank.Bank.Withdraw:input_type -> bank.TransactionRequest
+	18, // 23: bank.Bank.Balance:input_type -> bank.TransactionRequest
+	18, // 24: bank.Bank.Open:input_type -> bank.TransactionRequest
+	18, // 25: bank.Bank.Close:input_type -> bank.TransactionRequest
+	18, // 26: bank.Bank.History:input_type -> bank.TransactionRequest
+	18, // 27: bank.Bank.Snapshot:input_type -> bank.TransactionRequest
+	18, // 28: bank.Bank.Commit:input_type -> bank.TransactionRequest
+	18, // 29: bank.Bank.Abort:input_type -> bank.TransactionRequest
+	18, // 30: bank.Bank.Join:input_type -> bank.TransactionRequest
+	18, // 31: bank.Bank.Leave:input_type -> bank.TransactionRequest
+	14, // 32: bank.Branch.Exchange:input_type -> bank.Packet
+	7,  // 33: bank.Bank.Handshake:output_type -> bank.Handshake
+	19, // 34: bank.Bank.Begin:output_type -> bank.TransactionResponse
+	19, // 35: bank.Bank.Deposit:output_type -> bank.TransactionResponse
+	19, // 36: bank.Bank.Withdraw:output_type -> bank.TransactionResponse
+	19, // 37: bank.Bank.Balance:output_type -> bank.TransactionResponse
+	19, // 38: bank.Bank.Open:output_type -> bank.TransactionResponse
+	19, // 39: bank.Bank.Close:output_type -> bank.TransactionResponse
+	19, // 40: bank.Bank.History:output_type -> bank.TransactionResponse
+	19, // 41: bank.Bank.Snapshot:output_type -> bank.TransactionResponse
+	19, // 42: bank.Bank.Commit:output_type -> bank.TransactionResponse
+	19, // 43: bank.Bank.Abort:output_type -> bank.TransactionResponse
+	19, // 44: bank.Bank.Join:output_type -> bank.TransactionResponse
+	19, // 45: bank.Bank.Leave:output_type -> bank.TransactionResponse
+	14, // 46: bank.Branch.Exchange:output_type -> bank.Packet
+	33, // [33:47] is the sub-list for method output_type
+	19, // [19:33] is the sub-list for method input_type
+	19, // [19:19] is the sub-list for extension type_name
+	19, // [19:19] is the sub-list for extension extendee
+	0,  // [0:19] is the sub-list for field type_name
+}
+
+func init() { file_proto_bank_proto_init() }
+func file_proto_bank_proto_init() {
+	if File_proto_bank_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_bank_proto_rawDesc), len(file_proto_bank_proto_rawDesc)),
+			NumEnums:      7,
+			NumMessages:   13,
+			NumExtensions: 0,
+			NumServices:   2,
+		},
+		GoTypes:           file_proto_bank_proto_goTypes,
+		DependencyIndexes: file_proto_bank_proto_depIdxs,
+		EnumInfos:         file_proto_bank_proto_enumTypes,
+		MessageInfos:      file_proto_bank_proto_msgTypes,
+	}.Build()
+	File_proto_bank_proto = out.File
+	file_proto_bank_proto_goTypes = nil
+	file_proto_bank_proto_depIdxs = nil
+}
@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type Encoder interface {
+	Encode(e interface{}) error
+}
+
+type Decoder interface {
+	Decode(e interface{}) error
+}
+
+// Codec frames packets on a connection. Every listener picks one, so a branch
+// can serve gob to the Go client and newline-delimited JSON to everything else.
+type Codec interface {
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+type GobCodec struct {
+}
+
+func (c GobCodec) NewEncoder(w io.Writer) Encoder {
+	return gob.NewEncoder(w)
+}
+
+func (c GobCodec) NewDecoder(r io.Reader) Decoder {
+	return gob.NewDecoder(r)
+}
+
+// JSONCodec writes one JSON object per line, which makes it usable from nc.
+type JSONCodec struct {
+}
+
+func (c JSONCodec) NewEncoder(w io.Writer) Encoder {
+	return json.NewEncoder(w)
+}
+
+func (c JSONCodec) NewDecoder(r io.Reader) Decoder {
+	return json.NewDecoder(r)
+}
+
+func ParseRequest(command string) (Request, error) {
+	commandInfo := strings.Fields(command)
+	if len(commandInfo) == 0 {
+		return Request{}, errors.New("empty command")
+	}
+	request := Request{}
+	for operation, name := range operationNames {
+		if name == commandInfo[0] {
+			request.Operation = operation
+		}
+	}
+	if request.Operation == NoOperation {
+		return request, errors.New("unknown operation")
+	}
+	switch request.Operation {
+	case OpJoin:
+		if len(commandInfo) != 3 {
+			return request, errors.New("JOIN takes a branch and its host:port")
+		}
+		if _, _, err := net.SplitHostPort(commandInfo[2]); err != nil {
+			return request, err
+		}
+		request.Branch = commandInfo[1]
+		request.Address = commandInfo[2]
+		return request, nil
+	case OpLeave:
+		if len(commandInfo) != 2 {
+			return request, errors.New("LEAVE takes a branch")
+		}
+		request.Branch = commandInfo[1]
+		return request, nil
+	case OpBegin, OpCommit, OpAbort, OpSnapshot:
+		if len(commandInfo) != 1 {
+			return request, fmt.Errorf("%s takes no arguments", commandInfo[0])
+		}
+		return request, nil
+	}
+	if len(commandInfo) == 1 {
+		return request, fmt.Errorf("%s takes a branch.account", commandInfo[0])
+	}
+	accountInfo := strings.Split(commandInfo[1], ".")
+	if len(accountInfo) != 2 || accountInfo[0] == "" || accountInfo[1] == "" {
+		return request, errors.New("account should be branch.account")
+	}
+	if (request.Operation == OpDeposit || request.Operation == OpWithdraw) && len(commandInfo) == 2 {
+		return request, fmt.Errorf("%s takes a branch.account and an amount", commandInfo[0])
+	}
+	request.Branch = accountInfo[0]
+	request.Account = accountInfo[1]
+	var err error
+	if len(commandInfo) == 3 {
+		request.Amount, err = strconv.Atoi(commandInfo[2])
+		if err == nil && request.Amount <= 0 && (request.Operation == OpDeposit || request.Operation == OpWithdraw) {
+			err = errors.New("amount must be positive")
+		}
+	} else if len(commandInfo) == 4 && commandInfo[2] == "LIMIT" {
+		request.Limit, err = strconv.Atoi(commandInfo[3])
+	} else if len(commandInfo) == 5 && commandInfo[2] == "AS" && commandInfo[3] == "OF" {
+		request.AsOf = commandInfo[4]
+	} else if len(commandInfo) != 2 {
+		err = errors.New("too many arguments")
+	}
+	return request, err
+}
+
+func FormatResponse(request Request, response Response) string {
+	if response.Status != StatusOK {
+		status := response.Status.String()
+		if response.Abort.Code != NoAbortCode {
+			status += " " + response.Abort.String()
+		}
+		if response.Message != "" {
+			return status + ": " + response.Message
+		}
+		return status
+	}
+	switch request.Operation {
+	case OpBalance:
+		if request.Branch == "*" || request.Account == "*" {
+			if len(response.Balances) == 0 {
+				return "NO ACCOUNTS"
+			}
+			lines := make([]string, len(response.Balances))
+			for i, balance := range response.Balances {
+				lines[i] = fmt.Sprintf("%s.%s = %d", balance.Branch, balance.Account, balance.Value)
+			}
+			return strings.Join(lines, "\n")
+		}
+		if len(response.Balances) == 1 {
+			balance := response.Balances[0]
+			line := fmt.Sprintf("%s.%s = %d", balance.Branch, balance.Account, balance.Value)
+			if request.AsOf != "" {
+				line += " AS OF " + request.AsOf
+			}
+			return line
+		}
+	case OpHistory:
+		if len(response.History) == 0 {
+			return "NO HISTORY"
+		}
+		lines := make([]string, len(response.History))
+		for i, entry := range response.History {
+			lines[i] = fmt.Sprintf("%s.%s %s %+d = %d", request.Branch, request.Account, entry.TransactionId, entry.Delta, entry.Balance)
+		}
+		return strings.Join(lines, "\n")
+	case OpSnapshot:
+		return fmt.Sprintf("SNAPSHOT OK %s TOTAL %d", response.Snapshot, response.Total)
+	}
+	return "OK"
+}
@@ -0,0 +1,133 @@
+package protocol
+
+import (
+	"fmt"
+	"testing"
+
+	bankpb "bank/proto"
+)
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		command string
+		request Request
+	}{
+		{"BEGIN", Request{Operation: OpBegin}},
+		{"  COMMIT  ", Request{Operation: OpCommit}},
+		{"DEPOSIT A.x 10", Request{Operation: OpDeposit, Branch: "A", Account: "x", Amount: 10}},
+		{"WITHDRAW B.y 5", Request{Operation: OpWithdraw, Branch: "B", Account: "y", Amount: 5}},
+		{"BALANCE *.*", Request{Operation: OpBalance, Branch: "*", Account: "*"}},
+		{"BALANCE A.x AS OF 12:B", Request{Operation: OpBalance, Branch: "A", Account: "x", AsOf: "12:B"}},
+		{"HISTORY A.x LIMIT 3", Request{Operation: OpHistory, Branch: "A", Account: "x", Limit: 3}},
+		{"OPEN A.x", Request{Operation: OpOpen, Branch: "A", Account: "x"}},
+		{"JOIN F 10.0.0.6:1234", Request{Operation: OpJoin, Branch: "F", Address: "10.0.0.6:1234"}},
+		{"LEAVE F", Request{Operation: OpLeave, Branch: "F"}},
+	}
+	for _, test := range tests {
+		request, err := ParseRequest(test.command)
+		if err != nil || request != test.request {
+			t.Errorf("ParseRequest(%q) = %+v, %v; want %+v", test.command, request, err, test.request)
+		}
+	}
+
+	for _, command := range []string{
+		"",
+		"TRANSFER A.x B.y 5",
+		"DEPOSIT Ax 10",
+		"DEPOSIT A.x ten",
+		"DEPOSIT A.x 10 20",
+		"DEPOSIT A.x 0",
+		"WITHDRAW B.y -5",
+		"HISTORY A.x LIMIT",
+		"BALANCE A.x AS 12:B",
+		"JOIN F",
+		"JOIN F 10.0.0.6",
+		"LEAVE F G",
+	} {
+		if _, err := ParseRequest(command); err == nil {
+			t.Errorf("ParseRequest(%q) succeeded, want an error", command)
+		}
+	}
+}
+
+func TestPacketProtoRoundTrip(t *testing.T) {
+	packet := Packet{
+		Version:       ProtocolVersion,
+		Id:            "A",
+		TransactionId: "12:A",
+		CommandType:   ParticipantSnapshot,
+		Request:       Request{Operation: OpHistory, Branch: "A", Account: "x", Limit: 2, AsOf: "10:B"},
+		Response: Response{
+			Status:   StatusSnapshotFailed,
+			Balances: []Balance{{Branch: "A", Account: "x", Value: 5}},
+			History:  []HistoryEntry{{TransactionId: "11:A", Delta: -3, Balance: 5}},
+			InFlight: []TransactionStatus{{Id: "13:B", State: Prepare}},
+			Snapshot: "12:A",
+			Total:    5,
+			Message:  "in flight",
+			Abort:    AbortReason{Code: AbortReadTooLate, Account: "A.x", Conflict: "13:B"},
+		},
+		Handshake:  Handshake{Version: ProtocolVersion, Role: BranchRole, Id: "A", ClusterId: "test", Features: []string{"history"}, Token: "secret", Address: "10.0.0.1:1234"},
+		Membership: Membership{Branches: []Member{{Id: "A", Address: "10.0.0.1", Port: "1234", Incarnation: 2, State: MemberSuspect}}},
+		Trace:      TraceContext{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "00f067aa0ba902b7"},
+	}
+	got := PacketFromProto(PacketToProto(packet))
+	if fmt.Sprint(got) != fmt.Sprint(packet) {
+		t.Errorf("round trip = %+v, want %+v", got, packet)
+	}
+	// Every operation on an account needs one, and those that move money an
+	// amount too.
+	missing := []struct {
+		command string
+		err     string
+	}{
+		{"BALANCE", "BALANCE takes a branch.account"},
+		{"OPEN", "OPEN takes a branch.account"},
+		{"CLOSE", "CLOSE takes a branch.account"},
+		{"HISTORY", "HISTORY takes a branch.account"},
+		{"DEPOSIT", "DEPOSIT takes a branch.account"},
+		{"WITHDRAW", "WITHDRAW takes a branch.account"},
+		{"DEPOSIT A.x", "DEPOSIT takes a branch.account and an amount"},
+		{"BALANCE A", "account should be branch.account"},
+		{"BALANCE A.", "account should be branch.account"},
+		{"OPEN .x", "account should be branch.account"},
+		{"CLOSE A.x.y", "account should be branch.account"},
+		{"BEGIN A.x", "BEGIN takes no arguments"},
+		{"SNAPSHOT *.*", "SNAPSHOT takes no arguments"},
+	}
+	for _, test := range missing {
+		if _, err := ParseRequest(test.command); err == nil || err.Error() != test.err {
+			t.Errorf("ParseRequest(%q) error = %v, want %q", test.command, err, test.err)
+		}
+	}
+}
+
+func TestFormatAbort(t *testing.T) {
+	tests := []struct {
+		response Response
+		line     string
+	}{
+		{Response{Status: StatusAborted}, "ABORTED"},
+		{Response{Status: StatusAborted, Abort: AbortReason{Code: AbortWriteTooLate, Account: "B.y", Conflict: "7:A"}}, "ABORTED WRITE_TOO_LATE account=B.y conflict=7:A"},
+		{Response{Status: StatusAborted, Abort: AbortReason{Code: AbortPeerFailure}, Message: "branch B unavailable"}, "ABORTED PEER_FAILURE: branch B unavailable"},
+		{Response{Status: StatusAborted, Abort: AbortReason{Code: AbortCloseNonzeroBalance, Account: "A.x"}}, "ABORTED CLOSE_NONZERO_BALANCE account=A.x"},
+	}
+	for _, test := range tests {
+		if line := FormatResponse(Request{Operation: OpDeposit}, test.response); line != test.line {
+			t.Errorf("FormatResponse(%+v) = %q, want %q", test.response, line, test.line)
+		}
+	}
+}
+
+// Abort codes travel by number in protobuf and by name in text, so both
+// must name each code alike.
+func TestAbortCodeNames(t *testing.T) {
+	for code, name := range abortCodeNames {
+		if code == NoAbortCode {
+			continue
+		}
+		if protoName := bankpb.AbortCode(code).String(); protoName != name {
+			t.Errorf("%s is %s in the proto", name, protoName)
+		}
+	}
+}
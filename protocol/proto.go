@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	bankpb "bank/proto"
+)
+
+// The enumerations in proto/bank.proto are numbered like the Go constants, so
+// conversions are plain casts.
+
+func PacketToProto(packet Packet) *bankpb.Packet {
+	return &bankpb.Packet{
+		Version:       int32(packet.Version),
+		IsClient:      packet.IsClient,
+		Id:            packet.Id,
+		TransactionId: packet.TransactionId,
+		CommandType:   bankpb.CommandType(packet.CommandType),
+		Request:       RequestToProto(packet.Request),
+		Response:      ResponseToProto(packet.Response),
+		Handshake:     HandshakeToProto(packet.Handshake),
+		Membership:    MembershipToProto(packet.Membership),
+		Trace:         &bankpb.TraceContext{TraceId: packet.Trace.TraceId, SpanId: packet.Trace.SpanId},
+	}
+}
+
+func PacketFromProto(message *bankpb.Packet) Packet {
+	return Packet{
+		Version:       int(message.GetVersion()),
+		IsClient:      message.GetIsClient(),
+		Id:            message.GetId(),
+		TransactionId: message.GetTransactionId(),
+		CommandType:   CommandType(message.GetCommandType()),
+		Request:       RequestFromProto(message.GetRequest()),
+		Response:      ResponseFromProto(message.GetResponse()),
+		Handshake:     HandshakeFromProto(message.GetHandshake()),
+		Membership:    MembershipFromProto(message.GetMembership()),
+		Trace:         TraceContext{TraceId: message.GetTrace().GetTraceId(), SpanId: message.GetTrace().GetSpanId()},
+	}
+}
+
+func HandshakeToProto(handshake Handshake) *bankpb.Handshake {
+	return &bankpb.Handshake{
+		Version:   int32(handshake.Version),
+		Role:      bankpb.Role(handshake.Role),
+		Id:        handshake.Id,
+		ClusterId: handshake.ClusterId,
+		Features:  handshake.Features,
+		Token:     handshake.Token,
+		Address:   handshake.Address,
+	}
+}
+
+func HandshakeFromProto(message *bankpb.Handshake) Handshake {
+	return Handshake{
+		Version:   int(message.GetVersion()),
+		Role:      Role(message.GetRole()),
+		Id:        message.GetId(),
+		ClusterId: message.GetClusterId(),
+		Features:  message.GetFeatures(),
+		Token:     message.GetToken(),
+		Address:   message.GetAddress(),
+	}
+}
+
+func MembershipToProto(membership Membership) *bankpb.Membership {
+	message := &bankpb.Membership{}
+	for _, member := range membership.Branches {
+		message.Branches = append(message.Branches, &bankpb.Member{Id: member.Id, Address: member.Address, Port: member.Port, Incarnation: int32(member.Incarnation), State: bankpb.MemberState(member.State)})
+	}
+	return message
+}
+
+func MembershipFromProto(message *bankpb.Membership) Membership {
+	membership := Membership{}
+	for _, member := range message.GetBranches() {
+		membership.Branches = append(membership.Branches, Member{Id: member.GetId(), Address: member.GetAddress(), Port: member.GetPort(), Incarnation: int(member.GetIncarnation()), State: MemberState(member.GetState())})
+	}
+	return membership
+}
+
+func RequestToProto(request Request) *bankpb.Request {
+	return &bankpb.Request{
+		Operation: bankpb.Operation(request.Operation),
+		Branch:    request.Branch,
+		Account:   request.Account,
+		Amount:    int64(request.Amount),
+		Limit:     int32(request.Limit),
+		AsOf:      request.AsOf,
+		Address:   request.Address,
+	}
+}
+
+func RequestFromProto(message *bankpb.Request) Request {
+	return Request{
+		Operation: Operation(message.GetOperation()),
+		Branch:    message.GetBranch(),
+		Account:   message.GetAccount(),
+		Amount:    int(message.GetAmount()),
+		Limit:     int(message.GetLimit()),
+		AsOf:      message.GetAsOf(),
+		Address:   message.GetAddress(),
+	}
+}
+
+func ResponseToProto(response Response) *bankpb.Response {
+	message := &bankpb.Response{
+		Status:   bankpb.Status(response.Status),
+		Snapshot: response.Snapshot,
+		Total:    int64(response.Total),
+		Message:  response.Message,
+	}
+	if response.Abort.Code != NoAbortCode {
+		message.Abort = &bankpb.AbortReason{Code: bankpb.AbortCode(response.Abort.Code), Account: response.Abort.Account, Conflict: response.Abort.Conflict}
+	}
+	for _, balance := range response.Balances {
+		message.Balances = append(message.Balances, &bankpb.Balance{Branch: balance.Branch, Account: balance.Account, Value: int64(balance.Value)})
+	}
+	for _, entry := range response.History {
+		message.History = append(message.History, &bankpb.HistoryEntry{TransactionId: entry.TransactionId, Delta: int64(entry.Delta), Balance: int64(entry.Balance)})
+	}
+	for _, transaction := range response.InFlight {
+		message.InFlight = append(message.InFlight, &bankpb.TransactionStatus{Id: transaction.Id, State: bankpb.TransactionState(transaction.State)})
+	}
+	return message
+}
+
+func ResponseFromProto(message *bankpb.Response) Response {
+	response := Response{
+		Status:   Status(message.GetStatus()),
+		Snapshot: message.GetSnapshot(),
+		Total:    int(message.GetTotal()),
+		Message:  message.GetMessage(),
+		Abort: AbortReason{
+			Code:     AbortCode(message.GetAbort().GetCode()),
+			Account:  message.GetAbort().GetAccount(),
+			Conflict: message.GetAbort().GetConflict(),
+		},
+	}
+	for _, balance := range message.GetBalances() {
+		response.Balances = append(response.Balances, Balance{Branch: balance.GetBranch(), Account: balance.GetAccount(), Value: int(balance.GetValue())})
+	}
+	for _, entry := range message.GetHistory() {
+		response.History = append(response.History, HistoryEntry{TransactionId: entry.GetTransactionId(), Delta: int(entry.GetDelta()), Balance: int(entry.GetBalance())})
+	}
+	for _, transaction := range message.GetInFlight() {
+		response.InFlight = append(response.InFlight, TransactionStatus{Id: transaction.GetId(), State: TransactionState(transaction.GetState())})
+	}
+	return response
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Certificates are issued by the cluster CA and name their holder in the
+// subject: CommonName is the branch or client id and OrganizationalUnit is
+// "branch" or "client". Branch certificates also carry the branch id as a DNS
+// name, which is the server name dialers verify.
+
+var roleUnits = map[string]Role{
+	"branch": BranchRole,
+	"client": ClientRole,
+}
+
+// TLSFiles locates the PEM files a node presents. With no CA, TLS is off.
+type TLSFiles struct {
+	CA   string
+	Cert string
+	Key  string
+}
+
+// Enabled reports whether the cluster runs over TLS.
+func (f TLSFiles) Enabled() bool {
+	return f.CA != ""
+}
+
+// Resolve fills in Cert and Key for id from the directory dir when they were
+// not given explicitly.
+func (f TLSFiles) Resolve(dir string, id string) TLSFiles {
+	if f.Cert == "" {
+		f.Cert = filepath.Join(dir, id+".crt")
+	}
+	if f.Key == "" {
+		f.Key = filepath.Join(dir, id+".key")
+	}
+	return f
+}
+
+// Load builds a configuration that presents the node's certificate and
+// requires and verifies the peer's against the CA, whichever side dials.
+func (f TLSFiles) Load() (*tls.Config, error) {
+	ca, err := os.ReadFile(f.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", f.CA)
+	}
+	certificate, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// CertificateIdentity returns the role and id a verified certificate was
+// issued for.
+func CertificateIdentity(certificate *x509.Certificate) (Role, string, error) {
+	if certificate.Subject.CommonName == "" {
+		return 0, "", errors.New("certificate has no common name")
+	}
+	for _, unit := range certificate.Subject.OrganizationalUnit {
+		if role, ok := roleUnits[unit]; ok {
+			return role, certificate.Subject.CommonName, nil
+		}
+	}
+	return 0, "", fmt.Errorf("certificate for %q names neither a branch nor a client", certificate.Subject.CommonName)
+}
+
+// CheckPeerIdentity returns why a peer that presented certificates may not
+// claim role and id, or an empty string if it may.
+func CheckPeerIdentity(certificates []*x509.Certificate, role Role, id string) string {
+	if len(certificates) == 0 {
+		return "no certificate presented"
+	}
+	certifiedRole, certifiedId, err := CertificateIdentity(certificates[0])
+	if err != nil {
+		return err.Error()
+	}
+	if certifiedRole != role || certifiedId != id {
+		return fmt.Sprintf("certificate for %s %q does not match %s %q", certifiedRole, certifiedId, role, id)
+	}
+	return ""
+}
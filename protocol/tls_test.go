@@ -0,0 +1,32 @@
+package protocol
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestCheckPeerIdentity(t *testing.T) {
+	certificate := func(unit string, name string) []*x509.Certificate {
+		return []*x509.Certificate{{Subject: pkix.Name{OrganizationalUnit: []string{unit}, CommonName: name}}}
+	}
+	tests := []struct {
+		certificates []*x509.Certificate
+		role         Role
+		id           string
+		ok           bool
+	}{
+		{certificate("branch", "B"), BranchRole, "B", true},
+		{certificate("client", "alice"), ClientRole, "alice", true},
+		{certificate("client", "B"), BranchRole, "B", false},
+		{certificate("branch", "A"), BranchRole, "B", false},
+		{certificate("bank", "B"), BranchRole, "B", false},
+		{nil, ClientRole, "alice", false},
+	}
+	for _, test := range tests {
+		reason := CheckPeerIdentity(test.certificates, test.role, test.id)
+		if (reason == "") != test.ok {
+			t.Errorf("CheckPeerIdentity(%s %q) = %q, want ok=%v", test.role, test.id, reason, test.ok)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+// Package protocol holds what branches and clients exchange: the Packet and
+// the types inside it, the codecs that frame packets on a connection, and the
+// text form of commands and responses.
+package protocol
+
+type CommandType int
+
+const (
+	ClientRequest CommandType = iota
+	CoordinatorResponse
+	CoordinatorRequest
+	CoordinatorPrepare
+	CoordinatorCommit
+	CoordinatorAbort
+	ParticipantResponse
+	ParticipantYes
+	ParticipantAbort
+	CoordinatorSnapshot
+	ParticipantSnapshot
+	HandshakeRequest
+	HandshakeResponse
+	Heartbeat
+	MembershipUpdate
+	// PingRequest asks a branch whether it hears the branch in
+	// Request.Branch, and PingAck answers that it does.
+	PingRequest
+	PingAck
+)
+
+var commandTypeNames = map[CommandType]string{
+	ClientRequest:       "ClientRequest",
+	CoordinatorResponse: "CoordinatorResponse",
+	CoordinatorRequest:  "CoordinatorRequest",
+	CoordinatorPrepare:  "CoordinatorPrepare",
+	CoordinatorCommit:   "CoordinatorCommit",
+	CoordinatorAbort:    "CoordinatorAbort",
+	ParticipantResponse: "ParticipantResponse",
+	ParticipantYes:      "ParticipantYes",
+	ParticipantAbort:    "ParticipantAbort",
+	CoordinatorSnapshot: "CoordinatorSnapshot",
+	ParticipantSnapshot: "ParticipantSnapshot",
+	HandshakeRequest:    "HandshakeRequest",
+	HandshakeResponse:   "HandshakeResponse",
+	Heartbeat:           "Heartbeat",
+	MembershipUpdate:    "MembershipUpdate",
+	PingRequest:         "PingRequest",
+	PingAck:             "PingAck",
+}
+
+func (c CommandType) String() string {
+	if name, ok := commandTypeNames[c]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+const ProtocolVersion = 3
+
+// SupportedFeatures are the optional parts of the protocol this code speaks,
+// offered in every handshake.
+var SupportedFeatures = []string{"history", "as-of", "wildcard-balance", "snapshot", "heartbeat", "ping-req"}
+
+type Role int
+
+const (
+	ClientRole Role = iota
+	BranchRole
+)
+
+func (r Role) String() string {
+	if r == BranchRole {
+		return "branch"
+	}
+	return "client"
+}
+
+type Handshake struct {
+	Version   int
+	Role      Role
+	Id        string
+	ClusterId string
+	Features  []string
+	// Token authenticates a client when the branch requires it.
+	Token string
+	// Address is where a branch listens, as host:port, so that a branch
+	// that has not heard of it can add it to the membership.
+	Address string
+}
+
+type Operation int
+
+const (
+	NoOperation Operation = iota
+	OpBegin
+	OpDeposit
+	OpWithdraw
+	OpBalance
+	OpOpen
+	OpClose
+	OpHistory
+	OpSnapshot
+	OpCommit
+	OpAbort
+	OpJoin
+	OpLeave
+)
+
+var operationNames = map[Operation]string{
+	OpBegin:    "BEGIN",
+	OpDeposit:  "DEPOSIT",
+	OpWithdraw: "WITHDRAW",
+	OpBalance:  "BALANCE",
+	OpOpen:     "OPEN",
+	OpClose:    "CLOSE",
+	OpHistory:  "HISTORY",
+	OpSnapshot: "SNAPSHOT",
+	OpCommit:   "COMMIT",
+	OpAbort:    "ABORT",
+	OpJoin:     "JOIN",
+	OpLeave:    "LEAVE",
+}
+
+func (o Operation) String() string {
+	if name, ok := operationNames[o]; ok {
+		return name
+	}
+	return "NONE"
+}
+
+type Status int
+
+const (
+	StatusOK Status = iota
+	StatusCommitOK
+	StatusAborted
+	StatusNotFound
+	StatusAccountExists
+	StatusNonzeroBalance
+	StatusNotRetained
+	StatusNotStable
+	StatusInvalid
+	StatusSnapshotFailed
+	StatusVersionMismatch
+	StatusRefused
+	StatusPermissionDenied
+)
+
+var statusNames = map[Status]string{
+	StatusOK:               "OK",
+	StatusCommitOK:         "COMMIT OK",
+	StatusAborted:          "ABORTED",
+	StatusNotFound:         "NOT FOUND, ABORTED",
+	StatusAccountExists:    "ACCOUNT EXISTS, ABORTED",
+	StatusNonzeroBalance:   "NONZERO BALANCE, ABORTED",
+	StatusNotRetained:      "VERSION NOT RETAINED, ABORTED",
+	StatusNotStable:        "VERSION NOT STABLE, ABORTED",
+	StatusInvalid:          "INVALID COMMAND",
+	StatusSnapshotFailed:   "SNAPSHOT FAILED",
+	StatusVersionMismatch:  "PROTOCOL VERSION MISMATCH",
+	StatusRefused:          "REFUSED",
+	StatusPermissionDenied: "PERMISSION DENIED",
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// AbortCode says why a transaction aborted, so a client can tell a conflict
+// worth retrying at once from a failure worth waiting out.
+type AbortCode int
+
+const (
+	NoAbortCode AbortCode = iota
+	// AbortReadTooLate is a read of an account a later transaction has
+	// already committed.
+	AbortReadTooLate
+	// AbortWriteTooLate is a write to an account a later transaction has
+	// already read or committed.
+	AbortWriteTooLate
+	// AbortReadBlocked is a read of an account with an earlier tentative
+	// write, when the branch does not wait for it.
+	AbortReadBlocked
+	AbortNegativeBalance
+	AbortParticipantTimeout
+	AbortClientRequested
+	AbortPeerFailure
+	// AbortCloseNonzeroBalance is a close of an account that would still
+	// hold money when the transaction commits.
+	AbortCloseNonzeroBalance
+)
+
+var abortCodeNames = map[AbortCode]string{
+	NoAbortCode:              "NONE",
+	AbortReadTooLate:         "READ_TOO_LATE",
+	AbortWriteTooLate:        "WRITE_TOO_LATE",
+	AbortReadBlocked:         "READ_BLOCKED",
+	AbortNegativeBalance:     "NEGATIVE_BALANCE",
+	AbortParticipantTimeout:  "PARTICIPANT_TIMEOUT",
+	AbortClientRequested:     "CLIENT_ABORT",
+	AbortPeerFailure:         "PEER_FAILURE",
+	AbortCloseNonzeroBalance: "CLOSE_NONZERO_BALANCE",
+}
+
+func (c AbortCode) String() string {
+	if name, ok := abortCodeNames[c]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// AbortReason is why a transaction aborted. Account is qualified by branch,
+// as in A.x, and Conflict is the timestamp of the transaction it conflicted
+// with; either is empty where it does not apply.
+type AbortReason struct {
+	Code     AbortCode
+	Account  string
+	Conflict string
+}
+
+func (r AbortReason) String() string {
+	reason := r.Code.String()
+	if r.Account != "" {
+		reason += " account=" + r.Account
+	}
+	if r.Conflict != "" {
+		reason += " conflict=" + r.Conflict
+	}
+	return reason
+}
+
+type Request struct {
+	Operation Operation
+	Branch    string
+	Account   string
+	Amount    int
+	Limit     int
+	AsOf      string
+	// Address is where a joining branch listens, as host:port.
+	Address string
+}
+
+type Balance struct {
+	Branch  string
+	Account string
+	Value   int
+}
+
+type TransactionStatus struct {
+	Id    string
+	State TransactionState
+}
+
+type Response struct {
+	Status   Status
+	Balances []Balance
+	History  []HistoryEntry
+	InFlight []TransactionStatus
+	Snapshot string
+	Total    int
+	Message  string
+	Abort    AbortReason
+}
+
+type Packet struct {
+	Version       int
+	IsClient      bool
+	Id            string
+	TransactionId string
+	CommandType   CommandType
+	Request       Request
+	Response      Response
+	Handshake     Handshake
+	Membership    Membership
+	Trace         TraceContext
+}
+
+// TraceContext names the span a packet was sent from, so the span that
+// handles it joins the same trace. Ids are hex, as in W3C trace context.
+type TraceContext struct {
+	TraceId string
+	SpanId  string
+}
+
+// MemberState is what the cluster believes about a branch. Left is for
+// branches removed with LEAVE, which do not come back on their own.
+type MemberState int
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+	MemberLeft
+)
+
+var memberStateNames = map[MemberState]string{
+	MemberAlive:   "ALIVE",
+	MemberSuspect: "SUSPECT",
+	MemberDead:    "DEAD",
+	MemberLeft:    "LEFT",
+}
+
+func (s MemberState) String() string {
+	return memberStateNames[s]
+}
+
+// Member is one branch's entry in the membership. Only the branch itself
+// raises its Incarnation, to refute being suspected or declared dead.
+type Member struct {
+	Id          string
+	Address     string
+	Port        string
+	Incarnation int
+	State       MemberState
+}
+
+// Supersedes reports whether m is newer news about a branch than other: a
+// higher incarnation wins, and within one incarnation the later state does.
+func (m Member) Supersedes(other Member) bool {
+	if m.Incarnation != other.Incarnation {
+		return m.Incarnation > other.Incarnation
+	}
+	return m.State > other.State
+}
+
+// Membership is a branch's view of the cluster, which branches gossip to
+// each other and merge member by member.
+type Membership struct {
+	Branches []Member
+}
+
+type HistoryEntry struct {
+	TransactionId string
+	Delta         int
+	Balance       int
+}
+
+type TransactionState int
+
+const (
+	Open TransactionState = iota
+	Prepare
+	Committed
+	Aborted
+)
+
+func (s TransactionState) String() string {
+	switch s {
+	case Open:
+		return "OPEN"
+	case Prepare:
+		return "PREPARE"
+	case Committed:
+		return "COMMITTED"
+	case Aborted:
+		return "ABORTED"
+	}
+	return "UNKNOWN"
+}